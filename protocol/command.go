@@ -3,44 +3,372 @@ package protocol
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
 // examples
 // CHAT/1.0 SEND Body[name data]\n
-// CHAT/1.0 LOGIN Body[username]\n
+// CHAT/1.0 LOGIN Body[username password]\n
 // CHAT/1.0 LOGOUT\n
 // CHAT/1.0 RECEIVE Body[from data]\n
 // CHAT/1.0 GROUP Body[groupname username ...]\n
 // CHAT/1.0 LEAVE Body[groupname]\n
 // CHAT/1.0 BROADCAST Body[groupname data]\n
+// CHAT/1.0 OK\n
+// CHAT/1.0 ERROR Body[code message]\n
+// CHAT/1.1 HELLO Body[version,... capability,...]\n
+// CHAT/1.0 NOTICE Body[kind text]\n
+// CHAT/1.0 HISTORY Body[USER|GROUP name BEFORE|AFTER cursor limit]\n
+// CHAT/1.0 MESSAGE Body[id timestamp seq from data]\n
+// CHAT/1.2 DELIVERED Body[id user count total]\n
+// CHAT/1.2 READ Body[id]\n
+// CHAT/1.2 READ Body[id user count total]\n
+// CHAT/1.2 SESSION Body[token]\n
+// CHAT/1.0 PING Body[data]\n
+// CHAT/1.0 PONG Body[data]\n
+// CHAT/1.0 STATUS Body[state message]\n
+// CHAT/1.0 PRESENCE Body[user state since message]\n
+// CHAT/1.0 SUBSCRIBE Body[user]\n
+// CHAT/1.0 UNSUBSCRIBE Body[user]\n
+// CHAT/1.0 LIST Body[USERS|GROUPS limit after]\n
+// CHAT/1.0 LIST Body[MEMBERS group limit after]\n
+// CHAT/1.0 NAMES Body[USERS|GROUPS|MEMBERS MORE|END name1 name2 ...]\n
+// CHAT/1.0 WHOIS Body[user]\n
+// CHAT/1.0 USERINFO Body[user state since group1,group2 message]\n
+// CHAT/1.0 INVITE Body[group user]\n
+// CHAT/1.0 JOIN Body[group]\n
+// CHAT/1.0 KICK Body[group user]\n
+// CHAT/1.0 PROMOTE Body[group user role]\n
+// CHAT/1.0 ACCEPT Body[group]\n
+// CHAT/1.0 DECLINE Body[group]\n
+// CHAT/1.0 MUTE Body[target seconds group]\n
+// CHAT/1.0 UNMUTE Body[target group]\n
+// CHAT/1.0 BAN Body[target seconds group]\n
+// CHAT/1.0 UNBAN Body[target group]\n
+// CHAT/1.0 DISCONNECT Body[user]\n
+// CHAT/1.0 CHANNEL Body[channel]\n
+// CHAT/1.0 LIST Body[CHANNELS limit after]\n
+// CHAT/1.0 TOPIC Body[group topic]\n
+// CHAT/1.0 DESCRIPTION Body[group description]\n
+// CHAT/1.2 RESUME Body[token lastid]\n
+//
+// since 1.1 an optional client-chosen request id may follow the version, the
+// server echoes it in its reply and in the RECEIVE delivered to recipients
+// CHAT/1.1 #42 SEND Body[name data]\n
+//
+// since 1.2 RECEIVE carries the message id, the server timestamp, the
+// sequence number within its conversation and the conversation itself
+// CHAT/1.2 RECEIVE Body[id timestamp seq USER|GROUP name from data]\n
+//
+// since 1.3 the server PINGs clients that went quiet, which answer with PONG
 
 const (
-	ProtocolName    = "CHAT"
-	ProtocolVersion = "1.0"
-	ProtocolSep     = " "
-
-	CmdSend      = "SEND"
-	CmdBroadCast = "BROADCAST"
-	CmdLogin     = "LOGIN"
-	CmdLogout    = "LOGOUT"
-	CmdReceive   = "RECEIVE"
-	CmdGroup     = "GROUP"
-	CmdLeave     = "LEAVE"
+	ProtocolName      = "CHAT"
+	ProtocolVersion10 = "1.0"
+	ProtocolVersion11 = "1.1"
+	ProtocolVersion12 = "1.2"
+	ProtocolVersion13 = "1.3"
+	ProtocolVersion   = ProtocolVersion10
+	ProtocolSep       = " "
+	ListSep           = ","
+	RequestIDPrefix   = "#"
+
+	CmdSend        = "SEND"
+	CmdBroadCast   = "BROADCAST"
+	CmdLogin       = "LOGIN"
+	CmdLogout      = "LOGOUT"
+	CmdReceive     = "RECEIVE"
+	CmdGroup       = "GROUP"
+	CmdLeave       = "LEAVE"
+	CmdOk          = "OK"
+	CmdError       = "ERROR"
+	CmdHello       = "HELLO"
+	CmdNotice      = "NOTICE"
+	CmdHistory     = "HISTORY"
+	CmdMessage     = "MESSAGE"
+	CmdDelivered   = "DELIVERED"
+	CmdRead        = "READ"
+	CmdSession     = "SESSION"
+	CmdResume      = "RESUME"
+	CmdPing        = "PING"
+	CmdPong        = "PONG"
+	CmdStatus      = "STATUS"
+	CmdPresence    = "PRESENCE"
+	CmdSubscribe   = "SUBSCRIBE"
+	CmdUnsubscribe = "UNSUBSCRIBE"
+	CmdList        = "LIST"
+	CmdNames       = "NAMES"
+	CmdWhois       = "WHOIS"
+	CmdUserInfo    = "USERINFO"
+	CmdInvite      = "INVITE"
+	CmdJoin        = "JOIN"
+	CmdKick        = "KICK"
+	CmdPromote     = "PROMOTE"
+	CmdAccept      = "ACCEPT"
+	CmdDecline     = "DECLINE"
+	CmdMute        = "MUTE"
+	CmdUnmute      = "UNMUTE"
+	CmdBan         = "BAN"
+	CmdUnban       = "UNBAN"
+	CmdDisconnect  = "DISCONNECT"
+	CmdChannel     = "CHANNEL"
+	CmdTopic       = "TOPIC"
+	CmdDescription = "DESCRIPTION"
+)
+
+const (
+	// CapabilityReceipts makes the server send DELIVERED and READ receipts
+	// for the messages a client sends, it needs the message ids of 1.2.
+	CapabilityReceipts = "receipts"
+	// CapabilityPresence makes the server send PRESENCE for the users who
+	// share a group with the client or it subscribed to.
+	CapabilityPresence = "presence"
+)
+
+const (
+	ErrCodeUnknownUser    = "UNKNOWN_USER"
+	ErrCodeNoSuchGroup    = "NO_SUCH_GROUP"
+	ErrCodeNotLoggedIn    = "NOT_LOGGED_IN"
+	ErrCodeInvalidMessage = "INVALID_MESSAGE"
+	ErrCodeUnsupportedCmd = "UNSUPPORTED_CMD"
+	ErrCodeInternal       = "INTERNAL"
+	ErrCodeUnsupportedVer = "UNSUPPORTED_VERSION"
+	ErrCodeAuthFailed     = "AUTH_FAILED"
+	ErrCodeAlreadyLogin   = "ALREADY_LOGGED_IN"
+	ErrCodeNotMember      = "NOT_MEMBER"
+	ErrCodeUnknownMessage = "UNKNOWN_MESSAGE"
+	ErrCodeInvalidSession = "INVALID_SESSION"
+	ErrCodeGroupExists    = "GROUP_EXISTS"
+	ErrCodeAlreadyMember  = "ALREADY_MEMBER"
+	ErrCodeNotInvited     = "NOT_INVITED"
+	ErrCodeNoPermission   = "NO_PERMISSION"
+	ErrCodeMuted          = "MUTED"
+	ErrCodeBanned         = "BANNED"
+	ErrCodeRateLimited    = "RATE_LIMITED"
+	ErrCodeTooLarge       = "MESSAGE_TOO_LARGE"
+	ErrCodeInvalidName    = "INVALID_NAME"
+)
+
+const (
+	NoticeSessionReplaced = "SESSION_REPLACED"
+	NoticeShutdown        = "SERVER_SHUTDOWN"
+	NoticeIdleTimeout     = "IDLE_TIMEOUT"
+	// the text of the group notices is the group, the user concerned and
+	// for some who did it: INVITED group by expires, INVITE_DECLINED group
+	// user, MEMBER_JOINED group user, MEMBER_LEFT group user, MEMBER_KICKED
+	// group user by, MEMBER_ROLE group user role by. expires is in unix
+	// milliseconds.
+	NoticeInvited        = "INVITED"
+	NoticeInviteDeclined = "INVITE_DECLINED"
+	NoticeMemberJoined   = "MEMBER_JOINED"
+	NoticeMemberLeft     = "MEMBER_LEFT"
+	NoticeMemberKicked   = "MEMBER_KICKED"
+	NoticeMemberRole     = "MEMBER_ROLE"
+	// the text of TOPIC and DESCRIPTION is the group, who changed it and
+	// the new text, if any.
+	NoticeTopic       = "TOPIC"
+	NoticeDescription = "DESCRIPTION"
+	// the text of the moderation notices is the scope, a group or
+	// ScopeServer, who did it and until when in unix milliseconds, 0 for
+	// good: MUTED scope by until, UNMUTED scope by, BANNED scope by until,
+	// UNBANNED scope by. DISCONNECTED by has no scope.
+	NoticeMuted        = "MUTED"
+	NoticeUnmuted      = "UNMUTED"
+	NoticeBanned       = "BANNED"
+	NoticeUnbanned     = "UNBANNED"
+	NoticeDisconnected = "DISCONNECTED"
+	// the text of RATE_LIMITED is until when in unix milliseconds the
+	// client's IP may not connect again.
+	NoticeRateLimited = "RATE_LIMITED"
+)
+
+// ScopeServer stands for the whole server where a moderation notice names
+// the group it applies to.
+const ScopeServer = "*"
+
+// MaxSanctionDuration is the longest MUTE or BAN in seconds, 100 years. A
+// longer one couldn't be told apart from one that ran out, 0 stands for good.
+const MaxSanctionDuration int64 = 100 * 365 * 24 * 60 * 60
+
+// roles in a group: the owner, who created it, names admins, who may invite
+// and kick members
+const (
+	RoleOwner  = "OWNER"
+	RoleAdmin  = "ADMIN"
+	RoleMember = "MEMBER"
+)
+
+// presence states, OFFLINE is only ever set by the server
+const (
+	PresenceOnline  = "ONLINE"
+	PresenceAway    = "AWAY"
+	PresenceBusy    = "BUSY"
+	PresenceOffline = "OFFLINE"
+)
+
+// what LIST lists: the users online, the groups of the client, the members
+// of a group, the public channels
+const (
+	ListUsers    = "USERS"
+	ListGroups   = "GROUPS"
+	ListMembers  = "MEMBERS"
+	ListChannels = "CHANNELS"
+)
+
+// NAMES tells whether there's another page after this one
+const (
+	NamesMore = "MORE"
+	NamesEnd  = "END"
+)
+
+// EmptyList stands for a list with nothing in it where a field can't be left
+// out.
+const EmptyList = "-"
+
+// a conversation is named by its kind and the peer user or the group
+const (
+	ConversationUser  = "USER"
+	ConversationGroup = "GROUP"
+)
+
+const (
+	HistoryBefore = "BEFORE"
+	HistoryAfter  = "AFTER"
 )
 
 var (
 	InvalidMessageErr = errors.New("invalid message")
 	UnsupportedCmdErr = errors.New("unsupported cmd")
+	// MessageTooLargeErr is a message over the max size of a reader, which
+	// skipped it.
+	MessageTooLargeErr = errors.New("message too large")
 )
 
+// SupportedVersions lists every version this package can read and write,
+// oldest first. Clients that never send HELLO speak ProtocolVersion.
+var SupportedVersions = []string{ProtocolVersion10, ProtocolVersion11, ProtocolVersion12, ProtocolVersion13}
+
+// versionIndex returns the position of version in SupportedVersions, or -1.
+func versionIndex(version string) int {
+	for i, v := range SupportedVersions {
+		if v == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// SupportsRequestID reports whether request ids are part of the given version.
+func SupportsRequestID(version string) bool {
+	return versionIndex(version) >= versionIndex(ProtocolVersion11)
+}
+
+// SupportsHeartbeat reports whether clients of the given version answer a
+// PING sent by the server. Older ones may PING the server but never expect
+// one back.
+func SupportsHeartbeat(version string) bool {
+	return versionIndex(version) >= versionIndex(ProtocolVersion13)
+}
+
+// SupportsMessageMeta reports whether RECEIVE carries the id, timestamp,
+// sequence number and conversation of the message in the given version.
+func SupportsMessageMeta(version string) bool {
+	return versionIndex(version) >= versionIndex(ProtocolVersion12)
+}
+
+// SupportsResume reports whether LOGIN is answered with a SESSION token that
+// RESUME takes back after a reconnect in the given version.
+func SupportsResume(version string) bool {
+	return versionIndex(version) >= versionIndex(ProtocolVersion12)
+}
+
+// NegotiateVersion picks the newest version both sides support, or "".
+func NegotiateVersion(versions []string) string {
+	best := -1
+	for _, v := range versions {
+		if i := versionIndex(v); i > best {
+			best = i
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	return SupportedVersions[best]
+}
+
+// Command is implemented by every CHAT command. A command is written as the
+// fields of its BaseCommand, its CmdName and the args returned by Encode;
+// Decode receives the args that follow the CmdName.
+//
+// Applications add their own commands with Register.
+type Command interface {
+	Base() *BaseCommand
+	CmdName() string
+	Encode() []string
+	Decode(args []string) error
+}
+
 type BaseCommand struct {
-	Protocol string
-	Version  string
+	Protocol  string
+	Version   string
+	RequestID string
 }
 
 func (c *BaseCommand) String() string {
-	return fmt.Sprintf("%s/%s", c.Protocol, c.Version)
+	return strings.Join(c.fields(), ProtocolSep)
+}
+
+func (c *BaseCommand) Base() *BaseCommand {
+	return c
+}
+
+func (c *BaseCommand) fields() []string {
+	fields := []string{fmt.Sprintf("%s/%s", c.Protocol, c.Version)}
+	if c.RequestID != "" {
+		fields = append(fields, RequestIDPrefix+c.RequestID)
+	}
+	return fields
+}
+
+// encode lists the fields of a command in wire order, stamped with the given
+// version unless it's empty.
+func encode(cmd Command, version string) []string {
+	base := *cmd.Base()
+	if version != "" {
+		base.Version = version
+	}
+	if !SupportsRequestID(base.Version) {
+		base.RequestID = ""
+	}
+	var args []string
+	if v, ok := cmd.(versionedCommand); ok {
+		args = v.encodeVersion(base.Version)
+	} else {
+		args = cmd.Encode()
+	}
+	return append(append(base.fields(), cmd.CmdName()), args...)
+}
+
+// versionedCommand is implemented by commands whose args depend on the
+// version they're written in, Encode uses the version of the command itself.
+type versionedCommand interface {
+	encodeVersion(version string) []string
+}
+
+// lineEscaper keeps fields read from binary frames from breaking a line in
+// two, which would let a client forge whole commands to line clients. The
+// backslash is escaped too so that lineUnescaper can tell a written \n from
+// a newline.
+var (
+	lineEscaper   = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n")
+	lineUnescaper = strings.NewReplacer("\\\\", "\\", "\\r", "\r", "\\n", "\n")
+)
+
+// line joins the fields of a command into a single newline-terminated line,
+// backslash, CR and LF in the fields are written as \\, \r and \n.
+func line(fields []string) string {
+	return lineEscaper.Replace(strings.Join(fields, ProtocolSep)) + "\n"
 }
 
 type SendCommand struct {
@@ -50,12 +378,25 @@ type SendCommand struct {
 }
 
 func (c *SendCommand) String() string {
-	return strings.Join([]string{
-		c.BaseCommand.String(),
-		CmdSend,
-		c.Name,
-		string(c.Data),
-	}, ProtocolSep) + "\n"
+	return line(encode(c, ""))
+}
+
+func (c *SendCommand) CmdName() string {
+	return CmdSend
+}
+
+func (c *SendCommand) Encode() []string {
+	return []string{c.Name, string(c.Data)}
+}
+
+func (c *SendCommand) Decode(args []string) error {
+	if len(args) < 2 {
+		return InvalidMessageErr
+	}
+
+	c.Name = strings.TrimSpace(args[0])
+	c.Data = []byte(strings.Join(args[1:], ProtocolSep))
+	return nil
 }
 
 type BroadCastCommand struct {
@@ -65,25 +406,56 @@ type BroadCastCommand struct {
 }
 
 func (c *BroadCastCommand) String() string {
-	return strings.Join([]string{
-		c.BaseCommand.String(),
-		CmdBroadCast,
-		c.GroupName,
-		string(c.Data),
-	}, ProtocolSep) + "\n"
+	return line(encode(c, ""))
+}
+
+func (c *BroadCastCommand) CmdName() string {
+	return CmdBroadCast
+}
+
+func (c *BroadCastCommand) Encode() []string {
+	return []string{c.GroupName, string(c.Data)}
+}
+
+func (c *BroadCastCommand) Decode(args []string) error {
+	if len(args) < 2 {
+		return InvalidMessageErr
+	}
+
+	c.GroupName = strings.TrimSpace(args[0])
+	c.Data = []byte(strings.Join(args[1:], ProtocolSep))
+	return nil
 }
 
 type LoginCommand struct {
 	BaseCommand
 	Username string
+	Password string
 }
 
 func (c *LoginCommand) String() string {
-	return strings.Join([]string{
-		c.BaseCommand.String(),
-		CmdLogin,
-		c.Username,
-	}, ProtocolSep) + "\n"
+	return line(encode(c, ""))
+}
+
+func (c *LoginCommand) CmdName() string {
+	return CmdLogin
+}
+
+func (c *LoginCommand) Encode() []string {
+	if c.Password == "" {
+		return []string{c.Username}
+	}
+	return []string{c.Username, c.Password}
+}
+
+func (c *LoginCommand) Decode(args []string) error {
+	if len(args) < 1 {
+		return InvalidMessageErr
+	}
+
+	c.Username = strings.TrimSpace(args[0])
+	c.Password = strings.Join(args[1:], ProtocolSep)
+	return nil
 }
 
 type LogoutCommand struct {
@@ -91,25 +463,90 @@ type LogoutCommand struct {
 }
 
 func (c *LogoutCommand) String() string {
-	return strings.Join([]string{
-		c.BaseCommand.String(),
-		CmdLogout,
-	}, ProtocolSep) + "\n"
+	return line(encode(c, ""))
 }
 
+func (c *LogoutCommand) CmdName() string {
+	return CmdLogout
+}
+
+func (c *LogoutCommand) Encode() []string {
+	return nil
+}
+
+func (c *LogoutCommand) Decode(args []string) error {
+	if len(args) != 0 {
+		return InvalidMessageErr
+	}
+	return nil
+}
+
+// ReceiveCommand delivers a message. Since 1.2 it also carries the id of the
+// message, its server timestamp in unix milliseconds, its sequence number
+// within the conversation and the conversation: the sender of a direct
+// message or the group of a group message.
 type ReceiveCommand struct {
 	BaseCommand
-	From string
-	Data []byte
+	ID        uint64
+	Timestamp int64
+	Seq       uint64
+	Kind      string
+	Target    string
+	From      string
+	Data      []byte
 }
 
 func (c *ReceiveCommand) String() string {
-	return strings.Join([]string{
-		c.BaseCommand.String(),
-		CmdReceive,
-		c.From,
-		string(c.Data),
-	}, ProtocolSep) + "\n"
+	return line(encode(c, ""))
+}
+
+func (c *ReceiveCommand) CmdName() string {
+	return CmdReceive
+}
+
+func (c *ReceiveCommand) Encode() []string {
+	return c.encodeVersion(c.Version)
+}
+
+func (c *ReceiveCommand) encodeVersion(version string) []string {
+	if !SupportsMessageMeta(version) {
+		return []string{c.From, string(c.Data)}
+	}
+	return []string{strconv.FormatUint(c.ID, 10), strconv.FormatInt(c.Timestamp, 10),
+		strconv.FormatUint(c.Seq, 10), c.Kind, c.Target, c.From, string(c.Data)}
+}
+
+func (c *ReceiveCommand) Decode(args []string) (err error) {
+	if !SupportsMessageMeta(c.Version) {
+		if len(args) < 2 {
+			return InvalidMessageErr
+		}
+
+		c.From = strings.TrimSpace(args[0])
+		c.Data = []byte(strings.Join(args[1:], ProtocolSep))
+		return nil
+	}
+
+	if len(args) < 7 {
+		return InvalidMessageErr
+	}
+	if c.ID, err = strconv.ParseUint(strings.TrimSpace(args[0]), 10, 64); err != nil {
+		return InvalidMessageErr
+	}
+	if c.Timestamp, err = strconv.ParseInt(strings.TrimSpace(args[1]), 10, 64); err != nil {
+		return InvalidMessageErr
+	}
+	if c.Seq, err = strconv.ParseUint(strings.TrimSpace(args[2]), 10, 64); err != nil {
+		return InvalidMessageErr
+	}
+	c.Kind = strings.TrimSpace(args[3])
+	if c.Kind != ConversationUser && c.Kind != ConversationGroup {
+		return InvalidMessageErr
+	}
+	c.Target = strings.TrimSpace(args[4])
+	c.From = strings.TrimSpace(args[5])
+	c.Data = []byte(strings.Join(args[6:], ProtocolSep))
+	return nil
 }
 
 type GroupCommand struct {
@@ -119,12 +556,30 @@ type GroupCommand struct {
 }
 
 func (c *GroupCommand) String() string {
-	return strings.Join([]string{
-		c.BaseCommand.String(),
-		CmdGroup,
-		c.GroupName,
-		strings.Join(c.UserNames, ProtocolSep),
-	}, ProtocolSep) + "\n"
+	return line(encode(c, ""))
+}
+
+func (c *GroupCommand) CmdName() string {
+	return CmdGroup
+}
+
+func (c *GroupCommand) Encode() []string {
+	return append([]string{c.GroupName}, c.UserNames...)
+}
+
+// Decode takes a group alone too, UserNames are invited and needn't be
+// there.
+func (c *GroupCommand) Decode(args []string) error {
+	if len(args) < 1 {
+		return InvalidMessageErr
+	}
+
+	c.GroupName = strings.TrimSpace(args[0])
+	c.UserNames = nil
+	if len(args) > 1 {
+		c.UserNames = args[1:]
+	}
+	return nil
 }
 
 type LeaveCommand struct {
@@ -133,9 +588,1211 @@ type LeaveCommand struct {
 }
 
 func (c *LeaveCommand) String() string {
-	return strings.Join([]string{
-		c.BaseCommand.String(),
-		CmdLeave,
-		c.GroupName,
-	}, ProtocolSep) + "\n"
+	return line(encode(c, ""))
+}
+
+func (c *LeaveCommand) CmdName() string {
+	return CmdLeave
+}
+
+func (c *LeaveCommand) Encode() []string {
+	return []string{c.GroupName}
+}
+
+func (c *LeaveCommand) Decode(args []string) error {
+	if len(args) < 1 {
+		return InvalidMessageErr
+	}
+
+	c.GroupName = strings.TrimSpace(args[0])
+	return nil
+}
+
+type OkCommand struct {
+	BaseCommand
+}
+
+func (c *OkCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *OkCommand) CmdName() string {
+	return CmdOk
+}
+
+func (c *OkCommand) Encode() []string {
+	return nil
+}
+
+func (c *OkCommand) Decode(args []string) error {
+	if len(args) != 0 {
+		return InvalidMessageErr
+	}
+	return nil
+}
+
+type ErrorCommand struct {
+	BaseCommand
+	Code    string
+	Message string
+}
+
+func (c *ErrorCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *ErrorCommand) CmdName() string {
+	return CmdError
+}
+
+func (c *ErrorCommand) Encode() []string {
+	if c.Message == "" {
+		return []string{c.Code}
+	}
+	return []string{c.Code, c.Message}
+}
+
+func (c *ErrorCommand) Decode(args []string) error {
+	if len(args) < 1 {
+		return InvalidMessageErr
+	}
+
+	c.Code = strings.TrimSpace(args[0])
+	c.Message = strings.Join(args[1:], ProtocolSep)
+	return nil
+}
+
+// HelloCommand is sent by the client with every version and capability it
+// supports, the server answers with a HelloCommand carrying the single
+// negotiated version and the capabilities both sides share.
+type HelloCommand struct {
+	BaseCommand
+	Versions     []string
+	Capabilities []string
+}
+
+func (c *HelloCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *HelloCommand) CmdName() string {
+	return CmdHello
+}
+
+func (c *HelloCommand) Encode() []string {
+	args := []string{strings.Join(c.Versions, ListSep)}
+	if len(c.Capabilities) > 0 {
+		args = append(args, strings.Join(c.Capabilities, ListSep))
+	}
+	return args
+}
+
+func (c *HelloCommand) Decode(args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return InvalidMessageErr
+	}
+
+	c.Versions = strings.Split(strings.TrimSpace(args[0]), ListSep)
+	c.Capabilities = nil
+	if len(args) == 2 {
+		c.Capabilities = strings.Split(strings.TrimSpace(args[1]), ListSep)
+	}
+	return nil
+}
+
+// NoticeCommand is pushed by the server to tell the client about something
+// that happened outside of any request, e.g. its session being replaced.
+type NoticeCommand struct {
+	BaseCommand
+	Kind string
+	Text string
+}
+
+func (c *NoticeCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *NoticeCommand) CmdName() string {
+	return CmdNotice
+}
+
+func (c *NoticeCommand) Encode() []string {
+	if c.Text == "" {
+		return []string{c.Kind}
+	}
+	return []string{c.Kind, c.Text}
+}
+
+func (c *NoticeCommand) Decode(args []string) error {
+	if len(args) < 1 {
+		return InvalidMessageErr
+	}
+
+	c.Kind = strings.TrimSpace(args[0])
+	c.Text = strings.Join(args[1:], ProtocolSep)
+	return nil
+}
+
+// HistoryCommand asks for past messages with a user or in a group, the ones
+// before or after the message with id Cursor, at most Limit of them. A zero
+// Cursor starts from the newest or the oldest message, a zero Limit leaves
+// it to the server. The server answers with a MESSAGE per message, oldest
+// first, then OK.
+type HistoryCommand struct {
+	BaseCommand
+	Kind      string
+	Name      string
+	Direction string
+	Cursor    uint64
+	Limit     int
+}
+
+func (c *HistoryCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *HistoryCommand) CmdName() string {
+	return CmdHistory
+}
+
+func (c *HistoryCommand) Encode() []string {
+	return []string{c.Kind, c.Name, c.Direction,
+		strconv.FormatUint(c.Cursor, 10), strconv.Itoa(c.Limit)}
+}
+
+func (c *HistoryCommand) Decode(args []string) (err error) {
+	if len(args) < 2 || len(args) > 5 {
+		return InvalidMessageErr
+	}
+
+	c.Kind = strings.TrimSpace(args[0])
+	c.Name = strings.TrimSpace(args[1])
+	c.Direction = HistoryBefore
+	c.Cursor = 0
+	c.Limit = 0
+	if c.Kind != ConversationUser && c.Kind != ConversationGroup {
+		return InvalidMessageErr
+	}
+
+	if len(args) > 2 {
+		c.Direction = strings.TrimSpace(args[2])
+		if c.Direction != HistoryBefore && c.Direction != HistoryAfter {
+			return InvalidMessageErr
+		}
+	}
+	if len(args) > 3 {
+		if c.Cursor, err = strconv.ParseUint(strings.TrimSpace(args[3]), 10, 64); err != nil {
+			return InvalidMessageErr
+		}
+	}
+	if len(args) > 4 {
+		if c.Limit, err = strconv.Atoi(strings.TrimSpace(args[4])); err != nil || c.Limit < 0 {
+			return InvalidMessageErr
+		}
+	}
+	return nil
+}
+
+// MessageCommand is a past message sent back for HISTORY, Timestamp is in
+// unix milliseconds and Seq the sequence number within the conversation.
+type MessageCommand struct {
+	BaseCommand
+	ID        uint64
+	Timestamp int64
+	Seq       uint64
+	From      string
+	Data      []byte
+}
+
+func (c *MessageCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *MessageCommand) CmdName() string {
+	return CmdMessage
+}
+
+func (c *MessageCommand) Encode() []string {
+	return []string{strconv.FormatUint(c.ID, 10), strconv.FormatInt(c.Timestamp, 10),
+		strconv.FormatUint(c.Seq, 10), c.From, string(c.Data)}
+}
+
+func (c *MessageCommand) Decode(args []string) (err error) {
+	if len(args) < 5 {
+		return InvalidMessageErr
+	}
+
+	if c.ID, err = strconv.ParseUint(strings.TrimSpace(args[0]), 10, 64); err != nil {
+		return InvalidMessageErr
+	}
+	if c.Timestamp, err = strconv.ParseInt(strings.TrimSpace(args[1]), 10, 64); err != nil {
+		return InvalidMessageErr
+	}
+	if c.Seq, err = strconv.ParseUint(strings.TrimSpace(args[2]), 10, 64); err != nil {
+		return InvalidMessageErr
+	}
+	c.From = strings.TrimSpace(args[3])
+	c.Data = []byte(strings.Join(args[4:], ProtocolSep))
+	return nil
+}
+
+// DeliveredCommand tells the sender of message ID that it reached a
+// connection of User, Count of its Total recipients have got it by now.
+type DeliveredCommand struct {
+	BaseCommand
+	ID    uint64
+	User  string
+	Count int
+	Total int
+}
+
+func (c *DeliveredCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *DeliveredCommand) CmdName() string {
+	return CmdDelivered
+}
+
+func (c *DeliveredCommand) Encode() []string {
+	return []string{strconv.FormatUint(c.ID, 10), c.User, strconv.Itoa(c.Count), strconv.Itoa(c.Total)}
+}
+
+func (c *DeliveredCommand) Decode(args []string) (err error) {
+	if len(args) != 4 {
+		return InvalidMessageErr
+	}
+
+	c.User = strings.TrimSpace(args[1])
+	return decodeReceipt(args, &c.ID, &c.Count, &c.Total)
+}
+
+// ReadCommand is sent by a recipient once it has read message ID. The server
+// relays it to the sender with the reader in User, Count of the Total
+// recipients have read the message by now.
+type ReadCommand struct {
+	BaseCommand
+	ID    uint64
+	User  string
+	Count int
+	Total int
+}
+
+func (c *ReadCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *ReadCommand) CmdName() string {
+	return CmdRead
+}
+
+func (c *ReadCommand) Encode() []string {
+	if c.User == "" {
+		return []string{strconv.FormatUint(c.ID, 10)}
+	}
+	return []string{strconv.FormatUint(c.ID, 10), c.User, strconv.Itoa(c.Count), strconv.Itoa(c.Total)}
+}
+
+func (c *ReadCommand) Decode(args []string) (err error) {
+	c.User, c.Count, c.Total = "", 0, 0
+	switch len(args) {
+	case 1:
+		if c.ID, err = strconv.ParseUint(strings.TrimSpace(args[0]), 10, 64); err != nil {
+			return InvalidMessageErr
+		}
+		return nil
+	case 4:
+		c.User = strings.TrimSpace(args[1])
+		return decodeReceipt(args, &c.ID, &c.Count, &c.Total)
+	default:
+		return InvalidMessageErr
+	}
+}
+
+// decodeReceipt parses the id, count and total args of a receipt.
+func decodeReceipt(args []string, id *uint64, count, total *int) (err error) {
+	if *id, err = strconv.ParseUint(strings.TrimSpace(args[0]), 10, 64); err != nil {
+		return InvalidMessageErr
+	}
+	if *count, err = strconv.Atoi(strings.TrimSpace(args[2])); err != nil {
+		return InvalidMessageErr
+	}
+	if *total, err = strconv.Atoi(strings.TrimSpace(args[3])); err != nil {
+		return InvalidMessageErr
+	}
+	return nil
+}
+
+// SessionCommand answers LOGIN and RESUME since 1.2, Token resumes the
+// session on a new connection should this one drop.
+type SessionCommand struct {
+	BaseCommand
+	Token string
+}
+
+func (c *SessionCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *SessionCommand) CmdName() string {
+	return CmdSession
+}
+
+func (c *SessionCommand) Encode() []string {
+	return []string{c.Token}
+}
+
+func (c *SessionCommand) Decode(args []string) error {
+	if len(args) != 1 {
+		return InvalidMessageErr
+	}
+
+	c.Token = strings.TrimSpace(args[0])
+	return nil
+}
+
+// ResumeCommand takes over the session of Token on a new connection instead
+// of LOGIN, every message after the one with id LastID is sent again.
+type ResumeCommand struct {
+	BaseCommand
+	Token  string
+	LastID uint64
+}
+
+func (c *ResumeCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *ResumeCommand) CmdName() string {
+	return CmdResume
+}
+
+func (c *ResumeCommand) Encode() []string {
+	return []string{c.Token, strconv.FormatUint(c.LastID, 10)}
+}
+
+func (c *ResumeCommand) Decode(args []string) (err error) {
+	if len(args) != 2 {
+		return InvalidMessageErr
+	}
+
+	c.Token = strings.TrimSpace(args[0])
+	if c.LastID, err = strconv.ParseUint(strings.TrimSpace(args[1]), 10, 64); err != nil {
+		return InvalidMessageErr
+	}
+	return nil
+}
+
+// PingCommand may be sent by either side to check the other is still there,
+// it's answered with a PONG carrying the same Data, which is optional.
+type PingCommand struct {
+	BaseCommand
+	Data string
+}
+
+func (c *PingCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *PingCommand) CmdName() string {
+	return CmdPing
+}
+
+func (c *PingCommand) Encode() []string {
+	return heartbeatArgs(c.Data)
+}
+
+func (c *PingCommand) Decode(args []string) (err error) {
+	c.Data, err = decodeHeartbeat(args)
+	return
+}
+
+type PongCommand struct {
+	BaseCommand
+	Data string
+}
+
+func (c *PongCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *PongCommand) CmdName() string {
+	return CmdPong
+}
+
+func (c *PongCommand) Encode() []string {
+	return heartbeatArgs(c.Data)
+}
+
+func (c *PongCommand) Decode(args []string) (err error) {
+	c.Data, err = decodeHeartbeat(args)
+	return
+}
+
+func heartbeatArgs(data string) []string {
+	if data == "" {
+		return nil
+	}
+	return []string{data}
+}
+
+func decodeHeartbeat(args []string) (string, error) {
+	switch len(args) {
+	case 0:
+		return "", nil
+	case 1:
+		return strings.TrimSpace(args[0]), nil
+	default:
+		return "", InvalidMessageErr
+	}
+}
+
+// StatusCommand sets the presence state of the client's user along with an
+// optional message, e.g. STATUS AWAY back in 5 minutes.
+type StatusCommand struct {
+	BaseCommand
+	State   string
+	Message string
+}
+
+func (c *StatusCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *StatusCommand) CmdName() string {
+	return CmdStatus
+}
+
+func (c *StatusCommand) Encode() []string {
+	if c.Message == "" {
+		return []string{c.State}
+	}
+	return []string{c.State, c.Message}
+}
+
+func (c *StatusCommand) Decode(args []string) error {
+	if len(args) < 1 {
+		return InvalidMessageErr
+	}
+
+	c.State = strings.TrimSpace(args[0])
+	switch c.State {
+	case PresenceOnline, PresenceAway, PresenceBusy:
+	default:
+		return InvalidMessageErr
+	}
+	c.Message = strings.Join(args[1:], ProtocolSep)
+	return nil
+}
+
+// PresenceCommand is pushed by the server when User changes state, Since is
+// when in unix milliseconds, which is the last seen time of an OFFLINE user.
+type PresenceCommand struct {
+	BaseCommand
+	User    string
+	State   string
+	Since   int64
+	Message string
+}
+
+func (c *PresenceCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *PresenceCommand) CmdName() string {
+	return CmdPresence
+}
+
+func (c *PresenceCommand) Encode() []string {
+	args := []string{c.User, c.State, strconv.FormatInt(c.Since, 10)}
+	if c.Message != "" {
+		args = append(args, c.Message)
+	}
+	return args
+}
+
+func (c *PresenceCommand) Decode(args []string) (err error) {
+	if len(args) < 3 {
+		return InvalidMessageErr
+	}
+
+	c.User = strings.TrimSpace(args[0])
+	c.State = strings.TrimSpace(args[1])
+	if c.Since, err = strconv.ParseInt(strings.TrimSpace(args[2]), 10, 64); err != nil {
+		return InvalidMessageErr
+	}
+	c.Message = strings.Join(args[3:], ProtocolSep)
+	return nil
+}
+
+// SubscribeCommand asks for the PRESENCE of User, who needn't share a group
+// with the client.
+type SubscribeCommand struct {
+	BaseCommand
+	User string
+}
+
+func (c *SubscribeCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *SubscribeCommand) CmdName() string {
+	return CmdSubscribe
+}
+
+func (c *SubscribeCommand) Encode() []string {
+	return []string{c.User}
+}
+
+func (c *SubscribeCommand) Decode(args []string) error {
+	if len(args) != 1 {
+		return InvalidMessageErr
+	}
+
+	c.User = strings.TrimSpace(args[0])
+	return nil
+}
+
+type UnsubscribeCommand struct {
+	BaseCommand
+	User string
+}
+
+func (c *UnsubscribeCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *UnsubscribeCommand) CmdName() string {
+	return CmdUnsubscribe
+}
+
+func (c *UnsubscribeCommand) Encode() []string {
+	return []string{c.User}
+}
+
+func (c *UnsubscribeCommand) Decode(args []string) error {
+	if len(args) != 1 {
+		return InvalidMessageErr
+	}
+
+	c.User = strings.TrimSpace(args[0])
+	return nil
+}
+
+// ListCommand asks for a page of names in name order: up to Limit of them,
+// the server's default if 0, after the name After, from the first if empty.
+// Group is only set for MEMBERS.
+type ListCommand struct {
+	BaseCommand
+	Kind  string
+	Group string
+	Limit int
+	After string
+}
+
+func (c *ListCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *ListCommand) CmdName() string {
+	return CmdList
+}
+
+func (c *ListCommand) Encode() []string {
+	args := []string{c.Kind}
+	if c.Kind == ListMembers {
+		args = append(args, c.Group)
+	}
+	if c.Limit > 0 || c.After != "" {
+		args = append(args, strconv.Itoa(c.Limit))
+	}
+	if c.After != "" {
+		args = append(args, c.After)
+	}
+	return args
+}
+
+func (c *ListCommand) Decode(args []string) (err error) {
+	if len(args) < 1 {
+		return InvalidMessageErr
+	}
+
+	c.Kind = strings.TrimSpace(args[0])
+	c.Group, c.Limit, c.After = "", 0, ""
+	switch c.Kind {
+	case ListUsers, ListGroups, ListChannels:
+		args = args[1:]
+	case ListMembers:
+		if len(args) < 2 {
+			return InvalidMessageErr
+		}
+		c.Group = strings.TrimSpace(args[1])
+		args = args[2:]
+	default:
+		return InvalidMessageErr
+	}
+
+	if len(args) > 2 {
+		return InvalidMessageErr
+	}
+	if len(args) > 0 {
+		if c.Limit, err = strconv.Atoi(strings.TrimSpace(args[0])); err != nil || c.Limit < 0 {
+			return InvalidMessageErr
+		}
+	}
+	if len(args) > 1 {
+		c.After = strings.TrimSpace(args[1])
+	}
+	return nil
+}
+
+// NamesCommand answers LIST with a page of names, More tells whether
+// another LIST after the last of them has more.
+type NamesCommand struct {
+	BaseCommand
+	Kind  string
+	More  bool
+	Names []string
+}
+
+func (c *NamesCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *NamesCommand) CmdName() string {
+	return CmdNames
+}
+
+func (c *NamesCommand) Encode() []string {
+	more := NamesEnd
+	if c.More {
+		more = NamesMore
+	}
+	return append([]string{c.Kind, more}, c.Names...)
+}
+
+func (c *NamesCommand) Decode(args []string) error {
+	if len(args) < 2 {
+		return InvalidMessageErr
+	}
+
+	c.Kind = strings.TrimSpace(args[0])
+	switch strings.TrimSpace(args[1]) {
+	case NamesMore:
+		c.More = true
+	case NamesEnd:
+		c.More = false
+	default:
+		return InvalidMessageErr
+	}
+	c.Names = nil
+	if len(args) > 2 {
+		c.Names = args[2:]
+	}
+	return nil
+}
+
+type WhoisCommand struct {
+	BaseCommand
+	User string
+}
+
+func (c *WhoisCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *WhoisCommand) CmdName() string {
+	return CmdWhois
+}
+
+func (c *WhoisCommand) Encode() []string {
+	return []string{c.User}
+}
+
+func (c *WhoisCommand) Decode(args []string) error {
+	if len(args) != 1 {
+		return InvalidMessageErr
+	}
+
+	c.User = strings.TrimSpace(args[0])
+	return nil
+}
+
+// UserInfoCommand answers WHOIS with the presence of User as in PRESENCE
+// and the Groups the client shares with them.
+type UserInfoCommand struct {
+	BaseCommand
+	User    string
+	State   string
+	Since   int64
+	Groups  []string
+	Message string
+}
+
+func (c *UserInfoCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *UserInfoCommand) CmdName() string {
+	return CmdUserInfo
+}
+
+func (c *UserInfoCommand) Encode() []string {
+	groups := EmptyList
+	if len(c.Groups) > 0 {
+		groups = strings.Join(c.Groups, ListSep)
+	}
+
+	args := []string{c.User, c.State, strconv.FormatInt(c.Since, 10), groups}
+	if c.Message != "" {
+		args = append(args, c.Message)
+	}
+	return args
+}
+
+func (c *UserInfoCommand) Decode(args []string) (err error) {
+	if len(args) < 4 {
+		return InvalidMessageErr
+	}
+
+	c.User = strings.TrimSpace(args[0])
+	c.State = strings.TrimSpace(args[1])
+	if c.Since, err = strconv.ParseInt(strings.TrimSpace(args[2]), 10, 64); err != nil {
+		return InvalidMessageErr
+	}
+	c.Groups = nil
+	if groups := strings.TrimSpace(args[3]); groups != EmptyList {
+		c.Groups = strings.Split(groups, ListSep)
+	}
+	c.Message = strings.Join(args[4:], ProtocolSep)
+	return nil
+}
+
+// InviteCommand invites User to Group, who becomes a member by JOIN.
+type InviteCommand struct {
+	BaseCommand
+	Group string
+	User  string
+}
+
+func (c *InviteCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *InviteCommand) CmdName() string {
+	return CmdInvite
+}
+
+func (c *InviteCommand) Encode() []string {
+	return []string{c.Group, c.User}
+}
+
+func (c *InviteCommand) Decode(args []string) (err error) {
+	c.Group, c.User, err = decodeGroupUser(args)
+	return
+}
+
+type JoinCommand struct {
+	BaseCommand
+	Group string
+}
+
+func (c *JoinCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *JoinCommand) CmdName() string {
+	return CmdJoin
+}
+
+func (c *JoinCommand) Encode() []string {
+	return []string{c.Group}
+}
+
+func (c *JoinCommand) Decode(args []string) error {
+	if len(args) != 1 {
+		return InvalidMessageErr
+	}
+
+	c.Group = strings.TrimSpace(args[0])
+	return nil
+}
+
+type KickCommand struct {
+	BaseCommand
+	Group string
+	User  string
+}
+
+func (c *KickCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *KickCommand) CmdName() string {
+	return CmdKick
+}
+
+func (c *KickCommand) Encode() []string {
+	return []string{c.Group, c.User}
+}
+
+func (c *KickCommand) Decode(args []string) (err error) {
+	c.Group, c.User, err = decodeGroupUser(args)
+	return
+}
+
+// PromoteCommand gives User the Role in Group, making them OWNER hands the
+// group over and leaves the old owner an ADMIN.
+type PromoteCommand struct {
+	BaseCommand
+	Group string
+	User  string
+	Role  string
+}
+
+func (c *PromoteCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *PromoteCommand) CmdName() string {
+	return CmdPromote
+}
+
+func (c *PromoteCommand) Encode() []string {
+	return []string{c.Group, c.User, c.Role}
+}
+
+func (c *PromoteCommand) Decode(args []string) error {
+	if len(args) != 3 {
+		return InvalidMessageErr
+	}
+
+	c.Group = strings.TrimSpace(args[0])
+	c.User = strings.TrimSpace(args[1])
+	c.Role = strings.TrimSpace(args[2])
+	switch c.Role {
+	case RoleOwner, RoleAdmin, RoleMember:
+	default:
+		return InvalidMessageErr
+	}
+	return nil
+}
+
+func decodeGroupUser(args []string) (group, user string, err error) {
+	if len(args) != 2 {
+		return "", "", InvalidMessageErr
+	}
+	return strings.TrimSpace(args[0]), strings.TrimSpace(args[1]), nil
+}
+
+// AcceptCommand takes up the invitation to Group.
+type AcceptCommand struct {
+	BaseCommand
+	Group string
+}
+
+func (c *AcceptCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *AcceptCommand) CmdName() string {
+	return CmdAccept
+}
+
+func (c *AcceptCommand) Encode() []string {
+	return []string{c.Group}
+}
+
+func (c *AcceptCommand) Decode(args []string) (err error) {
+	c.Group, err = decodeGroup(args)
+	return
+}
+
+// DeclineCommand turns the invitation to Group down.
+type DeclineCommand struct {
+	BaseCommand
+	Group string
+}
+
+func (c *DeclineCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *DeclineCommand) CmdName() string {
+	return CmdDecline
+}
+
+func (c *DeclineCommand) Encode() []string {
+	return []string{c.Group}
+}
+
+func (c *DeclineCommand) Decode(args []string) (err error) {
+	c.Group, err = decodeGroup(args)
+	return
+}
+
+func decodeGroup(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", InvalidMessageErr
+	}
+	return strings.TrimSpace(args[0]), nil
+}
+
+// ChannelCommand creates a public channel, which anyone may find by LIST
+// CHANNELS and JOIN without an invitation.
+type ChannelCommand struct {
+	BaseCommand
+	Name string
+}
+
+func (c *ChannelCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *ChannelCommand) CmdName() string {
+	return CmdChannel
+}
+
+func (c *ChannelCommand) Encode() []string {
+	return []string{c.Name}
+}
+
+func (c *ChannelCommand) Decode(args []string) error {
+	if len(args) != 1 {
+		return InvalidMessageErr
+	}
+
+	c.Name = strings.TrimSpace(args[0])
+	return nil
+}
+
+// TopicCommand sets the topic of Group, or clears it if Topic is EmptyList.
+// Without a Topic it asks for the topic, which the server answers with a
+// TopicCommand of its own, EmptyList if there's none.
+type TopicCommand struct {
+	BaseCommand
+	Group string
+	Topic string
+}
+
+func (c *TopicCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *TopicCommand) CmdName() string {
+	return CmdTopic
+}
+
+func (c *TopicCommand) Encode() []string {
+	return groupTextArgs(c.Group, c.Topic)
+}
+
+func (c *TopicCommand) Decode(args []string) (err error) {
+	c.Group, c.Topic, err = decodeGroupText(args)
+	return
+}
+
+// DescriptionCommand is to the description of Group what TopicCommand is to
+// its topic.
+type DescriptionCommand struct {
+	BaseCommand
+	Group       string
+	Description string
+}
+
+func (c *DescriptionCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *DescriptionCommand) CmdName() string {
+	return CmdDescription
+}
+
+func (c *DescriptionCommand) Encode() []string {
+	return groupTextArgs(c.Group, c.Description)
+}
+
+func (c *DescriptionCommand) Decode(args []string) (err error) {
+	c.Group, c.Description, err = decodeGroupText(args)
+	return
+}
+
+func groupTextArgs(group, text string) []string {
+	if text == "" {
+		return []string{group}
+	}
+	return []string{group, text}
+}
+
+func decodeGroupText(args []string) (group, text string, err error) {
+	if len(args) < 1 {
+		return "", "", InvalidMessageErr
+	}
+	return strings.TrimSpace(args[0]), strings.Join(args[1:], ProtocolSep), nil
+}
+
+// MuteCommand keeps Target from sending for Duration seconds, for good if
+// 0, in Group or on the whole server if Group is empty.
+type MuteCommand struct {
+	BaseCommand
+	Target   string
+	Duration int64
+	Group    string
+}
+
+func (c *MuteCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *MuteCommand) CmdName() string {
+	return CmdMute
+}
+
+func (c *MuteCommand) Encode() []string {
+	return sanctionArgs(c.Target, c.Duration, c.Group)
+}
+
+func (c *MuteCommand) Decode(args []string) (err error) {
+	c.Target, c.Duration, c.Group, err = decodeSanction(args)
+	return
+}
+
+// BanCommand is MuteCommand for logging in, or joining Group. On the whole
+// server Target may be an IP.
+type BanCommand struct {
+	BaseCommand
+	Target   string
+	Duration int64
+	Group    string
+}
+
+func (c *BanCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *BanCommand) CmdName() string {
+	return CmdBan
+}
+
+func (c *BanCommand) Encode() []string {
+	return sanctionArgs(c.Target, c.Duration, c.Group)
+}
+
+func (c *BanCommand) Decode(args []string) (err error) {
+	c.Target, c.Duration, c.Group, err = decodeSanction(args)
+	return
+}
+
+type UnmuteCommand struct {
+	BaseCommand
+	Target string
+	Group  string
+}
+
+func (c *UnmuteCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *UnmuteCommand) CmdName() string {
+	return CmdUnmute
+}
+
+func (c *UnmuteCommand) Encode() []string {
+	return liftArgs(c.Target, c.Group)
+}
+
+func (c *UnmuteCommand) Decode(args []string) (err error) {
+	c.Target, c.Group, err = decodeLift(args)
+	return
+}
+
+type UnbanCommand struct {
+	BaseCommand
+	Target string
+	Group  string
+}
+
+func (c *UnbanCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *UnbanCommand) CmdName() string {
+	return CmdUnban
+}
+
+func (c *UnbanCommand) Encode() []string {
+	return liftArgs(c.Target, c.Group)
+}
+
+func (c *UnbanCommand) Decode(args []string) (err error) {
+	c.Target, c.Group, err = decodeLift(args)
+	return
+}
+
+// DisconnectCommand closes every connection of User, who may log in again.
+type DisconnectCommand struct {
+	BaseCommand
+	User string
+}
+
+func (c *DisconnectCommand) String() string {
+	return line(encode(c, ""))
+}
+
+func (c *DisconnectCommand) CmdName() string {
+	return CmdDisconnect
+}
+
+func (c *DisconnectCommand) Encode() []string {
+	return []string{c.User}
+}
+
+func (c *DisconnectCommand) Decode(args []string) error {
+	if len(args) != 1 {
+		return InvalidMessageErr
+	}
+
+	c.User = strings.TrimSpace(args[0])
+	return nil
+}
+
+func sanctionArgs(target string, duration int64, group string) []string {
+	args := []string{target, strconv.FormatInt(duration, 10)}
+	if group != "" {
+		args = append(args, group)
+	}
+	return args
+}
+
+func decodeSanction(args []string) (target string, duration int64, group string, err error) {
+	if len(args) < 2 || len(args) > 3 {
+		return "", 0, "", InvalidMessageErr
+	}
+
+	duration, err = strconv.ParseInt(strings.TrimSpace(args[1]), 10, 64)
+	if err != nil || duration < 0 || duration > MaxSanctionDuration {
+		return "", 0, "", InvalidMessageErr
+	}
+	if len(args) == 3 {
+		group = strings.TrimSpace(args[2])
+	}
+	return strings.TrimSpace(args[0]), duration, group, nil
+}
+
+func liftArgs(target, group string) []string {
+	if group == "" {
+		return []string{target}
+	}
+	return []string{target, group}
+}
+
+func decodeLift(args []string) (target, group string, err error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", "", InvalidMessageErr
+	}
+
+	if len(args) == 2 {
+		group = strings.TrimSpace(args[1])
+	}
+	return strings.TrimSpace(args[0]), group, nil
 }
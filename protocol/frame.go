@@ -0,0 +1,173 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+)
+
+// binary framing
+// frame := size(uint32) field...
+// field := size(uint32) bytes
+//
+// the fields are the same as the space separated parts of a line, e.g.
+// [CHAT/1.0] [SEND] [name] [data], but data may contain any byte.
+// MaxFrameSize keeps the first byte of every frame 0x00, which never starts
+// a line, so the framing of a connection can be told from its first byte.
+
+const MaxFrameSize = 1<<24 - 1
+
+type Framing int
+
+const (
+	FramingLine Framing = iota
+	FramingBinary
+)
+
+func (f Framing) String() string {
+	if f == FramingBinary {
+		return "binary"
+	}
+	return "line"
+}
+
+// SniffFraming peeks at the first byte sent by the client without consuming it.
+func SniffFraming(reader *bufio.Reader) (Framing, error) {
+	b, err := reader.Peek(1)
+	if err != nil {
+		return FramingLine, err
+	}
+
+	if b[0] == 0 {
+		return FramingBinary, nil
+	}
+	return FramingLine, nil
+}
+
+func NewReader(reader io.Reader, framing Framing) Reader {
+	if framing == FramingBinary {
+		return NewFrameReader(reader)
+	}
+	return NewCommandReader(reader)
+}
+
+func NewWriter(writer io.Writer, framing Framing) Writer {
+	if framing == FramingBinary {
+		return NewFrameWriter(writer)
+	}
+	return NewCommandWriter(writer)
+}
+
+type FrameReader struct {
+	reader  *bufio.Reader
+	version string
+	maxSize int
+	maxBody int
+}
+
+func NewFrameReader(reader io.Reader) *FrameReader {
+	return &FrameReader{
+		reader:  bufio.NewReader(reader),
+		version: ProtocolVersion,
+		maxSize: DefaultMaxMessageSize,
+	}
+}
+
+func (r *FrameReader) SetVersion(version string) {
+	r.version = version
+}
+
+// SetMaxSize bounds the frames read to frame bytes, the size header left
+// out.
+func (r *FrameReader) SetMaxSize(frame, body int) {
+	if frame <= 0 || frame > MaxFrameSize {
+		frame = MaxFrameSize
+	}
+	r.maxSize = frame
+	r.maxBody = body
+}
+
+func (r *FrameReader) Read() (cmd Command, err error) {
+	var size uint32
+	if err = binary.Read(r.reader, binary.BigEndian, &size); err != nil {
+		return
+	}
+
+	if size > uint32(r.maxSize) {
+		if _, err = io.CopyN(ioutil.Discard, r.reader, int64(size)); err != nil {
+			return
+		}
+		err = MessageTooLargeErr
+		return
+	}
+
+	payload := make([]byte, size)
+	if _, err = io.ReadFull(r.reader, payload); err != nil {
+		return
+	}
+
+	var fields []string
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			err = InvalidMessageErr
+			return
+		}
+
+		n := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		if uint32(len(payload)) < n {
+			err = InvalidMessageErr
+			return
+		}
+
+		fields = append(fields, string(payload[:n]))
+		payload = payload[n:]
+	}
+
+	return decode(fields, r.version, r.maxBody)
+}
+
+type FrameWriter struct {
+	writer  *bufio.Writer
+	version string
+}
+
+func NewFrameWriter(writer io.Writer) *FrameWriter {
+	return &FrameWriter{
+		writer: bufio.NewWriter(writer),
+	}
+}
+
+func (w *FrameWriter) SetVersion(version string) {
+	w.version = version
+}
+
+func (w *FrameWriter) Write(cmd Command) (err error) {
+	fields := encode(cmd, w.version)
+	size := 0
+	for _, field := range fields {
+		size += 4 + len(field)
+	}
+	if size > MaxFrameSize {
+		return InvalidMessageErr
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(size))
+	if _, err = w.writer.Write(header[:]); err != nil {
+		return
+	}
+
+	for _, field := range fields {
+		binary.BigEndian.PutUint32(header[:], uint32(len(field)))
+		if _, err = w.writer.Write(header[:]); err != nil {
+			return
+		}
+		if _, err = w.writer.WriteString(field); err != nil {
+			return
+		}
+	}
+
+	return w.writer.Flush()
+}
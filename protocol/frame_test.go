@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	cases := []struct {
+		cmd Command
+	}{
+		{
+			&SendCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+				Name:        "zhenghe",
+				Data:        []byte("func main() {\n\tprintln(\"hello world\")\n}\n"),
+			},
+		},
+		{
+			&BroadCastCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion11, RequestID: "7"},
+				GroupName:   "g1",
+				Data:        []byte{0x00, 0xff, '\n', ' ', 0x01},
+			},
+		},
+		{
+			&GroupCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+				GroupName:   "g1",
+				UserNames:   []string{"zhenghe", "xixi"},
+			},
+		},
+		{
+			&LogoutCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+			},
+		},
+	}
+
+	for i, c := range cases {
+		buf := bytes.NewBuffer([]byte{})
+		fw := NewFrameWriter(buf)
+
+		if err := fw.Write(c.cmd); err != nil {
+			t.Errorf("case %d: write err:%v", i, err)
+			continue
+		}
+
+		framing, err := SniffFraming(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+		if err != nil || framing != FramingBinary {
+			t.Errorf("case %d: should sniff framing:%v got:%v err:%v",
+				i, FramingBinary, framing, err)
+		}
+
+		fr := NewFrameReader(buf)
+		fr.SetVersion(ProtocolVersion11)
+		cmd, err := fr.Read()
+		if err != nil {
+			t.Errorf("case %d: read err:%v", i, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(cmd, c.cmd) {
+			t.Errorf("case %d: should have cmd:%#v got:%#v",
+				i, c.cmd, cmd)
+		}
+	}
+}
+
+func TestInvalidFrame(t *testing.T) {
+	cases := []struct {
+		frame       []byte
+		expectedErr error
+	}{
+		{
+			// field size runs past the end of the frame
+			[]byte{0, 0, 0, 6, 0, 0, 0, 9, 'C', 'H'},
+			InvalidMessageErr,
+		},
+		{
+			// trailing bytes too short for a field header
+			[]byte{0, 0, 0, 2, 0, 0},
+			InvalidMessageErr,
+		},
+		{
+			// frame larger than MaxFrameSize is skipped
+			append([]byte{0x01, 0, 0, 0}, make([]byte, 1<<24)...),
+			MessageTooLargeErr,
+		},
+	}
+
+	for i, c := range cases {
+		fr := NewFrameReader(bytes.NewReader(c.frame))
+
+		_, err := fr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+	}
+}
+
+func TestSniffLineFraming(t *testing.T) {
+	framing, err := SniffFraming(bufio.NewReader(bytes.NewReader([]byte("CHAT/1.0 LOGOUT\n"))))
+	if err != nil || framing != FramingLine {
+		t.Errorf("should sniff framing:%v got:%v err:%v",
+			FramingLine, framing, err)
+	}
+}
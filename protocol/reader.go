@@ -6,24 +6,86 @@ import (
 	"strings"
 )
 
+// Reader reads commands off a connection regardless of its framing.
+type Reader interface {
+	Read() (cmd Command, err error)
+	// SetVersion sets the newest version accepted from now on, HELLO is
+	// accepted in every supported version.
+	SetVersion(version string)
+	// SetMaxSize bounds the messages read from now on to frame bytes and
+	// their arguments after the command name to body bytes, separators left
+	// out. Larger ones are skipped and read as MessageTooLargeErr. 0 leaves
+	// the body unbounded and the frame bounded by MaxFrameSize alone.
+	SetMaxSize(frame, body int)
+}
+
+// DefaultMaxMessageSize bounds the frame of the messages a reader accepts
+// unless SetMaxSize says otherwise.
+const DefaultMaxMessageSize = 1 << 20
+
 type CommandReader struct {
-	reader *bufio.Reader
+	reader  *bufio.Reader
+	version string
+	maxSize int
+	maxBody int
 }
 
 func NewCommandReader(reader io.Reader) *CommandReader {
 	return &CommandReader{
-		reader: bufio.NewReader(reader),
+		reader:  bufio.NewReader(reader),
+		version: ProtocolVersion,
+		maxSize: DefaultMaxMessageSize,
 	}
 }
 
-func (r *CommandReader) Read() (cmd interface{}, err error) {
-	line, _, err := r.reader.ReadLine()
-	if err != nil {
-		return
+func (r *CommandReader) SetVersion(version string) {
+	r.version = version
+}
+
+// SetMaxSize bounds the lines read to frame bytes, the newline left out.
+func (r *CommandReader) SetMaxSize(frame, body int) {
+	if frame <= 0 || frame > MaxFrameSize {
+		frame = MaxFrameSize
 	}
+	r.maxSize = frame
+	r.maxBody = body
+}
 
-	parts := strings.Split(string(line), ProtocolSep)
+// Read reads the next line, one longer than the max size is skipped up to
+// its newline, so the next Read starts at the line after. The escapes line
+// wrote are undone.
+func (r *CommandReader) Read() (cmd Command, err error) {
+	var line []byte
+	tooLarge := false
+	for {
+		chunk, isPrefix, rerr := r.reader.ReadLine()
+		if rerr != nil {
+			return nil, rerr
+		}
 
+		if !tooLarge && len(line)+len(chunk) > r.maxSize {
+			tooLarge = true
+			line = nil
+		}
+		if !tooLarge {
+			line = append(line, chunk...)
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	if tooLarge {
+		return nil, MessageTooLargeErr
+	}
+
+	return decode(strings.Split(lineUnescaper.Replace(string(line)), ProtocolSep), r.version, r.maxBody)
+}
+
+// decode turns the fields of a message, split from a line or read from a
+// frame, into the command registered under its name. Messages newer than
+// maxVersion are rejected unless they are HELLO, ones with arguments longer
+// than maxBody, if it's not 0, are too large.
+func decode(parts []string, maxVersion string, maxBody int) (cmd Command, err error) {
 	if len(parts) < 2 {
 		err = InvalidMessageErr
 		return
@@ -37,82 +99,49 @@ func (r *CommandReader) Read() (cmd interface{}, err error) {
 	}
 	protocol, version := proVerParts[0], proVerParts[1]
 
-	if protocol != ProtocolName || version != ProtocolVersion {
+	if protocol != ProtocolName || versionIndex(version) < 0 {
 		err = InvalidMessageErr
 		return
 	}
-	base := BaseCommand{protocol, version}
+	base := BaseCommand{Protocol: protocol, Version: version}
 
-	cmdName := strings.TrimSpace(parts[1])
-
-	switch cmdName {
-	case CmdSend:
-		if len(parts) < 4 {
+	if strings.HasPrefix(parts[1], RequestIDPrefix) {
+		base.RequestID = strings.TrimPrefix(parts[1], RequestIDPrefix)
+		if base.RequestID == "" || len(parts) < 3 || !SupportsRequestID(version) {
 			err = InvalidMessageErr
 			return
 		}
+		parts = append(parts[:1], parts[2:]...)
+	}
 
-		name := strings.TrimSpace(parts[2])
-		message := strings.Join(parts[3:], ProtocolSep)
+	cmdName := strings.TrimSpace(parts[1])
 
-		cmd = &SendCommand{base, name, []byte(message)}
+	if cmdName != CmdHello && versionIndex(version) > versionIndex(maxVersion) {
+		err = InvalidMessageErr
 		return
-	case CmdBroadCast:
-		if len(parts) < 4 {
-			err = InvalidMessageErr
-			return
-		}
-
-		groupName := strings.TrimSpace(parts[2])
-		message := strings.Join(parts[3:], ProtocolSep)
-		cmd = &BroadCastCommand{base, groupName, []byte(message)}
-	case CmdLogin:
-		if len(parts) != 3 {
-			err = InvalidMessageErr
-			return
-		}
-
-		username := strings.TrimSpace(parts[2])
-
-		cmd = &LoginCommand{base, username}
-	case CmdLogout:
-		if len(parts) != 2 {
-			err = InvalidMessageErr
-			return
-		}
-
-		cmd = &LogoutCommand{base}
-	case CmdReceive:
-		if len(parts) < 4 {
-			err = InvalidMessageErr
-			return
-		}
-
-		f := strings.TrimSpace(parts[2])
-		message := strings.Join(parts[3:], ProtocolSep)
+	}
 
-		cmd = &ReceiveCommand{base, f, []byte(message)}
-	case CmdGroup:
-		if len(parts) < 5 {
-			err = InvalidMessageErr
-			return
+	if maxBody > 0 {
+		body := 0
+		for _, part := range parts[2:] {
+			body += len(part)
 		}
-
-		groupName := strings.TrimSpace(parts[2])
-		userNames := parts[3:]
-
-		cmd = &GroupCommand{base, groupName, userNames}
-	case CmdLeave:
-		if len(parts) < 3 {
-			err = InvalidMessageErr
+		if body > maxBody {
+			err = MessageTooLargeErr
 			return
 		}
+	}
 
-		groupName := strings.TrimSpace(parts[2])
-		cmd = &LeaveCommand{base, groupName}
-	default:
+	c, ok := newCommand(cmdName)
+	if !ok {
 		err = UnsupportedCmdErr
+		return
+	}
+
+	*c.Base() = base
+	if err = c.Decode(parts[2:]); err != nil {
+		return
 	}
 
-	return
+	return c, nil
 }
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"bytes"
+	"io"
 	"reflect"
 	"strings"
 	"testing"
@@ -41,6 +42,43 @@ func TestInvalidMessage(t *testing.T) {
 	}
 }
 
+func TestMessageTooLarge(t *testing.T) {
+	long := strings.Repeat("x", 5000)
+
+	cases := []struct {
+		message     string
+		frame, body int
+		// expected are the errs of reading every line, then io.EOF
+		expected []error
+	}{
+		{"CHAT/1.0 SEND xixi " + long + "\nCHAT/1.0 LOGOUT\n", 0, 0, []error{nil, nil}},
+		{"CHAT/1.0 SEND xixi " + long + "\nCHAT/1.0 LOGOUT\n", 64, 0, []error{MessageTooLargeErr, nil}},
+		{"CHAT/1.0 SEND xixi " + long + "\r\nCHAT/1.0 LOGOUT\r\n", 4096, 0, []error{MessageTooLargeErr, nil}},
+		{"CHAT/1.0 SEND xixi hello\n", 24, 0, []error{nil}},
+		{"CHAT/1.0 SEND xixi hello\n", 23, 0, []error{MessageTooLargeErr}},
+		{"CHAT/1.0 SEND xixi hello world\nCHAT/1.0 SEND xixi hi\n", 0, 8, []error{MessageTooLargeErr, nil}},
+		{"CHAT/1.2 #42 SEND xixi hello\n", 0, 9, []error{nil}},
+		// the last line needs no newline
+		{"CHAT/1.0 SEND xixi " + long, 64, 0, []error{MessageTooLargeErr}},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+		mr.SetVersion(ProtocolVersion12)
+		mr.SetMaxSize(c.frame, c.body)
+
+		for j, expected := range append(c.expected, io.EOF) {
+			if _, err := mr.Read(); err != expected {
+				t.Errorf("case %d: should have err:%v of line %d got:%v", i, expected, j, err)
+			}
+		}
+	}
+
+	if _, err := NewCommandReader(strings.NewReader("CHAT/1.0 SEND xixi " + strings.Repeat("x", DefaultMaxMessageSize) + "\n")).Read(); err != MessageTooLargeErr {
+		t.Errorf("should have err:%v by default got:%v", MessageTooLargeErr, err)
+	}
+}
+
 func TestSendMessage(t *testing.T) {
 	cases := []struct {
 		message      string
@@ -125,11 +163,25 @@ func TestLoginMessage(t *testing.T) {
 		message          string
 		expectedErr      error
 		expectedUsername string
+		expectedPassword string
 	}{
 		{
 			"CHAT/1.0 LOGIN zhenghe\n",
 			nil,
 			"zhenghe",
+			"",
+		},
+		{
+			"CHAT/1.0 LOGIN zhenghe open sesame\n",
+			nil,
+			"zhenghe",
+			"open sesame",
+		},
+		{
+			"CHAT/1.0 LOGIN\n",
+			InvalidMessageErr,
+			"",
+			"",
 		},
 	}
 
@@ -148,6 +200,11 @@ func TestLoginMessage(t *testing.T) {
 				t.Errorf("case %d: should have name:%s got:%s",
 					i, c.expectedUsername, loginCmd.Username)
 			}
+
+			if loginCmd.Password != c.expectedPassword {
+				t.Errorf("case %d: should have password:%s got:%s",
+					i, c.expectedPassword, loginCmd.Password)
+			}
 		}
 	}
 }
@@ -226,6 +283,13 @@ func TestGroupMessage(t *testing.T) {
 			"g1",
 			[]string{"zhenghe", "xixi"},
 		},
+		{
+			"CHAT/1.0 GROUP g1\n",
+			nil,
+			"g1",
+			nil,
+		},
+		{"CHAT/1.0 GROUP\n", InvalidMessageErr, "", nil},
 	}
 
 	for i, c := range cases {
@@ -284,3 +348,709 @@ func TestLeaveMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestOkMessage(t *testing.T) {
+	cases := []struct {
+		message     string
+		expectedErr error
+	}{
+		{
+			"CHAT/1.0 OK\n",
+			nil,
+		},
+		{
+			"CHAT/1.0 OK extra\n",
+			InvalidMessageErr,
+		},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			if _, ok := cmd.(*OkCommand); !ok {
+				t.Errorf("case %d: should have type:%T got:%T",
+					i, &OkCommand{}, cmd)
+			}
+		}
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	cases := []struct {
+		message         string
+		expectedErr     error
+		expectedCode    string
+		expectedMessage string
+	}{
+		{
+			"CHAT/1.0 ERROR UNKNOWN_USER unknown user\n",
+			nil,
+			ErrCodeUnknownUser,
+			"unknown user",
+		},
+		{
+			"CHAT/1.0 ERROR INTERNAL\n",
+			nil,
+			ErrCodeInternal,
+			"",
+		},
+		{
+			"CHAT/1.0 ERROR\n",
+			InvalidMessageErr,
+			"",
+			"",
+		},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			errorCmd := cmd.(*ErrorCommand)
+			if errorCmd.Code != c.expectedCode {
+				t.Errorf("case %d: should have code:%s got:%s",
+					i, c.expectedCode, errorCmd.Code)
+			}
+
+			if errorCmd.Message != c.expectedMessage {
+				t.Errorf("case %d: should have message:%s got:%s",
+					i, c.expectedMessage, errorCmd.Message)
+			}
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	cases := []struct {
+		message           string
+		expectedErr       error
+		expectedRequestID string
+	}{
+		{
+			"CHAT/1.1 #42 SEND zhenghe hello world\n",
+			nil,
+			"42",
+		},
+		{
+			"CHAT/1.1 SEND zhenghe hello world\n",
+			nil,
+			"",
+		},
+		{
+			"CHAT/1.1 # SEND zhenghe hello world\n",
+			InvalidMessageErr,
+			"",
+		},
+		{
+			"CHAT/1.1 #42\n",
+			InvalidMessageErr,
+			"",
+		},
+		{
+			"CHAT/1.0 #42 SEND zhenghe hello world\n",
+			InvalidMessageErr,
+			"",
+		},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+		mr.SetVersion(ProtocolVersion11)
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			sendCmd := cmd.(*SendCommand)
+			if sendCmd.RequestID != c.expectedRequestID {
+				t.Errorf("case %d: should have requestID:%s got:%s",
+					i, c.expectedRequestID, sendCmd.RequestID)
+			}
+
+			if sendCmd.Name != "zhenghe" {
+				t.Errorf("case %d: should have name:%s got:%s",
+					i, "zhenghe", sendCmd.Name)
+			}
+		}
+	}
+}
+
+func TestHelloMessage(t *testing.T) {
+	cases := []struct {
+		message              string
+		expectedErr          error
+		expectedVersions     []string
+		expectedCapabilities []string
+	}{
+		{
+			"CHAT/1.1 HELLO 1.0,1.1\n",
+			nil,
+			[]string{"1.0", "1.1"},
+			nil,
+		},
+		{
+			"CHAT/1.1 #1 HELLO 1.1 binary,receipts\n",
+			nil,
+			[]string{"1.1"},
+			[]string{"binary", "receipts"},
+		},
+		{
+			"CHAT/1.1 HELLO\n",
+			InvalidMessageErr,
+			nil,
+			nil,
+		},
+		{
+			"CHAT/2.0 HELLO 2.0\n",
+			InvalidMessageErr,
+			nil,
+			nil,
+		},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			helloCmd := cmd.(*HelloCommand)
+			if !reflect.DeepEqual(helloCmd.Versions, c.expectedVersions) {
+				t.Errorf("case %d: should have versions:%v got:%v",
+					i, c.expectedVersions, helloCmd.Versions)
+			}
+
+			if !reflect.DeepEqual(helloCmd.Capabilities, c.expectedCapabilities) {
+				t.Errorf("case %d: should have capabilities:%v got:%v",
+					i, c.expectedCapabilities, helloCmd.Capabilities)
+			}
+		}
+	}
+}
+
+func TestReaderVersion(t *testing.T) {
+	cases := []struct {
+		version     string
+		message     string
+		expectedErr error
+	}{
+		{
+			ProtocolVersion10,
+			"CHAT/1.1 SEND zhenghe hello\n",
+			InvalidMessageErr,
+		},
+		{
+			ProtocolVersion11,
+			"CHAT/1.1 SEND zhenghe hello\n",
+			nil,
+		},
+		{
+			ProtocolVersion11,
+			"CHAT/1.0 SEND zhenghe hello\n",
+			nil,
+		},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+		mr.SetVersion(c.version)
+
+		_, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+	}
+}
+
+func TestNoticeMessage(t *testing.T) {
+	cases := []struct {
+		message      string
+		expectedErr  error
+		expectedKind string
+		expectedText string
+	}{
+		{
+			"CHAT/1.0 NOTICE SESSION_REPLACED logged in from 127.0.0.1:4000\n",
+			nil,
+			NoticeSessionReplaced,
+			"logged in from 127.0.0.1:4000",
+		},
+		{
+			"CHAT/1.0 NOTICE\n",
+			InvalidMessageErr,
+			"",
+			"",
+		},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			noticeCmd := cmd.(*NoticeCommand)
+			if noticeCmd.Kind != c.expectedKind {
+				t.Errorf("case %d: should have kind:%s got:%s",
+					i, c.expectedKind, noticeCmd.Kind)
+			}
+
+			if noticeCmd.Text != c.expectedText {
+				t.Errorf("case %d: should have text:%s got:%s",
+					i, c.expectedText, noticeCmd.Text)
+			}
+		}
+	}
+}
+
+func TestHistoryMessage(t *testing.T) {
+	cases := []struct {
+		message     string
+		expectedErr error
+		expectedCmd HistoryCommand
+	}{
+		{
+			"CHAT/1.0 HISTORY USER xixi\n",
+			nil,
+			HistoryCommand{Kind: ConversationUser, Name: "xixi", Direction: HistoryBefore},
+		},
+		{
+			"CHAT/1.0 HISTORY GROUP team AFTER 42 20\n",
+			nil,
+			HistoryCommand{Kind: ConversationGroup, Name: "team", Direction: HistoryAfter, Cursor: 42, Limit: 20},
+		},
+		{"CHAT/1.0 HISTORY CHANNEL team\n", InvalidMessageErr, HistoryCommand{}},
+		{"CHAT/1.0 HISTORY USER xixi AROUND\n", InvalidMessageErr, HistoryCommand{}},
+		{"CHAT/1.0 HISTORY USER xixi BEFORE -1\n", InvalidMessageErr, HistoryCommand{}},
+		{"CHAT/1.0 HISTORY USER xixi BEFORE 0 -1\n", InvalidMessageErr, HistoryCommand{}},
+		{"CHAT/1.0 HISTORY USER\n", InvalidMessageErr, HistoryCommand{}},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			historyCmd := cmd.(*HistoryCommand)
+			historyCmd.BaseCommand = BaseCommand{}
+			if *historyCmd != c.expectedCmd {
+				t.Errorf("case %d: should have cmd:%+v got:%+v",
+					i, c.expectedCmd, *historyCmd)
+			}
+		}
+	}
+}
+
+func TestMessageMessage(t *testing.T) {
+	cases := []struct {
+		message           string
+		expectedErr       error
+		expectedID        uint64
+		expectedTimestamp int64
+		expectedSeq       uint64
+		expectedFrom      string
+		expectedData      string
+	}{
+		{"CHAT/1.0 MESSAGE 7 1562720884000 3 zhenghe hello world\n", nil, 7, 1562720884000, 3, "zhenghe", "hello world"},
+		{"CHAT/1.0 MESSAGE x 1562720884000 3 zhenghe hello\n", InvalidMessageErr, 0, 0, 0, "", ""},
+		{"CHAT/1.0 MESSAGE 7 1562720884000 3 zhenghe\n", InvalidMessageErr, 0, 0, 0, "", ""},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			messageCmd := cmd.(*MessageCommand)
+			if messageCmd.ID != c.expectedID || messageCmd.Timestamp != c.expectedTimestamp || messageCmd.Seq != c.expectedSeq {
+				t.Errorf("case %d: should have id:%d timestamp:%d seq:%d got:%d, %d, %d",
+					i, c.expectedID, c.expectedTimestamp, c.expectedSeq, messageCmd.ID, messageCmd.Timestamp, messageCmd.Seq)
+			}
+
+			if messageCmd.From != c.expectedFrom || string(messageCmd.Data) != c.expectedData {
+				t.Errorf("case %d: should have from:%s data:%s got:%s, %s",
+					i, c.expectedFrom, c.expectedData, messageCmd.From, messageCmd.Data)
+			}
+		}
+	}
+}
+
+func TestReceiveMessageMeta(t *testing.T) {
+	cases := []struct {
+		message     string
+		expectedErr error
+		expectedCmd ReceiveCommand
+	}{
+		{
+			"CHAT/1.2 RECEIVE 9 1562720884000 3 USER zhenghe zhenghe hello world\n",
+			nil,
+			ReceiveCommand{ID: 9, Timestamp: 1562720884000, Seq: 3, Kind: ConversationUser, Target: "zhenghe", From: "zhenghe"},
+		},
+		{"CHAT/1.2 RECEIVE zhenghe hello world\n", InvalidMessageErr, ReceiveCommand{}},
+		{"CHAT/1.2 RECEIVE 9 1562720884000 3 CHANNEL team zhenghe hello\n", InvalidMessageErr, ReceiveCommand{}},
+		{"CHAT/1.2 RECEIVE 9 1562720884000 x GROUP team zhenghe hello\n", InvalidMessageErr, ReceiveCommand{}},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+		mr.SetVersion(ProtocolVersion12)
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			receiveCmd := cmd.(*ReceiveCommand)
+			if string(receiveCmd.Data) != "hello world" {
+				t.Errorf("case %d: should have data:hello world got:%s", i, receiveCmd.Data)
+			}
+
+			receiveCmd.BaseCommand, receiveCmd.Data = BaseCommand{}, nil
+			if !reflect.DeepEqual(*receiveCmd, c.expectedCmd) {
+				t.Errorf("case %d: should have cmd:%+v got:%+v",
+					i, c.expectedCmd, *receiveCmd)
+			}
+		}
+	}
+}
+
+func TestReceiptAndSessionMessage(t *testing.T) {
+	cases := []struct {
+		message     string
+		expectedErr error
+		expectedCmd Command
+	}{
+		{
+			"CHAT/1.2 DELIVERED 9 xixi 1 2\n",
+			nil,
+			&DeliveredCommand{ID: 9, User: "xixi", Count: 1, Total: 2},
+		},
+		{
+			"CHAT/1.2 READ 9\n",
+			nil,
+			&ReadCommand{ID: 9},
+		},
+		{
+			"CHAT/1.2 READ 9 xixi 2 2\n",
+			nil,
+			&ReadCommand{ID: 9, User: "xixi", Count: 2, Total: 2},
+		},
+		{
+			"CHAT/1.2 SESSION 3f2a\n",
+			nil,
+			&SessionCommand{Token: "3f2a"},
+		},
+		{
+			"CHAT/1.2 RESUME 3f2a 9\n",
+			nil,
+			&ResumeCommand{Token: "3f2a", LastID: 9},
+		},
+		{"CHAT/1.2 RESUME 3f2a\n", InvalidMessageErr, nil},
+		{"CHAT/1.2 RESUME 3f2a nine\n", InvalidMessageErr, nil},
+		{"CHAT/1.2 DELIVERED 9 xixi\n", InvalidMessageErr, nil},
+		{"CHAT/1.2 READ 9 xixi\n", InvalidMessageErr, nil},
+		{"CHAT/1.2 READ nine\n", InvalidMessageErr, nil},
+		{"CHAT/1.2 READ 9 xixi 1 two\n", InvalidMessageErr, nil},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+		mr.SetVersion(ProtocolVersion12)
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			*cmd.Base() = BaseCommand{}
+			if !reflect.DeepEqual(cmd, c.expectedCmd) {
+				t.Errorf("case %d: should have cmd:%+v got:%+v",
+					i, c.expectedCmd, cmd)
+			}
+		}
+	}
+}
+
+func TestHeartbeatMessage(t *testing.T) {
+	cases := []struct {
+		message     string
+		expectedErr error
+		expectedCmd Command
+	}{
+		{"CHAT/1.0 PING\n", nil, &PingCommand{}},
+		{"CHAT/1.0 PING 42\n", nil, &PingCommand{Data: "42"}},
+		{"CHAT/1.0 PONG\n", nil, &PongCommand{}},
+		{"CHAT/1.0 PONG 42\n", nil, &PongCommand{Data: "42"}},
+		{"CHAT/1.0 PING 4 2\n", InvalidMessageErr, nil},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			*cmd.Base() = BaseCommand{}
+			if !reflect.DeepEqual(cmd, c.expectedCmd) {
+				t.Errorf("case %d: should have cmd:%+v got:%+v",
+					i, c.expectedCmd, cmd)
+			}
+		}
+	}
+}
+
+func TestPresenceMessage(t *testing.T) {
+	cases := []struct {
+		message     string
+		expectedErr error
+		expectedCmd Command
+	}{
+		{"CHAT/1.0 STATUS AWAY\n", nil, &StatusCommand{State: PresenceAway}},
+		{
+			"CHAT/1.0 STATUS BUSY in a meeting\n",
+			nil,
+			&StatusCommand{State: PresenceBusy, Message: "in a meeting"},
+		},
+		{"CHAT/1.0 STATUS OFFLINE\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 STATUS\n", InvalidMessageErr, nil},
+		{
+			"CHAT/1.0 PRESENCE xixi OFFLINE 1562720884000\n",
+			nil,
+			&PresenceCommand{User: "xixi", State: PresenceOffline, Since: 1562720884000},
+		},
+		{
+			"CHAT/1.0 PRESENCE xixi BUSY 1562720884000 in a meeting\n",
+			nil,
+			&PresenceCommand{User: "xixi", State: PresenceBusy, Since: 1562720884000, Message: "in a meeting"},
+		},
+		{"CHAT/1.0 PRESENCE xixi ONLINE\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 SUBSCRIBE xixi\n", nil, &SubscribeCommand{User: "xixi"}},
+		{"CHAT/1.0 UNSUBSCRIBE xixi\n", nil, &UnsubscribeCommand{User: "xixi"}},
+		{"CHAT/1.0 SUBSCRIBE\n", InvalidMessageErr, nil},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			*cmd.Base() = BaseCommand{}
+			if !reflect.DeepEqual(cmd, c.expectedCmd) {
+				t.Errorf("case %d: should have cmd:%+v got:%+v",
+					i, c.expectedCmd, cmd)
+			}
+		}
+	}
+}
+
+func TestQueryMessage(t *testing.T) {
+	cases := []struct {
+		message     string
+		expectedErr error
+		expectedCmd Command
+	}{
+		{"CHAT/1.0 LIST USERS\n", nil, &ListCommand{Kind: ListUsers}},
+		{"CHAT/1.0 LIST GROUPS 20 team\n", nil, &ListCommand{Kind: ListGroups, Limit: 20, After: "team"}},
+		{"CHAT/1.0 LIST MEMBERS team 0 xixi\n", nil, &ListCommand{Kind: ListMembers, Group: "team", After: "xixi"}},
+		{"CHAT/1.0 LIST MEMBERS\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 LIST USERS xixi\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 LIST USERS 20 xixi haha\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 LIST FRIENDS\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 NAMES USERS END\n", nil, &NamesCommand{Kind: ListUsers}},
+		{
+			"CHAT/1.0 NAMES MEMBERS MORE haha xixi\n",
+			nil,
+			&NamesCommand{Kind: ListMembers, More: true, Names: []string{"haha", "xixi"}},
+		},
+		{"CHAT/1.0 NAMES USERS MAYBE\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 WHOIS xixi\n", nil, &WhoisCommand{User: "xixi"}},
+		{
+			"CHAT/1.0 USERINFO xixi BUSY 1562720884000 team,ops in a meeting\n",
+			nil,
+			&UserInfoCommand{User: "xixi", State: PresenceBusy, Since: 1562720884000, Groups: []string{"team", "ops"}, Message: "in a meeting"},
+		},
+		{
+			"CHAT/1.0 USERINFO xixi OFFLINE 0 -\n",
+			nil,
+			&UserInfoCommand{User: "xixi", State: PresenceOffline},
+		},
+		{"CHAT/1.0 USERINFO xixi OFFLINE 0\n", InvalidMessageErr, nil},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			*cmd.Base() = BaseCommand{}
+			if !reflect.DeepEqual(cmd, c.expectedCmd) {
+				t.Errorf("case %d: should have cmd:%+v got:%+v",
+					i, c.expectedCmd, cmd)
+			}
+		}
+	}
+}
+
+func TestMembershipMessage(t *testing.T) {
+	cases := []struct {
+		message     string
+		expectedErr error
+		expectedCmd Command
+	}{
+		{"CHAT/1.0 INVITE team xixi\n", nil, &InviteCommand{Group: "team", User: "xixi"}},
+		{"CHAT/1.0 JOIN team\n", nil, &JoinCommand{Group: "team"}},
+		{"CHAT/1.0 KICK team xixi\n", nil, &KickCommand{Group: "team", User: "xixi"}},
+		{"CHAT/1.0 PROMOTE team xixi ADMIN\n", nil, &PromoteCommand{Group: "team", User: "xixi", Role: RoleAdmin}},
+		{"CHAT/1.0 PROMOTE team xixi KING\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 PROMOTE team xixi\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 INVITE team\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 KICK team xixi haha\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 ACCEPT team\n", nil, &AcceptCommand{Group: "team"}},
+		{"CHAT/1.0 DECLINE team\n", nil, &DeclineCommand{Group: "team"}},
+		{"CHAT/1.0 DECLINE\n", InvalidMessageErr, nil},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			*cmd.Base() = BaseCommand{}
+			if !reflect.DeepEqual(cmd, c.expectedCmd) {
+				t.Errorf("case %d: should have cmd:%+v got:%+v",
+					i, c.expectedCmd, cmd)
+			}
+		}
+	}
+}
+
+func TestChannelMessage(t *testing.T) {
+	cases := []struct {
+		message     string
+		expectedErr error
+		expectedCmd Command
+	}{
+		{"CHAT/1.0 CHANNEL golang\n", nil, &ChannelCommand{Name: "golang"}},
+		{"CHAT/1.0 CHANNEL\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 TOPIC golang release  party\n", nil, &TopicCommand{Group: "golang", Topic: "release  party"}},
+		{"CHAT/1.0 TOPIC golang\n", nil, &TopicCommand{Group: "golang"}},
+		{"CHAT/1.0 TOPIC\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 DESCRIPTION golang all about go\n", nil, &DescriptionCommand{Group: "golang", Description: "all about go"}},
+		{"CHAT/1.0 LIST CHANNELS 10 golang\n", nil, &ListCommand{Kind: ListChannels, Limit: 10, After: "golang"}},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			*cmd.Base() = BaseCommand{}
+			if !reflect.DeepEqual(cmd, c.expectedCmd) {
+				t.Errorf("case %d: should have cmd:%+v got:%+v",
+					i, c.expectedCmd, cmd)
+			}
+		}
+	}
+}
+
+func TestModerationMessage(t *testing.T) {
+	cases := []struct {
+		message     string
+		expectedErr error
+		expectedCmd Command
+	}{
+		{"CHAT/1.0 MUTE xixi 600 team\n", nil, &MuteCommand{Target: "xixi", Duration: 600, Group: "team"}},
+		{"CHAT/1.0 MUTE xixi 0\n", nil, &MuteCommand{Target: "xixi"}},
+		{"CHAT/1.0 MUTE xixi\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 MUTE xixi -1\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 MUTE xixi 3153600000\n", nil, &MuteCommand{Target: "xixi", Duration: MaxSanctionDuration}},
+		{"CHAT/1.0 MUTE xixi 10000000000\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 BAN 10.0.0.1 3600\n", nil, &BanCommand{Target: "10.0.0.1", Duration: 3600}},
+		{"CHAT/1.0 BAN xixi soon team\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 UNMUTE xixi team\n", nil, &UnmuteCommand{Target: "xixi", Group: "team"}},
+		{"CHAT/1.0 UNBAN 10.0.0.1\n", nil, &UnbanCommand{Target: "10.0.0.1"}},
+		{"CHAT/1.0 UNBAN\n", InvalidMessageErr, nil},
+		{"CHAT/1.0 DISCONNECT xixi\n", nil, &DisconnectCommand{User: "xixi"}},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			*cmd.Base() = BaseCommand{}
+			if !reflect.DeepEqual(cmd, c.expectedCmd) {
+				t.Errorf("case %d: should have cmd:%+v got:%+v",
+					i, c.expectedCmd, cmd)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"sync"
+)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]func() Command)
+)
+
+func init() {
+	Register(CmdSend, func() Command { return &SendCommand{} })
+	Register(CmdBroadCast, func() Command { return &BroadCastCommand{} })
+	Register(CmdLogin, func() Command { return &LoginCommand{} })
+	Register(CmdLogout, func() Command { return &LogoutCommand{} })
+	Register(CmdReceive, func() Command { return &ReceiveCommand{} })
+	Register(CmdGroup, func() Command { return &GroupCommand{} })
+	Register(CmdLeave, func() Command { return &LeaveCommand{} })
+	Register(CmdOk, func() Command { return &OkCommand{} })
+	Register(CmdError, func() Command { return &ErrorCommand{} })
+	Register(CmdHello, func() Command { return &HelloCommand{} })
+	Register(CmdNotice, func() Command { return &NoticeCommand{} })
+	Register(CmdHistory, func() Command { return &HistoryCommand{} })
+	Register(CmdMessage, func() Command { return &MessageCommand{} })
+	Register(CmdDelivered, func() Command { return &DeliveredCommand{} })
+	Register(CmdRead, func() Command { return &ReadCommand{} })
+	Register(CmdSession, func() Command { return &SessionCommand{} })
+	Register(CmdResume, func() Command { return &ResumeCommand{} })
+	Register(CmdPing, func() Command { return &PingCommand{} })
+	Register(CmdPong, func() Command { return &PongCommand{} })
+	Register(CmdStatus, func() Command { return &StatusCommand{} })
+	Register(CmdPresence, func() Command { return &PresenceCommand{} })
+	Register(CmdSubscribe, func() Command { return &SubscribeCommand{} })
+	Register(CmdUnsubscribe, func() Command { return &UnsubscribeCommand{} })
+	Register(CmdList, func() Command { return &ListCommand{} })
+	Register(CmdNames, func() Command { return &NamesCommand{} })
+	Register(CmdWhois, func() Command { return &WhoisCommand{} })
+	Register(CmdUserInfo, func() Command { return &UserInfoCommand{} })
+	Register(CmdInvite, func() Command { return &InviteCommand{} })
+	Register(CmdJoin, func() Command { return &JoinCommand{} })
+	Register(CmdKick, func() Command { return &KickCommand{} })
+	Register(CmdPromote, func() Command { return &PromoteCommand{} })
+	Register(CmdAccept, func() Command { return &AcceptCommand{} })
+	Register(CmdDecline, func() Command { return &DeclineCommand{} })
+	Register(CmdMute, func() Command { return &MuteCommand{} })
+	Register(CmdUnmute, func() Command { return &UnmuteCommand{} })
+	Register(CmdBan, func() Command { return &BanCommand{} })
+	Register(CmdUnban, func() Command { return &UnbanCommand{} })
+	Register(CmdDisconnect, func() Command { return &DisconnectCommand{} })
+	Register(CmdChannel, func() Command { return &ChannelCommand{} })
+	Register(CmdTopic, func() Command { return &TopicCommand{} })
+	Register(CmdDescription, func() Command { return &DescriptionCommand{} })
+}
+
+// Register makes a command readable by every reader under cmdName, factory
+// returns an empty command to decode into. It panics if cmdName is
+// registered twice.
+func Register(cmdName string, factory func() Command) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("protocol: Register command is nil")
+	}
+	if _, dup := registry[cmdName]; dup {
+		panic("protocol: Register called twice for command " + cmdName)
+	}
+	registry[cmdName] = factory
+}
+
+func newCommand(cmdName string) (Command, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	factory, ok := registry[cmdName]
+	if !ok {
+		return nil, false
+	}
+	return factory(), true
+}
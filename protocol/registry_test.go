@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const cmdPin = "PIN"
+
+type pinCommand struct {
+	BaseCommand
+	GroupName string
+	Text      string
+}
+
+func (c *pinCommand) CmdName() string {
+	return cmdPin
+}
+
+func (c *pinCommand) Encode() []string {
+	return []string{c.GroupName, c.Text}
+}
+
+func (c *pinCommand) Decode(args []string) error {
+	if len(args) < 2 {
+		return InvalidMessageErr
+	}
+
+	c.GroupName = strings.TrimSpace(args[0])
+	c.Text = strings.Join(args[1:], ProtocolSep)
+	return nil
+}
+
+func init() {
+	Register(cmdPin, func() Command { return &pinCommand{} })
+}
+
+func TestRegisteredCommand(t *testing.T) {
+	cases := []struct {
+		message           string
+		expectedErr       error
+		expectedGroupName string
+		expectedText      string
+	}{
+		{
+			"CHAT/1.0 PIN g1 release on friday\n",
+			nil,
+			"g1",
+			"release on friday",
+		},
+		{
+			"CHAT/1.0 PIN g1\n",
+			InvalidMessageErr,
+			"",
+			"",
+		},
+	}
+
+	for i, c := range cases {
+		mr := NewCommandReader(strings.NewReader(c.message))
+
+		cmd, err := mr.Read()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		if err == nil {
+			pinCmd := cmd.(*pinCommand)
+			if pinCmd.GroupName != c.expectedGroupName {
+				t.Errorf("case %d: should have groupName:%s got:%s",
+					i, c.expectedGroupName, pinCmd.GroupName)
+			}
+
+			if pinCmd.Text != c.expectedText {
+				t.Errorf("case %d: should have text:%s got:%s",
+					i, c.expectedText, pinCmd.Text)
+			}
+
+			buf := bytes.NewBuffer([]byte{})
+			_ = NewCommandWriter(buf).Write(cmd)
+			if buf.String() != c.message {
+				t.Errorf("case %d: expect message:%s got:%s",
+					i, c.message, buf.String())
+			}
+		}
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("should panic registering %s twice", CmdSend)
+		}
+	}()
+
+	Register(CmdSend, func() Command { return &SendCommand{} })
+}
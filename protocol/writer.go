@@ -2,12 +2,20 @@ package protocol
 
 import (
 	"bufio"
-	"fmt"
 	"io"
 )
 
+// Writer writes commands to a connection regardless of its framing.
+type Writer interface {
+	Write(cmd Command) error
+	// SetVersion stamps every command written from now on with version and
+	// drops what that version can't carry.
+	SetVersion(version string)
+}
+
 type CommandWriter struct {
-	writer *bufio.Writer
+	writer  *bufio.Writer
+	version string
 }
 
 func NewCommandWriter(writer io.Writer) *CommandWriter {
@@ -16,7 +24,13 @@ func NewCommandWriter(writer io.Writer) *CommandWriter {
 	}
 }
 
-func (w *CommandWriter) Write(cmd interface{}) (err error) {
-	_, err = w.writer.WriteString(fmt.Sprintf("%v", cmd))
+func (w *CommandWriter) SetVersion(version string) {
+	w.version = version
+}
+
+func (w *CommandWriter) Write(cmd Command) (err error) {
+	if _, err = w.writer.WriteString(line(encode(cmd, w.version))); err != nil {
+		return
+	}
 	return w.writer.Flush()
 }
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
 )
 
@@ -12,12 +13,30 @@ func TestWriteSendMessage(t *testing.T) {
 	}{
 		{
 			&SendCommand{
-				BaseCommand: BaseCommand{ProtocolName, ProtocolVersion},
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
 				Name:        "zhenghe",
 				Data:        []byte("hello world"),
 			},
 			"CHAT/1.0 SEND zhenghe hello world\n",
 		},
+		{
+			// data from a binary frame can't forge a line
+			&SendCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+				Name:        "zhenghe",
+				Data:        []byte("hi\r\nCHAT/1.0 NOTICE SERVER_SHUTDOWN bye"),
+			},
+			"CHAT/1.0 SEND zhenghe hi\\r\\nCHAT/1.0 NOTICE SERVER_SHUTDOWN bye\n",
+		},
+		{
+			// so is the backslash, or it'd read back as a newline
+			&SendCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+				Name:        "zhenghe",
+				Data:        []byte(`C:\new`),
+			},
+			"CHAT/1.0 SEND zhenghe C:\\\\new\n",
+		},
 	}
 
 	for i, c := range cases {
@@ -40,7 +59,7 @@ func TestWriteBroadCastMessage(t *testing.T) {
 	}{
 		{
 			&BroadCastCommand{
-				BaseCommand: BaseCommand{ProtocolName, ProtocolVersion},
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
 				GroupName:   "g1",
 				Data:        []byte("hello world"),
 			},
@@ -68,11 +87,19 @@ func TestWriteLoginMessage(t *testing.T) {
 	}{
 		{
 			&LoginCommand{
-				BaseCommand: BaseCommand{ProtocolName, ProtocolVersion},
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
 				Username:    "zhenghe",
 			},
 			"CHAT/1.0 LOGIN zhenghe\n",
 		},
+		{
+			&LoginCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+				Username:    "zhenghe",
+				Password:    "open sesame",
+			},
+			"CHAT/1.0 LOGIN zhenghe open sesame\n",
+		},
 	}
 
 	for i, c := range cases {
@@ -95,7 +122,7 @@ func TestWriteLogoutMessage(t *testing.T) {
 	}{
 		{
 			&LogoutCommand{
-				BaseCommand: BaseCommand{ProtocolName, ProtocolVersion},
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
 			},
 			"CHAT/1.0 LOGOUT\n",
 		},
@@ -121,7 +148,7 @@ func TestWriteReceiveMessage(t *testing.T) {
 	}{
 		{
 			&ReceiveCommand{
-				BaseCommand: BaseCommand{ProtocolName, ProtocolVersion},
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
 				From:        "zhenghe",
 				Data:        []byte("hello world"),
 			},
@@ -149,7 +176,7 @@ func TestWriteGroupMessage(t *testing.T) {
 	}{
 		{
 			&GroupCommand{
-				BaseCommand: BaseCommand{ProtocolName, ProtocolVersion},
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
 				GroupName:   "g1",
 				UserNames:   []string{"zhenghe", "xixi"},
 			},
@@ -177,7 +204,7 @@ func TestWriteLeaveMessage(t *testing.T) {
 	}{
 		{
 			&LeaveCommand{
-				BaseCommand: BaseCommand{ProtocolName, ProtocolVersion},
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
 				GroupName:   "g1",
 			},
 			"CHAT/1.0 LEAVE g1\n",
@@ -196,3 +223,309 @@ func TestWriteLeaveMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteOkMessage(t *testing.T) {
+	cases := []struct {
+		cmd             *OkCommand
+		expectedMessage string
+	}{
+		{
+			&OkCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+			},
+			"CHAT/1.0 OK\n",
+		},
+	}
+
+	for i, c := range cases {
+		buf := bytes.NewBuffer([]byte{})
+		mw := NewCommandWriter(buf)
+
+		_ = mw.Write(c.cmd)
+
+		if buf.String() != c.expectedMessage {
+			t.Errorf("Case %d: expect message:%s got:%s",
+				i, c.expectedMessage, buf.String())
+		}
+	}
+}
+
+func TestWriteErrorMessage(t *testing.T) {
+	cases := []struct {
+		cmd             *ErrorCommand
+		expectedMessage string
+	}{
+		{
+			&ErrorCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+				Code:        ErrCodeNoSuchGroup,
+				Message:     "no such group",
+			},
+			"CHAT/1.0 ERROR NO_SUCH_GROUP no such group\n",
+		},
+		{
+			&ErrorCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+				Code:        ErrCodeInternal,
+			},
+			"CHAT/1.0 ERROR INTERNAL\n",
+		},
+	}
+
+	for i, c := range cases {
+		buf := bytes.NewBuffer([]byte{})
+		mw := NewCommandWriter(buf)
+
+		_ = mw.Write(c.cmd)
+
+		if buf.String() != c.expectedMessage {
+			t.Errorf("Case %d: expect message:%s got:%s",
+				i, c.expectedMessage, buf.String())
+		}
+	}
+}
+
+func TestWriteRequestID(t *testing.T) {
+	cases := []struct {
+		cmd             Command
+		expectedMessage string
+	}{
+		{
+			&ReceiveCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion11, RequestID: "42"},
+				From:        "zhenghe",
+				Data:        []byte("hello world"),
+			},
+			"CHAT/1.1 #42 RECEIVE zhenghe hello world\n",
+		},
+		{
+			&OkCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion11, RequestID: "a1"},
+			},
+			"CHAT/1.1 #a1 OK\n",
+		},
+	}
+
+	for i, c := range cases {
+		buf := bytes.NewBuffer([]byte{})
+		mw := NewCommandWriter(buf)
+
+		_ = mw.Write(c.cmd)
+
+		if buf.String() != c.expectedMessage {
+			t.Errorf("Case %d: expect message:%s got:%s",
+				i, c.expectedMessage, buf.String())
+		}
+	}
+}
+
+func TestWriteVersion(t *testing.T) {
+	cases := []struct {
+		version         string
+		cmd             Command
+		expectedMessage string
+	}{
+		{
+			ProtocolVersion10,
+			&ReceiveCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion11, RequestID: "42"},
+				From:        "zhenghe",
+				Data:        []byte("hello world"),
+			},
+			"CHAT/1.0 RECEIVE zhenghe hello world\n",
+		},
+		{
+			ProtocolVersion12,
+			&ReceiveCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+				ID:          9,
+				Timestamp:   1562720884000,
+				Seq:         3,
+				Kind:        ConversationGroup,
+				Target:      "team",
+				From:        "zhenghe",
+				Data:        []byte("hello world"),
+			},
+			"CHAT/1.2 RECEIVE 9 1562720884000 3 GROUP team zhenghe hello world\n",
+		},
+		{
+			ProtocolVersion11,
+			&HelloCommand{
+				BaseCommand:  BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion, RequestID: "1"},
+				Versions:     []string{ProtocolVersion11},
+				Capabilities: []string{"receipts"},
+			},
+			"CHAT/1.1 #1 HELLO 1.1 receipts\n",
+		},
+	}
+
+	for i, c := range cases {
+		buf := bytes.NewBuffer([]byte{})
+		mw := NewCommandWriter(buf)
+		mw.SetVersion(c.version)
+
+		_ = mw.Write(c.cmd)
+
+		if buf.String() != c.expectedMessage {
+			t.Errorf("Case %d: expect message:%s got:%s",
+				i, c.expectedMessage, buf.String())
+		}
+	}
+}
+
+func TestWriteMessageCommands(t *testing.T) {
+	cases := []struct {
+		cmd             Command
+		expectedMessage string
+	}{
+		{
+			&HistoryCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+				Kind:        ConversationGroup,
+				Name:        "team",
+				Direction:   HistoryBefore,
+				Cursor:      42,
+				Limit:       20,
+			},
+			"CHAT/1.0 HISTORY GROUP team BEFORE 42 20\n",
+		},
+		{
+			&PingCommand{BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion}},
+			"CHAT/1.0 PING\n",
+		},
+		{
+			&PongCommand{BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion}, Data: "42"},
+			"CHAT/1.0 PONG 42\n",
+		},
+		{
+			&PresenceCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+				User:        "xixi",
+				State:       PresenceBusy,
+				Since:       1562720884000,
+				Message:     "in a meeting",
+			},
+			"CHAT/1.0 PRESENCE xixi BUSY 1562720884000 in a meeting\n",
+		},
+		{
+			&ListCommand{BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion}, Kind: ListMembers, Group: "team"},
+			"CHAT/1.0 LIST MEMBERS team\n",
+		},
+		{
+			&ListCommand{BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion}, Kind: ListUsers, After: "haha"},
+			"CHAT/1.0 LIST USERS 0 haha\n",
+		},
+		{
+			&NamesCommand{BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion}, Kind: ListUsers, More: true, Names: []string{"haha", "xixi"}},
+			"CHAT/1.0 NAMES USERS MORE haha xixi\n",
+		},
+		{
+			&UserInfoCommand{BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion}, User: "xixi", State: PresenceOffline},
+			"CHAT/1.0 USERINFO xixi OFFLINE 0 -\n",
+		},
+		{
+			&MessageCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+				ID:          7,
+				Timestamp:   1562720884000,
+				Seq:         3,
+				From:        "zhenghe",
+				Data:        []byte("hello world"),
+			},
+			"CHAT/1.0 MESSAGE 7 1562720884000 3 zhenghe hello world\n",
+		},
+		{
+			&DeliveredCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion12},
+				ID:          9,
+				User:        "xixi",
+				Count:       1,
+				Total:       2,
+			},
+			"CHAT/1.2 DELIVERED 9 xixi 1 2\n",
+		},
+		{
+			&ReadCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion12},
+				ID:          9,
+			},
+			"CHAT/1.2 READ 9\n",
+		},
+		{
+			&ReadCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion12},
+				ID:          9,
+				User:        "xixi",
+				Count:       2,
+				Total:       2,
+			},
+			"CHAT/1.2 READ 9 xixi 2 2\n",
+		},
+		{
+			&ResumeCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion12},
+				Token:       "3f2a",
+				LastID:      9,
+			},
+			"CHAT/1.2 RESUME 3f2a 9\n",
+		},
+	}
+
+	for i, c := range cases {
+		buf := bytes.NewBuffer([]byte{})
+		mw := NewCommandWriter(buf)
+
+		_ = mw.Write(c.cmd)
+
+		if buf.String() != c.expectedMessage {
+			t.Errorf("Case %d: expect message:%s got:%s",
+				i, c.expectedMessage, buf.String())
+		}
+	}
+}
+
+func TestLineRoundTrip(t *testing.T) {
+	cases := []struct {
+		cmd Command
+	}{
+		{
+			&SendCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+				Name:        "zhenghe",
+				Data:        []byte(`a literal \n, not a newline`),
+			},
+		},
+		{
+			&SendCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+				Name:        "zhenghe",
+				Data:        []byte("a newline\n, a \\\n and \\\\r\r"),
+			},
+		},
+		{
+			&BroadCastCommand{
+				BaseCommand: BaseCommand{Protocol: ProtocolName, Version: ProtocolVersion},
+				GroupName:   "g1",
+				Data:        []byte(`\\`),
+			},
+		},
+	}
+
+	for i, c := range cases {
+		buf := bytes.NewBuffer([]byte{})
+		if err := NewCommandWriter(buf).Write(c.cmd); err != nil {
+			t.Errorf("case %d: write err:%v", i, err)
+			continue
+		}
+
+		cmd, err := NewCommandReader(buf).Read()
+		if err != nil {
+			t.Errorf("case %d: read err:%v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(cmd, c.cmd) {
+			t.Errorf("case %d: should have cmd:%#v got:%#v",
+				i, c.cmd, cmd)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Authenticator verifies the credentials presented in LOGIN.
+type Authenticator interface {
+	Authenticate(username, password string) error
+}
+
+// UserChecker is implemented by Authenticators that know every user, SEND to
+// one of them is kept while they're offline even if they never logged in.
+type UserChecker interface {
+	HasUser(username string) bool
+}
+
+// MemoryAuthenticator keeps plain passwords in memory, it's meant for tests
+// and small deployments configured in code.
+type MemoryAuthenticator struct {
+	users map[string]string
+	mu    *sync.RWMutex
+}
+
+func NewMemoryAuthenticator(users map[string]string) *MemoryAuthenticator {
+	a := &MemoryAuthenticator{
+		users: make(map[string]string),
+		mu:    &sync.RWMutex{},
+	}
+	for username, password := range users {
+		a.users[username] = password
+	}
+	return a
+}
+
+func (a *MemoryAuthenticator) SetPassword(username, password string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.users[username] = password
+}
+
+func (a *MemoryAuthenticator) HasUser(username string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	_, ok := a.users[username]
+	return ok
+}
+
+func (a *MemoryAuthenticator) Authenticate(username, password string) error {
+	a.mu.RLock()
+	expected, ok := a.users[username]
+	a.mu.RUnlock()
+
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		return AuthFailedErr
+	}
+	return nil
+}
+
+// password file
+// # comment
+// username:$pbkdf2-sha256$iterations$salt$key
+//
+// salt and key are unpadded base64, lines are produced by HashPassword.
+
+const (
+	hashScheme     = "pbkdf2-sha256"
+	hashIterations = 100000
+	hashSaltSize   = 16
+)
+
+// FileAuthenticator checks passwords against salted hashes loaded from a
+// password file.
+type FileAuthenticator struct {
+	hashes map[string]string
+}
+
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &FileAuthenticator{hashes: make(map[string]string)}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, InvalidPasswordFileErr
+		}
+		if _, _, _, err := parseHash(parts[1]); err != nil {
+			return nil, err
+		}
+		a.hashes[parts[0]] = parts[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *FileAuthenticator) HasUser(username string) bool {
+	_, ok := a.hashes[username]
+	return ok
+}
+
+func (a *FileAuthenticator) Authenticate(username, password string) error {
+	hash, ok := a.hashes[username]
+	if !ok {
+		// spend the same time as a known user so names can't be probed
+		dummyHashOnce.Do(func() { dummyHash = mustHashPassword("") })
+		_ = CheckPassword(password, dummyHash)
+		return AuthFailedErr
+	}
+	return CheckPassword(password, hash)
+}
+
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// HashPassword returns the password file entry for password, with a random salt.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, hashSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := pbkdf2([]byte(password), salt, hashIterations)
+	return fmt.Sprintf("$%s$%d$%s$%s", hashScheme, hashIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func mustHashPassword(password string) string {
+	hash, err := HashPassword(password)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+// CheckPassword returns nil if password matches hash, AuthFailedErr otherwise.
+func CheckPassword(password, hash string) error {
+	iterations, salt, key, err := parseHash(hash)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(pbkdf2([]byte(password), salt, iterations), key) != 1 {
+		return AuthFailedErr
+	}
+	return nil
+}
+
+func parseHash(hash string) (iterations int, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != hashScheme {
+		err = InvalidPasswordFileErr
+		return
+	}
+
+	if iterations, err = strconv.Atoi(parts[2]); err != nil || iterations <= 0 {
+		err = InvalidPasswordFileErr
+		return
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil {
+		err = InvalidPasswordFileErr
+		return
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(key) != sha256.Size {
+		err = InvalidPasswordFileErr
+		return
+	}
+	return
+}
+
+// pbkdf2 derives a single sha256-sized key as in RFC 8018.
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+
+	var block [4]byte
+	binary.BigEndian.PutUint32(block[:], 1)
+	prf.Write(salt)
+	prf.Write(block[:])
+	u := prf.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
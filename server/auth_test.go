@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPbkdf2(t *testing.T) {
+	// RFC 7914 section 11, first 32 bytes
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"
+
+	key := pbkdf2([]byte("passwd"), []byte("salt"), 1)
+	if hex.EncodeToString(key) != expected {
+		t.Errorf("should have key:%s got:%x", expected, key)
+	}
+}
+
+func TestMemoryAuthenticator(t *testing.T) {
+	a := NewMemoryAuthenticator(map[string]string{"zhenghe": "secret"})
+
+	cases := []struct {
+		username    string
+		password    string
+		expectedErr error
+	}{
+		{"zhenghe", "secret", nil},
+		{"zhenghe", "wrong", AuthFailedErr},
+		{"xixi", "", AuthFailedErr},
+	}
+
+	for i, c := range cases {
+		if err := a.Authenticate(c.username, c.password); err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+	}
+}
+
+func TestFileAuthenticator(t *testing.T) {
+	hash, err := HashPassword("open sesame")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	_, _ = f.WriteString("# users\n\nzhenghe:" + hash + "\n")
+	_ = f.Close()
+
+	a, err := NewFileAuthenticator(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		username    string
+		password    string
+		expectedErr error
+	}{
+		{"zhenghe", "open sesame", nil},
+		{"zhenghe", "open", AuthFailedErr},
+		{"xixi", "open sesame", AuthFailedErr},
+	}
+
+	for i, c := range cases {
+		if err := a.Authenticate(c.username, c.password); err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+	}
+}
+
+func TestInvalidPasswordFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	_, _ = f.WriteString("zhenghe:plaintext\n")
+	_ = f.Close()
+
+	if _, err := NewFileAuthenticator(f.Name()); err != InvalidPasswordFileErr {
+		t.Errorf("should have err:%v got:%v", InvalidPasswordFileErr, err)
+	}
+}
@@ -1,13 +1,127 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"flag"
+	"fmt"
+	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
 	"github.com/ZhengHe-MD/network-examples/tcp/chat/server"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
-	ctx := context.TODO()
+	address := flag.String("address", ":3333", "address to listen on")
+	passwd := flag.String("passwd", "", "password file, any username is accepted without one")
+	loginPolicy := flag.String("login-policy", "reject", "second login of a user: reject, kick-old or multi-device")
+	groups := flag.String("groups", "", "directory to keep groups in, they're kept in memory only without one")
+	offlineSize := flag.Int("offline-size", 100, "messages kept for each offline user, 0 turns it off")
+	offlineTTL := flag.Duration("offline-ttl", 7*24*time.Hour, "how long messages to offline users are kept")
+	sessionGrace := flag.Duration("session-grace", 2*time.Minute, "how long a lost connection's session waits for RESUME, 0 turns it off")
+	operators := flag.String("operators", "", "comma separated users who may moderate the whole server")
+	moderation := flag.String("moderation", "", "file to keep mutes and bans in, they're kept in memory only without one")
+	inviteTTL := flag.Duration("invite-ttl", 7*24*time.Hour, "how long invitations to groups wait to be accepted")
+	maxMessage := flag.Int("max-message", protocol.DefaultMaxMessageSize, "bytes a line or frame sent by a client may take")
+	maxBody := flag.Int("max-body", 0, "bytes the arguments of a command may take, 0 leaves them bounded by -max-message alone")
+	oversize := flag.String("oversize", "reply", "client sending a message over the max size: reply or disconnect")
+	messageRate := flag.Float64("message-rate", 0, "SEND and BROADCAST each user and IP may send a second, 0 turns the limit off")
+	messageBurst := flag.Int("message-burst", 20, "SEND and BROADCAST each user and IP may send at once")
+	groupRate := flag.Float64("group-rate", 0, "group commands each user and IP may send a second, 0 turns the limit off")
+	groupBurst := flag.Int("group-burst", 10, "group commands each user and IP may send at once")
+	loginRate := flag.Float64("login-rate", 1, "LOGIN and RESUME each user and IP may send a second, 0 turns the limit off")
+	loginBurst := flag.Int("login-burst", 10, "LOGIN and RESUME each user and IP may send at once")
+	connRate := flag.Float64("conn-rate", 0, "connections each IP may open a second, 0 turns the limit off")
+	connBurst := flag.Int("conn-burst", 10, "connections each IP may open at once")
+	rateStrikes := flag.Int("rate-strikes", 10, "disconnect clients that go over a rate limit or fail to log in this many times in a row, 0 never does")
+	rateCooldown := flag.Duration("rate-cooldown", time.Minute, "how long the IP of a disconnected client may not connect")
+	heartbeat := flag.Duration("heartbeat", 30*time.Second, "PING clients that sent nothing for this long, 0 turns heartbeats off")
+	heartbeatTimeout := flag.Duration("heartbeat-timeout", 15*time.Second, "disconnect clients that send nothing for this long after a PING")
+	idleTimeout := flag.Duration("idle-timeout", 10*time.Minute, "disconnect clients too old for PINGs that send nothing for this long, 0 never does")
+	hash := flag.Bool("hash", false, "read a password from stdin, print its password file entry and exit")
+	flag.Parse()
+
+	if *hash {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatalf("read password err:%v", err)
+		}
+
+		entry, err := server.HashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			log.Fatalf("hash password err:%v", err)
+		}
+		fmt.Println(entry)
+		return
+	}
+
+	opts := []server.Option{
+		server.WithOfflineQueue(*offlineSize, *offlineTTL),
+		server.WithSessionResume(*sessionGrace),
+		server.WithInvitationTTL(*inviteTTL),
+		server.WithHeartbeat(*heartbeat, *heartbeatTimeout),
+		server.WithIdleTimeout(*idleTimeout),
+		server.WithMessageRateLimit(server.RateLimit{Rate: *messageRate, Burst: *messageBurst}),
+		server.WithGroupRateLimit(server.RateLimit{Rate: *groupRate, Burst: *groupBurst}),
+		server.WithLoginRateLimit(server.RateLimit{Rate: *loginRate, Burst: *loginBurst}),
+		server.WithConnectionRateLimit(server.RateLimit{Rate: *connRate, Burst: *connBurst}),
+		server.WithRateLimitStrikes(*rateStrikes, *rateCooldown),
+	}
+	switch *loginPolicy {
+	case "reject":
+		opts = append(opts, server.WithLoginPolicy(server.LoginPolicyReject))
+	case "kick-old":
+		opts = append(opts, server.WithLoginPolicy(server.LoginPolicyKickOld))
+	case "multi-device":
+		opts = append(opts, server.WithLoginPolicy(server.LoginPolicyMultiDevice))
+	default:
+		log.Fatalf("unknown login policy:%s", *loginPolicy)
+	}
+
+	switch *oversize {
+	case "reply":
+		opts = append(opts, server.WithMaxMessageSize(*maxMessage, *maxBody, server.OversizeReply))
+	case "disconnect":
+		opts = append(opts, server.WithMaxMessageSize(*maxMessage, *maxBody, server.OversizeDisconnect))
+	default:
+		log.Fatalf("unknown oversize policy:%s", *oversize)
+	}
+
+	if *passwd != "" {
+		a, err := server.NewFileAuthenticator(*passwd)
+		if err != nil {
+			log.Fatalf("load password file err:%v", err)
+		}
+		opts = append(opts, server.WithAuthenticator(a))
+	}
+
+	if *operators != "" {
+		opts = append(opts, server.WithOperators(strings.Split(*operators, ",")...))
+	}
+	if *moderation != "" {
+		opts = append(opts, server.WithModerationFile(*moderation))
+	}
+
+	if *groups != "" {
+		opts = append(opts, server.WithGroupStore(server.NewFileGroupStore(*groups)))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
 	var s server.ChatServer
-	s = server.NewTcpChatServer()
-	s.Start(ctx, ":3333")
-}
\ No newline at end of file
+	s = server.NewTcpChatServer(opts...)
+	if err := s.Start(ctx, *address); err != nil {
+		log.Fatal(err)
+	}
+}
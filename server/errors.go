@@ -0,0 +1,81 @@
+package server
+
+import (
+	"errors"
+	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
+)
+
+var (
+	UnknownUserErr        = errors.New("unknown user")
+	NoSuchGroupErr        = errors.New("no such group")
+	NotLoggedInErr        = errors.New("not logged in")
+	UnsupportedVersionErr = errors.New("unsupported version")
+	AuthFailedErr         = errors.New("authentication failed")
+	AlreadyLoggedInErr    = errors.New("already logged in")
+	ConnClosedErr         = errors.New("connection closed")
+	SlowConsumerErr       = errors.New("slow consumer")
+	NotMemberErr          = errors.New("not a member")
+	UnknownMessageErr     = errors.New("unknown message")
+	InvalidSessionErr     = errors.New("invalid or expired session")
+	GroupExistsErr        = errors.New("group exists")
+	AlreadyMemberErr      = errors.New("already a member")
+	NotInvitedErr         = errors.New("not invited")
+	NoPermissionErr       = errors.New("no permission")
+	MutedErr              = errors.New("muted")
+	BannedErr             = errors.New("banned")
+	RateLimitedErr        = errors.New("rate limited")
+	InvalidNameErr        = errors.New("invalid name")
+
+	InvalidPasswordFileErr   = errors.New("invalid password file")
+	InvalidGroupFileErr      = errors.New("invalid group file")
+	GroupStoreClosedErr      = errors.New("group store closed")
+	InvalidModerationFileErr = errors.New("invalid moderation file")
+)
+
+// errorCode maps a handler or reader error to the code sent back in an ERROR reply.
+func errorCode(err error) string {
+	switch err {
+	case UnknownUserErr:
+		return protocol.ErrCodeUnknownUser
+	case NoSuchGroupErr:
+		return protocol.ErrCodeNoSuchGroup
+	case NotLoggedInErr:
+		return protocol.ErrCodeNotLoggedIn
+	case UnsupportedVersionErr:
+		return protocol.ErrCodeUnsupportedVer
+	case AuthFailedErr:
+		return protocol.ErrCodeAuthFailed
+	case AlreadyLoggedInErr:
+		return protocol.ErrCodeAlreadyLogin
+	case NotMemberErr:
+		return protocol.ErrCodeNotMember
+	case UnknownMessageErr:
+		return protocol.ErrCodeUnknownMessage
+	case InvalidSessionErr:
+		return protocol.ErrCodeInvalidSession
+	case GroupExistsErr:
+		return protocol.ErrCodeGroupExists
+	case AlreadyMemberErr:
+		return protocol.ErrCodeAlreadyMember
+	case NotInvitedErr:
+		return protocol.ErrCodeNotInvited
+	case NoPermissionErr:
+		return protocol.ErrCodeNoPermission
+	case MutedErr:
+		return protocol.ErrCodeMuted
+	case BannedErr:
+		return protocol.ErrCodeBanned
+	case RateLimitedErr:
+		return protocol.ErrCodeRateLimited
+	case InvalidNameErr:
+		return protocol.ErrCodeInvalidName
+	case protocol.InvalidMessageErr:
+		return protocol.ErrCodeInvalidMessage
+	case protocol.MessageTooLargeErr:
+		return protocol.ErrCodeTooLarge
+	case protocol.UnsupportedCmdErr:
+		return protocol.ErrCodeUnsupportedCmd
+	default:
+		return protocol.ErrCodeInternal
+	}
+}
@@ -0,0 +1,747 @@
+package server
+
+import (
+	"bufio"
+	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// GroupStore keeps the members of every group and their roles, each group
+// has one owner as long as it has members.
+type GroupStore interface {
+	// Load reads the groups saved before, it's called once by the server
+	// before accepting connections.
+	Load() error
+	// Create adds group with owner as its only member, public makes it a
+	// channel anyone can find and join. created is false if the group
+	// already exists, in which case it's left as is.
+	Create(group, owner string, public bool) (created bool, err error)
+	// Join adds user to the members of group.
+	Join(group, user string) error
+	// Leave drops user from the members of group. The first admin in name
+	// order, or else the first member, takes over from an owner who leaves,
+	// and a group everyone left is gone.
+	Leave(group, user string) error
+	// SetRole gives a member of group role, making them the owner leaves the
+	// old owner an admin. The owner can't be given another role.
+	SetRole(group, user, role string) error
+	// Role returns the role of user in group, empty if they're not a member.
+	Role(group, user string) (string, error)
+	// SetTopic and SetDescription change what group is about, empty clears
+	// it.
+	SetTopic(group, topic string) error
+	SetDescription(group, description string) error
+	// Info returns whether group is public and what it's about.
+	Info(group string) (GroupInfo, error)
+	// Members returns the members of group in name order.
+	Members(group string) ([]string, error)
+	// Groups returns the groups user is a member of in name order.
+	Groups(user string) ([]string, error)
+	// Channels returns the public groups in name order.
+	Channels() ([]string, error)
+	// Close releases the store once the server is done with it.
+	Close() error
+}
+
+// GroupInfo is what a group is about beyond its members.
+type GroupInfo struct {
+	Public      bool
+	Topic       string
+	Description string
+}
+
+// groupEntry is a group in memory, members map each member to their role.
+type groupEntry struct {
+	GroupInfo
+	members map[string]string
+}
+
+// MemoryGroupStore keeps groups in memory only, they're gone when the
+// process exits.
+type MemoryGroupStore struct {
+	groups map[string]*groupEntry
+	mu     *sync.RWMutex
+}
+
+func NewMemoryGroupStore() *MemoryGroupStore {
+	return &MemoryGroupStore{
+		groups: make(map[string]*groupEntry),
+		mu:     &sync.RWMutex{},
+	}
+}
+
+func (m *MemoryGroupStore) Load() error {
+	return nil
+}
+
+func (m *MemoryGroupStore) Create(group, owner string, public bool) (created bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.groups[group]; ok {
+		return false, nil
+	}
+
+	m.groups[group] = &groupEntry{
+		GroupInfo: GroupInfo{Public: public},
+		members:   map[string]string{owner: protocol.RoleOwner},
+	}
+	return true, nil
+}
+
+func (m *MemoryGroupStore) Join(group, user string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g, ok := m.groups[group]
+	if !ok {
+		return NoSuchGroupErr
+	}
+	if _, ok := g.members[user]; !ok {
+		g.members[user] = protocol.RoleMember
+	}
+	return nil
+}
+
+func (m *MemoryGroupStore) Leave(group, user string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g, ok := m.groups[group]
+	if !ok {
+		return NoSuchGroupErr
+	}
+
+	role := g.members[user]
+	delete(g.members, user)
+	if len(g.members) == 0 {
+		delete(m.groups, group)
+		return nil
+	}
+	if role == protocol.RoleOwner {
+		g.members[successor(g.members)] = protocol.RoleOwner
+	}
+	return nil
+}
+
+// successor is who takes a group over, the first admin in name order or
+// else the first member.
+func successor(members map[string]string) string {
+	var first, admin string
+	for member, role := range members {
+		if first == "" || member < first {
+			first = member
+		}
+		if role == protocol.RoleAdmin && (admin == "" || member < admin) {
+			admin = member
+		}
+	}
+	if admin != "" {
+		return admin
+	}
+	return first
+}
+
+func (m *MemoryGroupStore) SetRole(group, user, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g, ok := m.groups[group]
+	if !ok {
+		return NoSuchGroupErr
+	}
+	current, ok := g.members[user]
+	if !ok {
+		return NotMemberErr
+	}
+	if current == protocol.RoleOwner {
+		if role == protocol.RoleOwner {
+			return nil
+		}
+		return NoPermissionErr
+	}
+
+	if role == protocol.RoleOwner {
+		for member, r := range g.members {
+			if r == protocol.RoleOwner {
+				g.members[member] = protocol.RoleAdmin
+			}
+		}
+	}
+	g.members[user] = role
+	return nil
+}
+
+func (m *MemoryGroupStore) Role(group, user string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	g, ok := m.groups[group]
+	if !ok {
+		return "", NoSuchGroupErr
+	}
+	return g.members[user], nil
+}
+
+func (m *MemoryGroupStore) SetTopic(group, topic string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g, ok := m.groups[group]
+	if !ok {
+		return NoSuchGroupErr
+	}
+	g.Topic = topic
+	return nil
+}
+
+func (m *MemoryGroupStore) SetDescription(group, description string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g, ok := m.groups[group]
+	if !ok {
+		return NoSuchGroupErr
+	}
+	g.Description = description
+	return nil
+}
+
+func (m *MemoryGroupStore) Info(group string) (GroupInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	g, ok := m.groups[group]
+	if !ok {
+		return GroupInfo{}, NoSuchGroupErr
+	}
+	return g.GroupInfo, nil
+}
+
+func (m *MemoryGroupStore) Members(group string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	g, ok := m.groups[group]
+	if !ok {
+		return nil, NoSuchGroupErr
+	}
+
+	names := make([]string, 0, len(g.members))
+	for member := range g.members {
+		names = append(names, member)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// admins returns the admins of group in name order, the owner left out.
+func (m *MemoryGroupStore) admins(group string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var admins []string
+	if g, ok := m.groups[group]; ok {
+		for member, role := range g.members {
+			if role == protocol.RoleAdmin {
+				admins = append(admins, member)
+			}
+		}
+	}
+	sort.Strings(admins)
+	return admins
+}
+
+// owner returns the owner of group, empty if there's no such group.
+func (m *MemoryGroupStore) owner(group string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if g, ok := m.groups[group]; ok {
+		for member, role := range g.members {
+			if role == protocol.RoleOwner {
+				return member
+			}
+		}
+	}
+	return ""
+}
+
+func (m *MemoryGroupStore) Groups(user string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var groups []string
+	for name, g := range m.groups {
+		if _, ok := g.members[user]; ok {
+			groups = append(groups, name)
+		}
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+func (m *MemoryGroupStore) Channels() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var channels []string
+	for name, g := range m.groups {
+		if g.Public {
+			channels = append(channels, name)
+		}
+	}
+	sort.Strings(channels)
+	return channels, nil
+}
+
+func (m *MemoryGroupStore) Close() error {
+	return nil
+}
+
+func (m *MemoryGroupStore) has(group string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.groups[group]
+	return ok
+}
+
+// names returns every group in name order.
+func (m *MemoryGroupStore) names() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := make([]string, 0, len(m.groups))
+	for name := range m.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedNames(set map[string]struct{}) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// group files
+// GROUP groupName owner userName1 userName2 ...\n
+// CHANNEL groupName owner userName1 userName2 ...\n
+// JOIN groupName userName\n
+// LEAVE groupName userName\n
+// ROLE groupName userName role\n
+// TOPIC groupName topic\n
+// DESCRIPTION groupName description\n
+//
+// the log has one line per change, the snapshot has a GROUP or CHANNEL line
+// per group followed by a ROLE line per admin and its topic and description.
+// Names are checked with validName before they're logged, the topic and
+// description are quoted with strconv.Quote, so binary framing can't slip a
+// newline into them.
+
+const (
+	groupOpCreate      = "GROUP"
+	groupOpChannel     = "CHANNEL"
+	groupOpJoin        = "JOIN"
+	groupOpLeave       = "LEAVE"
+	groupOpRole        = "ROLE"
+	groupOpTopic       = "TOPIC"
+	groupOpDescription = "DESCRIPTION"
+
+	groupLogFile      = "groups.log"
+	groupSnapshotFile = "groups.snapshot"
+
+	defaultSnapshotEvery = 1024
+)
+
+// FileGroupStore keeps groups in memory and makes every change durable in an
+// append-only log under dir. Once the log holds snapshotEvery changes it's
+// folded into a snapshot and started over.
+type FileGroupStore struct {
+	dir           string
+	groups        *MemoryGroupStore
+	log           *os.File
+	logged        int
+	snapshotEvery int
+	// mu keeps the log in the order changes are applied.
+	mu *sync.Mutex
+}
+
+func NewFileGroupStore(dir string) *FileGroupStore {
+	return &FileGroupStore{
+		dir:           dir,
+		groups:        NewMemoryGroupStore(),
+		snapshotEvery: defaultSnapshotEvery,
+		mu:            &sync.Mutex{},
+	}
+}
+
+// Load reads the snapshot, replays the log on top of it and opens the log
+// for appending. A last line cut short by a crash is dropped.
+func (f *FileGroupStore) Load() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return err
+	}
+
+	if _, _, err := f.replay(filepath.Join(f.dir, groupSnapshotFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	logPath := filepath.Join(f.dir, groupLogFile)
+	size, lines, err := f.replay(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f.logged = lines
+
+	if f.log, err = os.OpenFile(logPath, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return err
+	}
+	if err = f.log.Truncate(size); err != nil {
+		return err
+	}
+	if _, err = f.log.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	return nil
+}
+
+// replay applies every whole line of the file at path, size is where the
+// last whole line ends.
+func (f *FileGroupStore) replay(path string) (size int64, lines int, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return size, lines, nil
+		}
+		if err != nil {
+			return size, lines, err
+		}
+
+		if err = f.apply(strings.TrimSuffix(line, "\n")); err != nil {
+			return size, lines, err
+		}
+		size += int64(len(line))
+		lines++
+	}
+}
+
+// parseLine splits a line of a group file into its fields, checking there
+// are as many as its op takes.
+func parseLine(line string) ([]string, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, InvalidGroupFileErr
+	}
+
+	ok := false
+	switch fields[0] {
+	case groupOpCreate, groupOpChannel:
+		ok = len(fields) >= 3
+	case groupOpTopic, groupOpDescription:
+		ok = true
+	case groupOpJoin, groupOpLeave:
+		ok = len(fields) == 3
+	case groupOpRole:
+		ok = len(fields) == 4
+	}
+	if !ok {
+		return nil, InvalidGroupFileErr
+	}
+	return fields, nil
+}
+
+// apply makes the change of one line, replaying the log over a snapshot
+// may repeat changes or touch groups that are gone, which is harmless.
+func (f *FileGroupStore) apply(line string) error {
+	fields, err := parseLine(line)
+	if err != nil {
+		return err
+	}
+
+	switch fields[0] {
+	case groupOpCreate, groupOpChannel:
+		if created, _ := f.groups.Create(fields[1], fields[2], fields[0] == groupOpChannel); created {
+			for _, member := range fields[3:] {
+				_ = f.groups.Join(fields[1], member)
+			}
+		}
+	case groupOpTopic, groupOpDescription:
+		text, err := lineText(line)
+		if err != nil {
+			return err
+		}
+		if fields[0] == groupOpTopic {
+			_ = f.groups.SetTopic(fields[1], text)
+		} else {
+			_ = f.groups.SetDescription(fields[1], text)
+		}
+	case groupOpJoin:
+		_ = f.groups.Join(fields[1], fields[2])
+	case groupOpLeave:
+		_ = f.groups.Leave(fields[1], fields[2])
+	case groupOpRole:
+		_ = f.groups.SetRole(fields[1], fields[2], fields[3])
+	}
+	return nil
+}
+
+// validName reports whether name may be a group or user name: it can't be
+// empty or hold spaces or control characters, which would break the lines
+// it's written in.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// lineText unquotes the text that follows the op and the group in line.
+func lineText(line string) (string, error) {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 3 {
+		return "", InvalidGroupFileErr
+	}
+	text, err := strconv.Unquote(parts[2])
+	if err != nil {
+		return "", InvalidGroupFileErr
+	}
+	return text, nil
+}
+
+func (f *FileGroupStore) Create(group, owner string, public bool) (created bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !validName(group) || !validName(owner) {
+		return false, InvalidNameErr
+	}
+	if f.groups.has(group) {
+		return false, nil
+	}
+	op := groupOpCreate
+	if public {
+		op = groupOpChannel
+	}
+	err = f.commit([]string{op, group, owner})
+	return err == nil, err
+}
+
+func (f *FileGroupStore) Join(group, user string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.groups.has(group) {
+		return NoSuchGroupErr
+	}
+	if !validName(user) {
+		return InvalidNameErr
+	}
+	return f.commit([]string{groupOpJoin, group, user})
+}
+
+func (f *FileGroupStore) Leave(group, user string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.groups.has(group) {
+		return NoSuchGroupErr
+	}
+	return f.commit([]string{groupOpLeave, group, user})
+}
+
+// SetRole checks the change with the groups in memory first, so the log
+// only holds changes that apply.
+func (f *FileGroupStore) SetRole(group, user, role string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current, err := f.groups.Role(group, user)
+	if err != nil {
+		return err
+	}
+	if current == "" {
+		return NotMemberErr
+	}
+	if current == protocol.RoleOwner && role != protocol.RoleOwner {
+		return NoPermissionErr
+	}
+	return f.commit([]string{groupOpRole, group, user, role})
+}
+
+func (f *FileGroupStore) Role(group, user string) (string, error) {
+	return f.groups.Role(group, user)
+}
+
+func (f *FileGroupStore) SetTopic(group, topic string) error {
+	return f.setText(groupOpTopic, group, topic)
+}
+
+func (f *FileGroupStore) SetDescription(group, description string) error {
+	return f.setText(groupOpDescription, group, description)
+}
+
+func (f *FileGroupStore) setText(op, group, text string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.groups.has(group) {
+		return NoSuchGroupErr
+	}
+	return f.commit([]string{op, group, strconv.Quote(text)})
+}
+
+func (f *FileGroupStore) Info(group string) (GroupInfo, error) {
+	return f.groups.Info(group)
+}
+
+func (f *FileGroupStore) Members(group string) ([]string, error) {
+	return f.groups.Members(group)
+}
+
+func (f *FileGroupStore) Groups(user string) ([]string, error) {
+	return f.groups.Groups(user)
+}
+
+func (f *FileGroupStore) Channels() ([]string, error) {
+	return f.groups.Channels()
+}
+
+// commit checks one change would replay, writes it to the log, syncs it and
+// only then applies it, f.mu must be held.
+func (f *FileGroupStore) commit(fields []string) error {
+	if f.log == nil {
+		return GroupStoreClosedErr
+	}
+
+	line := strings.Join(fields, " ")
+	if strings.ContainsAny(line, "\r\n") {
+		return InvalidNameErr
+	}
+	if _, err := parseLine(line); err != nil {
+		return InvalidNameErr
+	}
+	if _, err := f.log.WriteString(line + "\n"); err != nil {
+		return err
+	}
+	if err := f.log.Sync(); err != nil {
+		return err
+	}
+	if err := f.apply(line); err != nil {
+		return err
+	}
+
+	f.logged++
+	if f.logged >= f.snapshotEvery {
+		// the change is safe in the log, a failed snapshot is retried later
+		if err := f.snapshot(); err != nil {
+			log.Printf("snapshot groups err:%v", err)
+		}
+	}
+	return nil
+}
+
+// snapshot writes every group to a new snapshot, swaps it in and empties
+// the log, f.mu must be held. Should it crash in between, replaying the log
+// over the new snapshot ends in the same groups.
+func (f *FileGroupStore) snapshot() error {
+	tmpPath := filepath.Join(f.dir, groupSnapshotFile+".tmp")
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, group := range f.groups.names() {
+		owner := f.groups.owner(group)
+		members, err := f.groups.Members(group)
+		if err != nil || owner == "" {
+			continue
+		}
+		info, _ := f.groups.Info(group)
+
+		op := groupOpCreate
+		if info.Public {
+			op = groupOpChannel
+		}
+		fields := []string{op, group, owner}
+		for _, member := range members {
+			if member != owner {
+				fields = append(fields, member)
+			}
+		}
+		_, _ = w.WriteString(strings.Join(fields, " ") + "\n")
+		for _, admin := range f.groups.admins(group) {
+			_, _ = w.WriteString(strings.Join([]string{groupOpRole, group, admin, protocol.RoleAdmin}, " ") + "\n")
+		}
+		if info.Topic != "" {
+			_, _ = w.WriteString(strings.Join([]string{groupOpTopic, group, strconv.Quote(info.Topic)}, " ") + "\n")
+		}
+		if info.Description != "" {
+			_, _ = w.WriteString(strings.Join([]string{groupOpDescription, group, strconv.Quote(info.Description)}, " ") + "\n")
+		}
+	}
+
+	if err = w.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	if err = os.Rename(tmpPath, filepath.Join(f.dir, groupSnapshotFile)); err != nil {
+		return err
+	}
+	if err = f.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = f.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f.logged = 0
+	return nil
+}
+
+func (f *FileGroupStore) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.log == nil {
+		return nil
+	}
+	err := f.log.Close()
+	f.log = nil
+	return err
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileGroupStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := NewFileGroupStore(dir)
+	f.snapshotEvery = 4
+	if err := f.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = f.Create("g1", "zhenghe", false)
+	_ = f.Join("g1", "xixi")
+	_ = f.Join("g1", "haha")
+	_, _ = f.Create("g2", "zhenghe", false)
+	_ = f.Join("g2", "xixi")
+	_ = f.Leave("g1", "xixi")
+	_ = f.SetRole("g1", "haha", "ADMIN")
+	_, _ = f.Create("g3", "xixi", true)
+	_ = f.Join("g3", "haha")
+	_ = f.SetTopic("g3", "release\nJOIN g3 zhenghe")
+	_ = f.SetDescription("g1", "old")
+	_ = f.Leave("g2", "xixi")
+	// folded into the snapshot by now
+	_ = f.Leave("g3", "xixi")
+	_ = f.SetDescription("g3", "all about\r\nreleases")
+	_ = f.SetDescription("g1", "")
+	if created, _ := f.Create("g3", "zhenghe", false); created {
+		t.Errorf("should not create g3 twice")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	logPath := filepath.Join(dir, groupLogFile)
+	data, _ := ioutil.ReadFile(logPath)
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("should have 3 lines in log got:%d", lines)
+	}
+
+	// a change cut short by a crash
+	lf, _ := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	_, _ = lf.WriteString("LEAVE g1 zheng")
+	_ = lf.Close()
+
+	f = NewFileGroupStore(dir)
+	if err := f.Load(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cases := []struct {
+		group           string
+		expectedMembers string
+		expectedErr     error
+	}{
+		{"g1", "haha,zhenghe", nil},
+		{"g2", "zhenghe", nil},
+		{"g3", "haha", nil},
+		{"g4", "", NoSuchGroupErr},
+	}
+
+	for i, c := range cases {
+		members, err := f.Members(c.group)
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+		if strings.Join(members, ",") != c.expectedMembers {
+			t.Errorf("case %d: should have members:%s got:%v",
+				i, c.expectedMembers, members)
+		}
+	}
+
+	for user, expected := range map[string]string{"zhenghe": "g1,g2", "haha": "g1,g3", "nobody": ""} {
+		if groups, _ := f.Groups(user); strings.Join(groups, ",") != expected {
+			t.Errorf("should have groups of %s:%s got:%v", user, expected, groups)
+		}
+	}
+
+	roles := []struct {
+		group, user, expected string
+	}{
+		{"g1", "zhenghe", "OWNER"},
+		{"g1", "haha", "ADMIN"},
+		{"g3", "haha", "OWNER"},
+		{"g3", "xixi", ""},
+	}
+	for i, c := range roles {
+		if role, _ := f.Role(c.group, c.user); role != c.expected {
+			t.Errorf("case %d: should have role:%s got:%s", i, c.expected, role)
+		}
+	}
+
+	infos := map[string]GroupInfo{
+		"g1": {},
+		"g3": {Public: true, Topic: "release\nJOIN g3 zhenghe", Description: "all about\r\nreleases"},
+	}
+	for group, expected := range infos {
+		if info, _ := f.Info(group); info != expected {
+			t.Errorf("should have info of %s:%+v got:%+v", group, expected, info)
+		}
+	}
+	if channels, _ := f.Channels(); strings.Join(channels, ",") != "g3" {
+		t.Errorf("should have channels:g3 got:%v", channels)
+	}
+
+	data, _ = ioutil.ReadFile(logPath)
+	if strings.HasSuffix(string(data), "zheng") {
+		t.Errorf("should have dropped the cut short line")
+	}
+}
+
+func TestMemoryGroupStoreRoles(t *testing.T) {
+	m := NewMemoryGroupStore()
+	_, _ = m.Create("g1", "zhenghe", false)
+	_ = m.Join("g1", "xixi")
+	_ = m.Join("g1", "haha")
+	_ = m.Join("g1", "lala")
+
+	cases := []struct {
+		op          string
+		user        string
+		role        string
+		expectedErr error
+		// expectedRoles are the roles of haha, lala, xixi and zhenghe after
+		expectedRoles string
+	}{
+		{"role", "lala", "ADMIN", nil, "MEMBER,ADMIN,MEMBER,OWNER"},
+		{"role", "zhenghe", "ADMIN", NoPermissionErr, "MEMBER,ADMIN,MEMBER,OWNER"},
+		{"role", "nobody", "ADMIN", NotMemberErr, "MEMBER,ADMIN,MEMBER,OWNER"},
+		{"role", "xixi", "OWNER", nil, "MEMBER,ADMIN,OWNER,ADMIN"},
+		{"leave", "xixi", "", nil, "MEMBER,OWNER,,ADMIN"},
+		{"leave", "lala", "", nil, "MEMBER,,,OWNER"},
+		{"leave", "zhenghe", "", nil, "OWNER,,,"},
+	}
+
+	for i, c := range cases {
+		var err error
+		switch c.op {
+		case "role":
+			err = m.SetRole("g1", c.user, c.role)
+		case "leave":
+			err = m.Leave("g1", c.user)
+		}
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v", i, c.expectedErr, err)
+		}
+
+		var roles []string
+		for _, user := range []string{"haha", "lala", "xixi", "zhenghe"} {
+			role, _ := m.Role("g1", user)
+			roles = append(roles, role)
+		}
+		if strings.Join(roles, ",") != c.expectedRoles {
+			t.Errorf("case %d: should have roles:%s got:%v", i, c.expectedRoles, roles)
+		}
+	}
+
+	_ = m.Leave("g1", "haha")
+	if _, err := m.Members("g1"); err != NoSuchGroupErr {
+		t.Errorf("should have dropped the empty group got err:%v", err)
+	}
+}
+
+func TestFileGroupStoreInvalidNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := NewFileGroupStore(dir)
+	if err := f.Load(); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Create("g1", "zhenghe", false)
+
+	cases := []struct {
+		op          func() error
+		expectedErr error
+	}{
+		{func() error { _, err := f.Create("", "zhenghe", false); return err }, InvalidNameErr},
+		{func() error { _, err := f.Create("g 2", "zhenghe", false); return err }, InvalidNameErr},
+		{func() error { _, err := f.Create("g2", "zheng\nhe", true); return err }, InvalidNameErr},
+		{func() error { return f.Join("g1", "xi xi") }, InvalidNameErr},
+		{func() error { return f.Join("g1", "xixi\x00") }, InvalidNameErr},
+		{func() error { return f.Leave("g1", "xixi\nJOIN g1 haha") }, InvalidNameErr},
+		{func() error { return f.Join("g1", "xixi") }, nil},
+	}
+
+	for i, c := range cases {
+		if err := c.op(); err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v", i, c.expectedErr, err)
+		}
+	}
+	_ = f.Close()
+
+	// nothing that was refused made it into the log
+	f = NewFileGroupStore(dir)
+	if err := f.Load(); err != nil {
+		t.Fatalf("should restart got err:%v", err)
+	}
+	defer f.Close()
+	if members, _ := f.Members("g1"); strings.Join(members, ",") != "xixi,zhenghe" {
+		t.Errorf("should have members:xixi,zhenghe got:%v", members)
+	}
+}
+
+func TestInvalidGroupFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []string{
+		"RENAME g1 g2\n",
+		// topics are always quoted
+		"GROUP g1 zhenghe\nTOPIC g1 release party\n",
+		"GROUP g1 zhenghe\nDESCRIPTION g1 \"unterminated\n",
+	}
+
+	for i, c := range cases {
+		_ = ioutil.WriteFile(filepath.Join(dir, groupLogFile), []byte(c), 0644)
+		if err := NewFileGroupStore(dir).Load(); err != InvalidGroupFileErr {
+			t.Errorf("case %d: should have err:%v got:%v", i, InvalidGroupFileErr, err)
+		}
+	}
+}
@@ -3,100 +3,1165 @@ package server
 import (
 	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
 	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func (s *TcpChatServer) handleSend(cc *clientConn, cmd *protocol.SendCommand) (err error) {
-	for scc, _ := range s.clientConnSet {
-		if scc.name == cmd.Name {
-			// fail-fast
-			if err = scc.writer.Write(&protocol.ReceiveCommand{
-				BaseCommand: cmd.BaseCommand,
-				From:        cc.name,
-				Data:        cmd.Data,
-			}); err != nil {
-				return
-			}
-		}
+	if err = s.muted(cc.Name(), ""); err != nil {
+		return
 	}
+	if !s.known(cmd.Name) {
+		log.Printf("user:%s not found", cmd.Name)
+		return UnknownUserErr
+	}
+
+	msg := &Message{Time: time.Now(), From: cc.Name(), To: cmd.Name, Data: cmd.Data}
+
+	unlock := s.sequencer.lock(msg.conversation())
+	defer unlock()
+
+	s.sequencer.stamp(msg)
+	s.receipts.track(msg.ID, msg.From, []string{cmd.Name})
+	if err = s.registry.deliver(cmd.Name, nil, receiveOf(cmd.BaseCommand, msg), msg.Time); err != nil {
+		log.Printf("user:%s not found", cmd.Name)
+		s.receipts.forget(msg.ID)
+		s.sequencer.unstamp(msg)
+		return
+	}
+
+	s.record(msg)
 	return
 }
 
+// known reports whether messages to user may be kept while they're offline:
+// they logged in since the server started or have a password. Made up names
+// would otherwise each get a queue.
+func (s *TcpChatServer) known(user string) bool {
+	if checker, ok := s.authenticator.(UserChecker); ok && checker.HasUser(user) {
+		return true
+	}
+	return s.presence.seen(user) || s.registry.online(user)
+}
+
 func (s *TcpChatServer) handleBroadcast(cc *clientConn, cmd *protocol.BroadCastCommand) (err error) {
-	userNames, ok := s.groupToMembers[cmd.GroupName]
-	if !ok {
-		log.Printf("group:%s doesn't exist", cmd.GroupName)
+	userNames, err := s.groups.Members(cmd.GroupName)
+	if err != nil {
+		log.Printf("group:%s err:%v", cmd.GroupName, err)
 		return
 	}
+	if !contains(userNames, cc.Name()) {
+		return NotMemberErr
+	}
+	if err = s.muted(cc.Name(), cmd.GroupName); err != nil {
+		return
+	}
+
+	msg := &Message{Time: time.Now(), From: cc.Name(), Group: cmd.GroupName, Data: cmd.Data}
 
-	userNameSet := make(map[string]interface{})
+	unlock := s.sequencer.lock(msg.conversation())
+	defer unlock()
+
+	s.sequencer.stamp(msg)
+	var recipients []string
 	for _, userName := range userNames {
-		userNameSet[userName] = struct{}{}
+		if userName != msg.From {
+			recipients = append(recipients, userName)
+		}
 	}
+	s.receipts.track(msg.ID, msg.From, recipients)
 
-	for scc, _ := range s.clientConnSet {
-		if scc == cc {
-			continue
-		}
+	receive := receiveOf(cmd.BaseCommand, msg)
+	for _, userName := range userNames {
+		// members who are offline and can't be queued for just miss it
+		_ = s.registry.deliver(userName, cc, receive, msg.Time)
+	}
+
+	s.record(msg)
+	return
+}
 
-		if _, ok := userNameSet[scc.name]; ok {
-			err = scc.writer.Write(&protocol.ReceiveCommand{
-				BaseCommand: cmd.BaseCommand,
-				From:        cc.name,
-				Data:        cmd.Data,
-			})
+// receiveOf is the RECEIVE delivering msg, its conversation is named after
+// the sender or the group as the recipients see it.
+func receiveOf(base protocol.BaseCommand, msg *Message) *protocol.ReceiveCommand {
+	kind, target := protocol.ConversationUser, msg.From
+	if msg.Group != "" {
+		kind, target = protocol.ConversationGroup, msg.Group
+	}
+
+	return &protocol.ReceiveCommand{
+		BaseCommand: base,
+		ID:          msg.ID,
+		Timestamp:   millis(msg.Time),
+		Seq:         msg.Seq,
+		Kind:        kind,
+		Target:      target,
+		From:        msg.From,
+		Data:        msg.Data,
+	}
+}
+
+// millis is t in unix milliseconds, as timestamps are sent.
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// maxMillis is the latest time millis can stand for.
+const maxMillis = math.MaxInt64 / int64(time.Millisecond)
+
+// fromMillis is the time of ms unix milliseconds, which can't be negative
+// or above maxMillis.
+func fromMillis(ms int64) time.Time {
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond))
+}
+
+// record keeps a delivered message in the history, the message has gone out
+// already so failing to record it is only logged.
+func (s *TcpChatServer) record(msg *Message) {
+	if err := s.messages.Append(msg); err != nil {
+		log.Printf("record message from user:%s err:%v", msg.From, err)
+	}
+}
+
+// handleLogin answers a 1.2 client with the SESSION token it may RESUME
+// with, older clients get OK.
+func (s *TcpChatServer) handleLogin(cc *clientConn, cmd *protocol.LoginCommand) (resp protocol.Command, err error) {
+	// an empty name leaves cc anonymous, others break the group and
+	// moderation files
+	if !validName(cmd.Username) {
+		return nil, InvalidNameErr
+	}
+	if err = s.banned(cmd.Username, cc); err != nil {
+		return
+	}
+	if s.authenticator != nil {
+		if err = s.authenticator.Authenticate(cmd.Username, cmd.Password); err != nil {
+			log.Printf("user:%s failed to authenticate from %s", cmd.Username, cc.conn.RemoteAddr().String())
+			return
 		}
 	}
+
+	token, kicked, err := s.registry.login(cc, cmd.Username, s.loginPolicy)
+	if err != nil {
+		log.Printf("user:%s login err:%v", cmd.Username, err)
+		return
+	}
+	log.Printf("set username:%s", cmd.Username)
+
+	s.kick(cmd.Username, cc, kicked)
+	s.announce()
+	if token != "" && protocol.SupportsResume(cc.Version()) {
+		resp = &protocol.SessionCommand{Token: token}
+	}
 	return
 }
 
-func (s *TcpChatServer) handleLogin(cc *clientConn, cmd *protocol.LoginCommand) (err error) {
-	cc.name = cmd.Username
-	log.Printf("set username:%s", cc.name)
-	return
+// handleResume takes over a session on a new connection, the messages the
+// client missed are written after the SESSION reply.
+func (s *TcpChatServer) handleResume(cc *clientConn, cmd *protocol.ResumeCommand) (resp protocol.Command, err error) {
+	if err = s.banned(s.registry.sessionUser(cmd.Token), cc); err != nil {
+		return
+	}
+	user, replaced, kicked, err := s.registry.resume(cc, cmd.Token, cmd.LastID, s.loginPolicy, time.Now())
+	if err != nil {
+		log.Printf("resume from %s err:%v", cc.conn.RemoteAddr().String(), err)
+		return
+	}
+	log.Printf("user:%s resumed from %s", user, cc.conn.RemoteAddr().String())
+
+	if replaced != nil {
+		log.Printf("user:%s dropped stale connection %s", user, replaced.conn.RemoteAddr().String())
+		replaced.stop()
+	}
+	s.kick(user, cc, kicked)
+	s.announce()
+	return &protocol.SessionCommand{Token: cmd.Token}, nil
+}
+
+// kick tells the sessions of user that cc replaced and stops them.
+func (s *TcpChatServer) kick(user string, cc *clientConn, kicked []*clientConn) {
+	for _, scc := range kicked {
+		log.Printf("user:%s session from %s replaced", user, scc.conn.RemoteAddr().String())
+		_ = scc.Write(&protocol.NoticeCommand{
+			BaseCommand: serverBase(),
+			Kind:        protocol.NoticeSessionReplaced,
+			Text:        "logged in from " + cc.conn.RemoteAddr().String(),
+		})
+		scc.stop()
+	}
 }
 
 func (s *TcpChatServer) handleLogout(cc *clientConn, cmd *protocol.LogoutCommand) (err error) {
-	delete(s.clientConnSet, cc)
-	err = cc.conn.Close()
-	log.Printf("user:%s logged out", cc.name)
+	s.registry.logout(cc)
+	log.Printf("user:%s logged out", cc.Name())
 	return
 }
 
+// handleGroup creates a group owned by the client's user and invites the
+// users listed, nobody becomes a member without JOIN.
 func (s *TcpChatServer) handleGroup(cc *clientConn, cmd *protocol.GroupCommand) (err error) {
-	s.mu.RLock()
-	if _, ok := s.groupToMembers[cmd.GroupName]; ok {
-		s.mu.RUnlock()
+	// the server scope can't be a group, its owner would moderate everyone
+	if !validName(cmd.GroupName) || cmd.GroupName == protocol.ScopeServer {
+		return InvalidNameErr
+	}
+
+	name := cc.Name()
+	created, err := s.groups.Create(cmd.GroupName, name, false)
+	if err != nil {
+		log.Printf("create group:%s err:%v", cmd.GroupName, err)
+		return
+	}
+	if !created {
 		log.Printf("group:%s exists", cmd.GroupName)
+		return GroupExistsErr
+	}
+	log.Printf("user:%s create group:%s", name, cmd.GroupName)
+
+	invited := map[string]struct{}{name: {}}
+	for _, user := range cmd.UserNames {
+		if _, ok := invited[user]; !ok {
+			invited[user] = struct{}{}
+			s.invite(cmd.GroupName, user, name)
+		}
+	}
+	return
+}
+
+// handleChannel creates a public channel owned by the client's user.
+func (s *TcpChatServer) handleChannel(cc *clientConn, cmd *protocol.ChannelCommand) (err error) {
+	if !validName(cmd.Name) || cmd.Name == protocol.ScopeServer {
+		return InvalidNameErr
+	}
+
+	name := cc.Name()
+	created, err := s.groups.Create(cmd.Name, name, true)
+	if err != nil {
+		log.Printf("create channel:%s err:%v", cmd.Name, err)
+		return
+	}
+	if !created {
+		log.Printf("group:%s exists", cmd.Name)
+		return GroupExistsErr
+	}
+	log.Printf("user:%s create channel:%s", name, cmd.Name)
+	return
+}
+
+// handleInvite lets the owner and admins of a group invite a user.
+func (s *TcpChatServer) handleInvite(cc *clientConn, cmd *protocol.InviteCommand) (err error) {
+	name := cc.Name()
+	if _, err = s.manager(cmd.Group, name); err != nil {
+		return
+	}
+	if err = s.joinable(cmd.Group, cmd.User); err != nil {
 		return
 	}
-	s.mu.RUnlock()
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.groupToMembers[cmd.GroupName] = cmd.UserNames
-	log.Printf("create group:%s", cmd.GroupName)
+	s.invite(cmd.Group, cmd.User, name)
+	return
+}
+
+// invite keeps the invitation and tells user if online, or else once they
+// log in.
+func (s *TcpChatServer) invite(group, user, by string) {
+	inv := s.invitations.add(group, user, by, time.Now())
+	log.Printf("user:%s invited user:%s to group:%s", by, user, group)
+
+	s.notify([]string{user}, protocol.NoticeInvited, invitedFields(inv)...)
+}
+
+// invitedFields is the text of the INVITED notice for inv.
+func invitedFields(inv invitation) []string {
+	return []string{inv.group, inv.by, strconv.FormatInt(millis(inv.expires), 10)}
+}
+
+// pendingInvitations writes to cc the invitations its user didn't take up
+// yet, leaving out the ones to groups that are gone or they joined since.
+func (s *TcpChatServer) pendingInvitations(cc *clientConn) {
+	name := cc.Name()
+	if name == "" {
+		return
+	}
+
+	for _, inv := range s.invitations.pending(name, time.Now()) {
+		if role, err := s.groups.Role(inv.group, name); err != nil || role != "" {
+			continue
+		}
+		if err := cc.Write(&protocol.NoticeCommand{
+			BaseCommand: serverBase(),
+			Kind:        protocol.NoticeInvited,
+			Text:        strings.Join(invitedFields(inv), protocol.ProtocolSep),
+		}); err != nil {
+			log.Printf("write invitations to %s err:%v", cc.conn.RemoteAddr().String(), err)
+			return
+		}
+	}
+}
+
+// handleJoin makes the client's user a member of a public channel or of a
+// group they were invited to.
+func (s *TcpChatServer) handleJoin(cc *clientConn, cmd *protocol.JoinCommand) (err error) {
+	name := cc.Name()
+	if err = s.joinable(cmd.Group, name); err != nil {
+		return
+	}
+	info, err := s.groups.Info(cmd.Group)
+	if err != nil {
+		return
+	}
+	if _, ok := s.invitations.take(cmd.Group, name, time.Now()); !ok && !info.Public {
+		log.Printf("user:%s not invited to group:%s", name, cmd.Group)
+		return NotInvitedErr
+	}
+
+	return s.join(cmd.Group, name)
+}
+
+// handleAccept makes the client's user a member of a group they were
+// invited to and didn't let the invitation expire.
+func (s *TcpChatServer) handleAccept(cc *clientConn, cmd *protocol.AcceptCommand) (err error) {
+	name := cc.Name()
+	if err = s.joinable(cmd.Group, name); err != nil {
+		return
+	}
+	if _, ok := s.invitations.take(cmd.Group, name, time.Now()); !ok {
+		log.Printf("user:%s not invited to group:%s", name, cmd.Group)
+		return NotInvitedErr
+	}
+
+	return s.join(cmd.Group, name)
+}
+
+// handleDecline drops the invitation of the client's user to a group and
+// tells who invited them.
+func (s *TcpChatServer) handleDecline(cc *clientConn, cmd *protocol.DeclineCommand) (err error) {
+	name := cc.Name()
+	inv, ok := s.invitations.take(cmd.Group, name, time.Now())
+	if !ok {
+		return NotInvitedErr
+	}
+
+	log.Printf("user:%s declined to join group:%s", name, cmd.Group)
+	s.notify([]string{inv.by}, protocol.NoticeInviteDeclined, cmd.Group, name)
+	return
+}
+
+// joinable checks that group exists, user isn't a member yet and isn't
+// banned from it.
+func (s *TcpChatServer) joinable(group, user string) error {
+	role, err := s.groups.Role(group, user)
+	if err != nil {
+		return err
+	}
+	if role != "" {
+		return AlreadyMemberErr
+	}
+	if _, ok := s.moderation.active(sanctionBan, group, user, time.Now()); ok {
+		log.Printf("user:%s is banned from group:%s", user, group)
+		return BannedErr
+	}
+	return nil
+}
+
+// join adds user to the members of group and tells the others.
+func (s *TcpChatServer) join(group, user string) (err error) {
+	if err = s.groups.Join(group, user); err != nil {
+		log.Printf("join group:%s err:%v", group, err)
+		return
+	}
+	log.Printf("user:%s joined group:%s", user, group)
+	s.notifyGroup(group, user, protocol.NoticeMemberJoined, group, user)
 	return
 }
 
 func (s *TcpChatServer) handleLeave(cc *clientConn, cmd *protocol.LeaveCommand) (err error) {
-	s.mu.RLock()
-	if _, ok := s.groupToMembers[cmd.GroupName]; !ok {
-		s.mu.RUnlock()
-		log.Printf("group:%s doesn't exist", cmd.GroupName)
+	name := cc.Name()
+	role, err := s.groups.Role(cmd.GroupName, name)
+	if err != nil {
+		return
+	}
+	if role == "" {
+		return NotMemberErr
+	}
+
+	if err = s.groups.Leave(cmd.GroupName, name); err != nil {
+		log.Printf("leave group:%s err:%v", cmd.GroupName, err)
+		return
+	}
+	log.Printf("%s leave group:%s", name, cmd.GroupName)
+
+	s.notifyGroup(cmd.GroupName, name, protocol.NoticeMemberLeft, cmd.GroupName, name)
+	if role == protocol.RoleOwner {
+		s.notifySuccessor(cmd.GroupName, name)
+	}
+	return
+}
+
+// handleKick lets the owner drop any other member of a group and admins drop
+// plain members.
+func (s *TcpChatServer) handleKick(cc *clientConn, cmd *protocol.KickCommand) (err error) {
+	name := cc.Name()
+	role, err := s.manager(cmd.Group, name)
+	if err != nil {
+		return
+	}
+	target, err := s.groups.Role(cmd.Group, cmd.User)
+	if err != nil {
+		return
+	}
+	if target == "" {
+		return NotMemberErr
+	}
+	if cmd.User == name || target == protocol.RoleOwner || (target == protocol.RoleAdmin && role != protocol.RoleOwner) {
+		return NoPermissionErr
+	}
+
+	return s.removeMember(cmd.Group, cmd.User, name)
+}
+
+// removeMember drops user from group on behalf of by and tells them and the
+// members left.
+func (s *TcpChatServer) removeMember(group, user, by string) (err error) {
+	role, _ := s.groups.Role(group, user)
+	if err = s.groups.Leave(group, user); err != nil {
+		log.Printf("kick from group:%s err:%v", group, err)
+		return
+	}
+	log.Printf("user:%s kicked user:%s from group:%s", by, user, group)
+	s.notifyGroup(group, by, protocol.NoticeMemberKicked, group, user, by)
+	s.notify([]string{user}, protocol.NoticeMemberKicked, group, user, by)
+	if role == protocol.RoleOwner {
+		s.notifySuccessor(group, user)
+	}
+	return
+}
+
+// handlePromote lets the owner of a group change the role of a member,
+// including handing the group over.
+func (s *TcpChatServer) handlePromote(cc *clientConn, cmd *protocol.PromoteCommand) (err error) {
+	name := cc.Name()
+	role, err := s.manager(cmd.Group, name)
+	if err != nil {
+		return
+	}
+	if role != protocol.RoleOwner || cmd.User == name {
+		return NoPermissionErr
+	}
+
+	if err = s.groups.SetRole(cmd.Group, cmd.User, cmd.Role); err != nil {
+		log.Printf("promote in group:%s err:%v", cmd.Group, err)
+		return
+	}
+	log.Printf("user:%s made user:%s %s of group:%s", name, cmd.User, cmd.Role, cmd.Group)
+	s.notifyGroup(cmd.Group, name, protocol.NoticeMemberRole, cmd.Group, cmd.User, cmd.Role, name)
+	if cmd.Role == protocol.RoleOwner {
+		s.notifyGroup(cmd.Group, name, protocol.NoticeMemberRole, cmd.Group, name, protocol.RoleAdmin, name)
+	}
+	return
+}
+
+// handleTopic answers with the topic of a group or lets its owner and
+// admins change it.
+func (s *TcpChatServer) handleTopic(cc *clientConn, cmd *protocol.TopicCommand) (resp protocol.Command, err error) {
+	if cmd.Topic == "" {
+		info, err := s.readInfo(cc.Name(), cmd.Group)
+		if err != nil {
+			return nil, err
+		}
+		return &protocol.TopicCommand{Group: cmd.Group, Topic: orEmptyList(info.Topic)}, nil
+	}
+
+	return nil, s.setInfo(cc.Name(), cmd.Group, protocol.NoticeTopic, cmd.Topic, s.groups.SetTopic)
+}
+
+// handleDescription is handleTopic for the description of a group.
+func (s *TcpChatServer) handleDescription(cc *clientConn, cmd *protocol.DescriptionCommand) (resp protocol.Command, err error) {
+	if cmd.Description == "" {
+		info, err := s.readInfo(cc.Name(), cmd.Group)
+		if err != nil {
+			return nil, err
+		}
+		return &protocol.DescriptionCommand{Group: cmd.Group, Description: orEmptyList(info.Description)}, nil
+	}
+
+	return nil, s.setInfo(cc.Name(), cmd.Group, protocol.NoticeDescription, cmd.Description, s.groups.SetDescription)
+}
+
+// readInfo returns the info of group if user may see it, anyone may see
+// that of a public channel.
+func (s *TcpChatServer) readInfo(user, group string) (info GroupInfo, err error) {
+	if info, err = s.groups.Info(group); err != nil {
+		return
+	}
+	if !info.Public {
+		role, err := s.groups.Role(group, user)
+		if err != nil {
+			return info, err
+		}
+		if role == "" {
+			return info, NotMemberErr
+		}
+	}
+	return
+}
+
+// setInfo changes the topic or description of group by set if user manages
+// it, EmptyList clears it, and tells the members as a notice of kind.
+func (s *TcpChatServer) setInfo(user, group, kind, text string, set func(group, text string) error) (err error) {
+	if _, err = s.manager(group, user); err != nil {
+		return
+	}
+	if text == protocol.EmptyList {
+		text = ""
+	}
+
+	if err = set(group, text); err != nil {
+		log.Printf("set %s of group:%s err:%v", kind, group, err)
+		return
+	}
+	log.Printf("user:%s set %s of group:%s", user, kind, group)
+	if text == "" {
+		s.notifyGroup(group, user, kind, group, user)
+	} else {
+		s.notifyGroup(group, user, kind, group, user, text)
+	}
+	return
+}
+
+// orEmptyList is text, or EmptyList if there's none.
+func orEmptyList(text string) string {
+	if text == "" {
+		return protocol.EmptyList
+	}
+	return text
+}
+
+// manager returns the role of user in group if it's one that may manage
+// members, otherwise an error.
+func (s *TcpChatServer) manager(group, user string) (role string, err error) {
+	if role, err = s.groups.Role(group, user); err != nil {
+		return
+	}
+
+	switch role {
+	case protocol.RoleOwner, protocol.RoleAdmin:
+		return role, nil
+	case "":
+		return "", NotMemberErr
+	default:
+		return "", NoPermissionErr
+	}
+}
+
+// notifySuccessor tells the members of group who took over from the owner
+// who left.
+func (s *TcpChatServer) notifySuccessor(group, from string) {
+	members, err := s.groups.Members(group)
+	if err != nil {
+		// the last member left
+		return
+	}
+	for _, member := range members {
+		if role, _ := s.groups.Role(group, member); role == protocol.RoleOwner {
+			s.notifyGroup(group, "", protocol.NoticeMemberRole, group, member, protocol.RoleOwner, from)
+			return
+		}
+	}
+}
+
+// notifyGroup writes a notice to the members of group who are online but
+// skip, the user whose command made the change and gets its reply instead.
+func (s *TcpChatServer) notifyGroup(group, skip, kind string, fields ...string) {
+	members, err := s.groups.Members(group)
+	if err != nil {
 		return
 	}
 
-	var userNames []string
-	for _, userName := range s.groupToMembers[cmd.GroupName] {
-		if userName != cc.name {
-			userNames = append(userNames, userName)
+	users := make([]string, 0, len(members))
+	for _, member := range members {
+		if member != skip {
+			users = append(users, member)
 		}
 	}
-	s.mu.RUnlock()
+	s.notify(users, kind, fields...)
+}
+
+// notify writes a notice to the sessions of users, it's not kept for the
+// ones who are offline.
+func (s *TcpChatServer) notify(users []string, kind string, fields ...string) {
+	s.notifyConns(s.registry.connsOf(users...), kind, fields...)
+}
+
+// notifyConns writes a notice to conns.
+func (s *TcpChatServer) notifyConns(conns []*clientConn, kind string, fields ...string) {
+	cmd := &protocol.NoticeCommand{
+		BaseCommand: serverBase(),
+		Kind:        kind,
+		Text:        strings.Join(fields, protocol.ProtocolSep),
+	}
+	for _, cc := range conns {
+		if err := cc.Write(cmd); err != nil {
+			log.Printf("write notice to %s err:%v", cc.conn.RemoteAddr().String(), err)
+		}
+	}
+}
+
+// handleHistory writes a MESSAGE for each past message asked for, then lets
+// the server answer OK. Only the members of a group may read its history.
+func (s *TcpChatServer) handleHistory(cc *clientConn, cmd *protocol.HistoryCommand) (err error) {
+	name := cc.Name()
+	q := HistoryQuery{
+		Cursor:  cmd.Cursor,
+		Forward: cmd.Direction == protocol.HistoryAfter,
+		Limit:   cmd.Limit,
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultHistoryPage
+	} else if q.Limit > maxHistoryPage {
+		q.Limit = maxHistoryPage
+	}
+
+	if cmd.Kind == protocol.ConversationGroup {
+		members, err := s.groups.Members(cmd.Name)
+		if err != nil {
+			log.Printf("group:%s err:%v", cmd.Name, err)
+			return err
+		}
+		if !contains(members, name) {
+			log.Printf("user:%s is not a member of group:%s", name, cmd.Name)
+			return NotMemberErr
+		}
+		q.Group = cmd.Name
+	} else {
+		q.User, q.Peer = name, cmd.Name
+	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.groupToMembers[cmd.GroupName] = userNames
-	log.Printf("%s leave group:%s", cc.name, cmd.GroupName)
+	msgs, err := s.messages.History(q)
+	if err != nil {
+		log.Printf("history of %s:%s err:%v", cmd.Kind, cmd.Name, err)
+		return
+	}
+
+	for _, msg := range msgs {
+		if err = cc.Write(&protocol.MessageCommand{
+			BaseCommand: cmd.BaseCommand,
+			ID:          msg.ID,
+			Timestamp:   millis(msg.Time),
+			Seq:         msg.Seq,
+			From:        msg.From,
+			Data:        msg.Data,
+		}); err != nil {
+			return
+		}
+	}
 	return
 }
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// handleRead relays to the sender that a recipient read a message.
+func (s *TcpChatServer) handleRead(cc *clientConn, cmd *protocol.ReadCommand) (err error) {
+	name := cc.Name()
+	from, count, total, first, err := s.receipts.read(cmd.ID, name)
+	if err != nil {
+		log.Printf("user:%s read message:%d err:%v", name, cmd.ID, err)
+		return
+	}
+
+	if first {
+		s.notifyReceipt(from, &protocol.ReadCommand{
+			BaseCommand: serverBase(),
+			ID:          cmd.ID,
+			User:        name,
+			Count:       count,
+			Total:       total,
+		})
+	}
+	return
+}
+
+// handleHello settles the version and capabilities used on the connection
+// and answers with a HELLO of its own instead of OK.
+func (s *TcpChatServer) handleHello(cc *clientConn, cmd *protocol.HelloCommand) (reply protocol.Command, err error) {
+	version := protocol.NegotiateVersion(cmd.Versions)
+	if version == "" {
+		log.Printf("no common version in:%v", cmd.Versions)
+		return nil, UnsupportedVersionErr
+	}
+
+	offered := make(map[string]struct{})
+	for _, capability := range cmd.Capabilities {
+		offered[capability] = struct{}{}
+	}
+
+	capabilities := make(map[string]struct{})
+	var agreed []string
+	for _, capability := range s.capabilities {
+		// receipts name messages by the ids of 1.2
+		if capability == protocol.CapabilityReceipts && !protocol.SupportsMessageMeta(version) {
+			continue
+		}
+		if _, ok := offered[capability]; ok {
+			capabilities[capability] = struct{}{}
+			agreed = append(agreed, capability)
+		}
+	}
+
+	cc.setSession(version, capabilities)
+	cc.reader.SetVersion(version)
+	cc.writeMu.Lock()
+	cc.writer.SetVersion(version)
+	cc.writeMu.Unlock()
+	log.Printf("%s speaks version:%s capabilities:%v", cc.conn.RemoteAddr().String(), version, agreed)
+
+	return &protocol.HelloCommand{
+		BaseCommand:  cmd.BaseCommand,
+		Versions:     []string{version},
+		Capabilities: agreed,
+	}, nil
+}
+
+// handleStatus sets the state of the client's user and tells its watchers.
+func (s *TcpChatServer) handleStatus(cc *clientConn, cmd *protocol.StatusCommand) (err error) {
+	name := cc.Name()
+
+	s.presence.mu.Lock()
+	defer s.presence.mu.Unlock()
+
+	if st, changed := s.presence.set(name, cmd.State, cmd.Message, time.Now()); changed {
+		log.Printf("user:%s is %s", name, cmd.State)
+		s.notifyPresence(name, st)
+	}
+	return
+}
+
+// handleSubscribe makes the client's user watch another user, whose current
+// PRESENCE is written before the OK.
+func (s *TcpChatServer) handleSubscribe(cc *clientConn, cmd *protocol.SubscribeCommand) (err error) {
+	name := cc.Name()
+
+	s.presence.mu.Lock()
+	defer s.presence.mu.Unlock()
+
+	s.presence.subscribe(name, cmd.User)
+	log.Printf("user:%s subscribed to user:%s", name, cmd.User)
+	if cc.hasCapability(protocol.CapabilityPresence) {
+		_ = cc.Write(presenceOf(cmd.User, s.presence.get(cmd.User)))
+	}
+	return
+}
+
+func (s *TcpChatServer) handleUnsubscribe(cc *clientConn, cmd *protocol.UnsubscribeCommand) (err error) {
+	name := cc.Name()
+
+	s.presence.mu.Lock()
+	defer s.presence.mu.Unlock()
+
+	s.presence.unsubscribe(name, cmd.User)
+	log.Printf("user:%s unsubscribed from user:%s", name, cmd.User)
+	return
+}
+
+// announce tells the watchers of the users who came online or went offline,
+// however they did: LOGIN, LOGOUT, a dropped or evicted connection.
+func (s *TcpChatServer) announce() {
+	users := s.registry.takeChanged()
+	if len(users) == 0 {
+		return
+	}
+	now := time.Now()
+
+	s.presence.mu.Lock()
+	defer s.presence.mu.Unlock()
+
+	for _, user := range users {
+		if st, changed := s.presence.connected(user, s.registry.online(user), now); changed {
+			log.Printf("user:%s is %s", user, st.state)
+			s.notifyPresence(user, st)
+		}
+	}
+}
+
+// notifyPresence writes st of user to the sessions that asked for presence
+// of the users sharing a group with user or subscribed to them,
+// s.presence.mu must be held.
+func (s *TcpChatServer) notifyPresence(user string, st status) {
+	watchers := s.peers(user)
+	for subscriber := range s.presence.subscribers[user] {
+		watchers[subscriber] = struct{}{}
+	}
+	delete(watchers, user)
+
+	cmd := presenceOf(user, st)
+	for _, cc := range s.registry.connsOf(sortedNames(watchers)...) {
+		if !cc.hasCapability(protocol.CapabilityPresence) {
+			continue
+		}
+		if err := cc.Write(cmd); err != nil {
+			log.Printf("write presence to %s err:%v", cc.conn.RemoteAddr().String(), err)
+		}
+	}
+}
+
+// roster writes the PRESENCE of every user the client of cc watches, if it
+// asked for presence.
+func (s *TcpChatServer) roster(cc *clientConn) {
+	name := cc.Name()
+	if name == "" || !cc.hasCapability(protocol.CapabilityPresence) {
+		return
+	}
+
+	s.presence.mu.Lock()
+	defer s.presence.mu.Unlock()
+
+	watched := s.peers(name)
+	for user := range s.presence.subscriptions[name] {
+		watched[user] = struct{}{}
+	}
+	delete(watched, name)
+
+	for _, user := range sortedNames(watched) {
+		if err := cc.Write(presenceOf(user, s.presence.get(user))); err != nil {
+			log.Printf("write roster to %s err:%v", cc.conn.RemoteAddr().String(), err)
+			return
+		}
+	}
+}
+
+// peers returns the users sharing a group with user, user included.
+func (s *TcpChatServer) peers(user string) map[string]struct{} {
+	peers := make(map[string]struct{})
+
+	groups, err := s.groups.Groups(user)
+	if err != nil {
+		log.Printf("groups of user:%s err:%v", user, err)
+		return peers
+	}
+	for _, group := range groups {
+		members, err := s.groups.Members(group)
+		if err != nil {
+			continue
+		}
+		for _, member := range members {
+			peers[member] = struct{}{}
+		}
+	}
+	return peers
+}
+
+// handleList answers with a page of the users online, the groups of the
+// client or the members of a group, which only its members may list.
+func (s *TcpChatServer) handleList(cc *clientConn, cmd *protocol.ListCommand) (resp protocol.Command, err error) {
+	name := cc.Name()
+
+	var names []string
+	switch cmd.Kind {
+	case protocol.ListUsers:
+		names = s.registry.onlineUsers()
+	case protocol.ListGroups:
+		names, err = s.groups.Groups(name)
+	case protocol.ListChannels:
+		names, err = s.groups.Channels()
+	case protocol.ListMembers:
+		if _, err = s.readInfo(name, cmd.Group); err == nil {
+			names, err = s.groups.Members(cmd.Group)
+		}
+	}
+	if err != nil {
+		log.Printf("list %s err:%v", cmd.Kind, err)
+		return
+	}
+
+	limit := cmd.Limit
+	if limit == 0 {
+		limit = defaultListPage
+	} else if limit > maxListPage {
+		limit = maxListPage
+	}
+	names, more := page(names, cmd.After, limit)
+	return &protocol.NamesCommand{Kind: cmd.Kind, More: more, Names: names}, nil
+}
+
+// page returns up to limit of the sorted names after the name after, more
+// tells whether there are others left.
+func page(names []string, after string, limit int) (pg []string, more bool) {
+	from := 0
+	if after != "" {
+		from = sort.Search(len(names), func(i int) bool { return names[i] > after })
+	}
+	to := from + limit
+	if to >= len(names) {
+		return names[from:], false
+	}
+	return names[from:to], true
+}
+
+// handleWhois answers with the presence of a user and the groups the client
+// shares with them, other groups stay private.
+func (s *TcpChatServer) handleWhois(cc *clientConn, cmd *protocol.WhoisCommand) (resp protocol.Command, err error) {
+	mine, err := s.groups.Groups(cc.Name())
+	if err != nil {
+		return
+	}
+	theirs, err := s.groups.Groups(cmd.User)
+	if err != nil {
+		return
+	}
+
+	var shared []string
+	for _, group := range theirs {
+		if contains(mine, group) {
+			shared = append(shared, group)
+		}
+	}
+
+	st, seen := s.presence.lookup(cmd.User)
+	if !seen && len(shared) == 0 {
+		return nil, UnknownUserErr
+	}
+
+	info := presenceOf(cmd.User, st)
+	return &protocol.UserInfoCommand{
+		User:    info.User,
+		State:   info.State,
+		Since:   info.Since,
+		Groups:  shared,
+		Message: info.Message,
+	}, nil
+}
+
+// handleMute keeps a user from sending in a group, or anywhere if no group
+// is given, for a while or for good.
+func (s *TcpChatServer) handleMute(cc *clientConn, cmd *protocol.MuteCommand) (err error) {
+	return s.sanction(cc.Name(), sanctionMute, scopeOf(cmd.Group), cmd.Target, cmd.Duration)
+}
+
+// handleBan keeps a user from joining a group, or a user or IP from logging
+// in if no group is given, and throws them out.
+func (s *TcpChatServer) handleBan(cc *clientConn, cmd *protocol.BanCommand) (err error) {
+	return s.sanction(cc.Name(), sanctionBan, scopeOf(cmd.Group), cmd.Target, cmd.Duration)
+}
+
+func (s *TcpChatServer) handleUnmute(cc *clientConn, cmd *protocol.UnmuteCommand) (err error) {
+	return s.lift(cc.Name(), sanctionMute, scopeOf(cmd.Group), cmd.Target)
+}
+
+func (s *TcpChatServer) handleUnban(cc *clientConn, cmd *protocol.UnbanCommand) (err error) {
+	return s.lift(cc.Name(), sanctionBan, scopeOf(cmd.Group), cmd.Target)
+}
+
+// handleDisconnect lets an operator close every connection of a user, their
+// sessions can't be resumed.
+func (s *TcpChatServer) handleDisconnect(cc *clientConn, cmd *protocol.DisconnectCommand) (err error) {
+	name := cc.Name()
+	if !s.isOperator(name) || cmd.User == name {
+		return NoPermissionErr
+	}
+	conns := s.registry.connsOf(cmd.User)
+	if len(conns) == 0 {
+		return UnknownUserErr
+	}
+
+	log.Printf("user:%s disconnected user:%s", name, cmd.User)
+	s.notifyConns(conns, protocol.NoticeDisconnected, name)
+	s.throwOut(conns)
+	return
+}
+
+// sanction puts a mute or ban of target in scope in force if by may
+// moderate them, tells the connections it hits and throws out the ones
+// banned.
+func (s *TcpChatServer) sanction(by, kind, scope, target string, duration int64) (err error) {
+	if !validName(scope) || !validName(target) {
+		return InvalidNameErr
+	}
+	if duration < 0 || duration > protocol.MaxSanctionDuration {
+		return protocol.InvalidMessageErr
+	}
+	if err = s.moderator(by, scope, target); err != nil {
+		return
+	}
+
+	sn := sanction{kind: kind, scope: scope, target: target, by: by}
+	if duration > 0 {
+		sn.until = time.Now().Add(time.Duration(duration) * time.Second)
+	}
+	if err = s.moderation.add(sn); err != nil {
+		log.Printf("%s %s in %s err:%v", kind, target, sn.scope, err)
+		return
+	}
+	log.Printf("user:%s %s %s in %s", by, kind, target, sn.scope)
+
+	var until int64
+	if !sn.until.IsZero() {
+		until = millis(sn.until)
+	}
+	notice := protocol.NoticeMuted
+	if kind == sanctionBan {
+		notice = protocol.NoticeBanned
+	}
+	conns := s.targeted(target)
+	s.notifyConns(conns, notice, sn.scope, by, strconv.FormatInt(until, 10))
+
+	if kind == sanctionBan {
+		if scope == protocol.ScopeServer {
+			s.throwOut(conns)
+		} else if role, _ := s.groups.Role(scope, target); role != "" {
+			return s.removeMember(scope, target, by)
+		}
+	}
+	return
+}
+
+// lift ends a mute or ban of target in scope early if by may moderate them,
+// it's no error if there was none.
+func (s *TcpChatServer) lift(by, kind, scope, target string) (err error) {
+	if !validName(scope) || !validName(target) {
+		return InvalidNameErr
+	}
+	if err = s.moderator(by, scope, target); err != nil {
+		return
+	}
+
+	lifted, err := s.moderation.lift(kind, scope, target, time.Now())
+	if err != nil {
+		log.Printf("lift %s of %s in %s err:%v", kind, target, scope, err)
+		return
+	}
+	if !lifted {
+		return
+	}
+	log.Printf("user:%s lifted %s of %s in %s", by, kind, target, scope)
+
+	notice := protocol.NoticeUnmuted
+	if kind == sanctionBan {
+		notice = protocol.NoticeUnbanned
+	}
+	s.notifyConns(s.targeted(target), notice, scope, by)
+	return
+}
+
+// moderator checks that by may sanction target in scope, the whole server
+// or a group. Operators may do both, the owner and admins of a group only
+// there and to those they could KICK.
+func (s *TcpChatServer) moderator(by, scope, target string) error {
+	if target == by {
+		return NoPermissionErr
+	}
+	if scope == protocol.ScopeServer {
+		if !s.isOperator(by) {
+			return NoPermissionErr
+		}
+		return nil
+	}
+
+	group := scope
+	if s.isOperator(by) {
+		_, err := s.groups.Info(group)
+		return err
+	}
+
+	role, err := s.manager(group, by)
+	if err != nil {
+		return err
+	}
+	targetRole, err := s.groups.Role(group, target)
+	if err != nil {
+		return err
+	}
+	if targetRole == protocol.RoleOwner || (targetRole == protocol.RoleAdmin && role != protocol.RoleOwner) {
+		return NoPermissionErr
+	}
+	return nil
+}
+
+func (s *TcpChatServer) isOperator(user string) bool {
+	_, ok := s.operators[user]
+	return ok
+}
+
+// muted returns MutedErr if user may not send on the whole server, or in
+// group if it's not empty.
+func (s *TcpChatServer) muted(user, group string) error {
+	now := time.Now()
+	if _, ok := s.moderation.active(sanctionMute, protocol.ScopeServer, user, now); ok {
+		return MutedErr
+	}
+	if group != "" {
+		if _, ok := s.moderation.active(sanctionMute, group, user, now); ok {
+			return MutedErr
+		}
+	}
+	return nil
+}
+
+// banned returns BannedErr if user, or the IP cc connects from, may not log
+// in.
+func (s *TcpChatServer) banned(user string, cc *clientConn) error {
+	now := time.Now()
+	if _, ok := s.moderation.active(sanctionBan, protocol.ScopeServer, hostOf(cc.conn.RemoteAddr()), now); ok {
+		log.Printf("%s is banned", cc.conn.RemoteAddr().String())
+		return BannedErr
+	}
+	if user == "" {
+		return nil
+	}
+	if _, ok := s.moderation.active(sanctionBan, protocol.ScopeServer, user, now); ok {
+		log.Printf("user:%s is banned", user)
+		return BannedErr
+	}
+	return nil
+}
+
+// targeted returns the connections of target, a user or an IP.
+func (s *TcpChatServer) targeted(target string) []*clientConn {
+	if net.ParseIP(target) == nil {
+		return s.registry.connsOf(target)
+	}
+
+	var conns []*clientConn
+	for _, cc := range s.registry.all() {
+		if hostOf(cc.conn.RemoteAddr()) == target {
+			conns = append(conns, cc)
+		}
+	}
+	return conns
+}
+
+// throwOut ends the sessions of conns and disconnects them once what's
+// queued for them is written.
+func (s *TcpChatServer) throwOut(conns []*clientConn) {
+	for _, cc := range conns {
+		s.registry.logout(cc)
+		cc.stop()
+	}
+}
+
+// scopeOf names where a sanction given with group applies, the whole server
+// if there's no group. No group can be named ScopeServer.
+func scopeOf(group string) string {
+	if group == "" {
+		return protocol.ScopeServer
+	}
+	return group
+}
+
+// hostOf is the IP of addr.
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPage(t *testing.T) {
+	names := []string{"haha", "xixi", "zhenghe"}
+
+	cases := []struct {
+		after         string
+		limit         int
+		expectedNames string
+		expectedMore  bool
+	}{
+		{"", 2, "haha,xixi", true},
+		{"xixi", 2, "zhenghe", false},
+		{"", 3, "haha,xixi,zhenghe", false},
+		// after needn't be one of the names
+		{"i", 1, "xixi", true},
+		{"zhenghe", 2, "", false},
+	}
+
+	for i, c := range cases {
+		pg, more := page(names, c.after, c.limit)
+		if strings.Join(pg, ",") != c.expectedNames || more != c.expectedMore {
+			t.Errorf("case %d: should have %s more:%v got:%v more:%v",
+				i, c.expectedNames, c.expectedMore, pg, more)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHistorySize = 1000
+	defaultHistoryPage = 50
+	maxHistoryPage     = 200
+	defaultListPage    = 100
+	maxListPage        = 1000
+)
+
+// Message is a direct or group message as recorded by the server, Seq
+// counts the messages of its conversation.
+type Message struct {
+	ID   uint64
+	Seq  uint64
+	Time time.Time
+	From string
+	// To is the recipient of a direct message, Group the group of a group
+	// message, only one of them is set.
+	To    string
+	Group string
+	Data  []byte
+}
+
+// HistoryQuery selects messages of one conversation: Group, or the direct
+// conversation between User and Peer. Forward lists the messages after the
+// one with id Cursor, otherwise the ones before it, a zero Cursor starts
+// from the oldest or the newest message.
+type HistoryQuery struct {
+	Group   string
+	User    string
+	Peer    string
+	Cursor  uint64
+	Forward bool
+	Limit   int
+}
+
+// MessageStore records messages and pages through them by conversation.
+type MessageStore interface {
+	// Append records msg, which has its ID and Seq set already. IDs only
+	// ever grow.
+	Append(msg *Message) error
+	// History returns up to q.Limit messages of the conversation, oldest
+	// first.
+	History(q HistoryQuery) ([]*Message, error)
+}
+
+// conversation is what messages are indexed by: a group, or the two users
+// of a direct conversation in name order.
+type conversation struct {
+	group        string
+	user1, user2 string
+}
+
+func directConversation(user, peer string) conversation {
+	if peer < user {
+		user, peer = peer, user
+	}
+	return conversation{user1: user, user2: peer}
+}
+
+func (m *Message) conversation() conversation {
+	if m.Group != "" {
+		return conversation{group: m.Group}
+	}
+	return directConversation(m.From, m.To)
+}
+
+func (q *HistoryQuery) conversation() conversation {
+	if q.Group != "" {
+		return conversation{group: q.Group}
+	}
+	return directConversation(q.User, q.Peer)
+}
+
+// MemoryMessageStore keeps the last size messages of every conversation in
+// memory.
+type MemoryMessageStore struct {
+	conversations map[conversation][]*Message
+	size          int
+	mu            *sync.RWMutex
+}
+
+func NewMemoryMessageStore(size int) *MemoryMessageStore {
+	return &MemoryMessageStore{
+		conversations: make(map[conversation][]*Message),
+		size:          size,
+		mu:            &sync.RWMutex{},
+	}
+}
+
+func (m *MemoryMessageStore) Append(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conv := msg.conversation()
+	msgs := m.conversations[conv]
+	if len(msgs) >= m.size {
+		msgs[0] = nil
+		msgs = msgs[1:]
+	}
+	m.conversations[conv] = append(msgs, msg)
+	return nil
+}
+
+func (m *MemoryMessageStore) History(q HistoryQuery) ([]*Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	msgs := m.conversations[q.conversation()]
+
+	var from, to int
+	if q.Forward {
+		from = sort.Search(len(msgs), func(i int) bool { return msgs[i].ID > q.Cursor })
+		to = from + q.Limit
+		if to > len(msgs) {
+			to = len(msgs)
+		}
+	} else {
+		to = len(msgs)
+		if q.Cursor > 0 {
+			to = sort.Search(len(msgs), func(i int) bool { return msgs[i].ID >= q.Cursor })
+		}
+		from = to - q.Limit
+		if from < 0 {
+			from = 0
+		}
+	}
+
+	page := make([]*Message, to-from)
+	copy(page, msgs[from:to])
+	return page, nil
+}
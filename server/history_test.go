@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func idsOf(msgs []*Message) string {
+	var ids []string
+	for _, msg := range msgs {
+		ids = append(ids, fmt.Sprint(msg.ID))
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestMemoryMessageStoreHistory(t *testing.T) {
+	m := NewMemoryMessageStore(5)
+	// odd ids up to 7 go to the direct conversation, the rest to the group,
+	// which keeps only its last five
+	for i := uint64(1); i <= 14; i++ {
+		if i%2 == 1 && i < 8 {
+			_ = m.Append(&Message{ID: i, From: "zhenghe", To: "xixi"})
+		} else {
+			_ = m.Append(&Message{ID: i, From: "xixi", Group: "team"})
+		}
+	}
+
+	cases := []struct {
+		q           HistoryQuery
+		expectedIDs string
+	}{
+		{HistoryQuery{User: "xixi", Peer: "zhenghe", Limit: 10}, "1,3,5,7"},
+		{HistoryQuery{User: "zhenghe", Peer: "xixi", Limit: 2}, "5,7"},
+		{HistoryQuery{User: "zhenghe", Peer: "xixi", Cursor: 5, Limit: 2}, "1,3"},
+		{HistoryQuery{User: "zhenghe", Peer: "xixi", Forward: true, Limit: 3}, "1,3,5"},
+		{HistoryQuery{User: "zhenghe", Peer: "xixi", Cursor: 3, Forward: true, Limit: 3}, "5,7"},
+		{HistoryQuery{User: "zhenghe", Peer: "haha", Limit: 3}, ""},
+		{HistoryQuery{Group: "team", Limit: 10}, "10,11,12,13,14"},
+		{HistoryQuery{Group: "team", Cursor: 12, Limit: 10}, "10,11"},
+	}
+
+	for i, c := range cases {
+		msgs, err := m.History(c.q)
+		if err != nil {
+			t.Errorf("case %d: should have no err got:%v", i, err)
+		}
+		if ids := idsOf(msgs); ids != c.expectedIDs {
+			t.Errorf("case %d: should have ids:%s got:%s",
+				i, c.expectedIDs, ids)
+		}
+	}
+}
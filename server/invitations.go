@@ -0,0 +1,113 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultInvitationTTL is how long an invitation waits to be accepted.
+const defaultInvitationTTL = 7 * 24 * time.Hour
+
+// invitation asks user to join group on behalf of by until it expires.
+type invitation struct {
+	group   string
+	user    string
+	by      string
+	expires time.Time
+}
+
+func (inv *invitation) expired(now time.Time) bool {
+	return !now.Before(inv.expires)
+}
+
+// invitations keeps the invitations nobody accepted or declined yet, indexed
+// by the user invited and then the group, a user has at most one to each
+// group.
+type invitations struct {
+	users map[string]map[string]*invitation
+	ttl   time.Duration
+	mu    *sync.Mutex
+}
+
+func newInvitations(ttl time.Duration) *invitations {
+	return &invitations{
+		users: make(map[string]map[string]*invitation),
+		ttl:   ttl,
+		mu:    &sync.Mutex{},
+	}
+}
+
+// add invites user to group, a later invitation replaces the earlier one.
+func (i *invitations) add(group, user, by string, now time.Time) invitation {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	groups, ok := i.users[user]
+	if !ok {
+		groups = make(map[string]*invitation)
+		i.users[user] = groups
+	}
+	inv := &invitation{group: group, user: user, by: by, expires: now.Add(i.ttl)}
+	groups[group] = inv
+	return *inv
+}
+
+// take removes the invitation of user to group, ok is false if there's none
+// or it expired.
+func (i *invitations) take(group, user string, now time.Time) (inv invitation, ok bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	found, ok := i.users[user][group]
+	if !ok {
+		return
+	}
+	i.remove(found)
+	if found.expired(now) {
+		return invitation{}, false
+	}
+	return *found, true
+}
+
+// pending returns the invitations of user that didn't expire in group
+// order.
+func (i *invitations) pending(user string, now time.Time) []invitation {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var invs []invitation
+	for _, inv := range i.users[user] {
+		if !inv.expired(now) {
+			invs = append(invs, *inv)
+		}
+	}
+	sort.Slice(invs, func(a, b int) bool {
+		return invs[a].group < invs[b].group
+	})
+	return invs
+}
+
+// expire drops the invitations nobody took up in time.
+func (i *invitations) expire(now time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, groups := range i.users {
+		for _, inv := range groups {
+			if inv.expired(now) {
+				i.remove(inv)
+			}
+		}
+	}
+}
+
+// remove drops inv, i.mu must be held.
+func (i *invitations) remove(inv *invitation) {
+	if groups, ok := i.users[inv.user]; ok {
+		delete(groups, inv.group)
+		if len(groups) == 0 {
+			delete(i.users, inv.user)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInvitations(t *testing.T) {
+	now := time.Now()
+	i := newInvitations(time.Hour)
+
+	i.add("team", "xixi", "zhenghe", now)
+	i.add("ops", "xixi", "haha", now.Add(30*time.Minute))
+	i.add("ops", "haha", "zhenghe", now)
+
+	cases := []struct {
+		at              time.Duration
+		expectedPending string
+	}{
+		{0, "ops:haha,team:zhenghe"},
+		{time.Hour, "ops:haha"},
+		{90 * time.Minute, ""},
+	}
+
+	for j, c := range cases {
+		pending := ""
+		for _, inv := range i.pending("xixi", now.Add(c.at)) {
+			if pending != "" {
+				pending += ","
+			}
+			pending += inv.group + ":" + inv.by
+		}
+		if pending != c.expectedPending {
+			t.Errorf("case %d: should have pending:%s got:%s", j, c.expectedPending, pending)
+		}
+	}
+
+	if _, ok := i.take("team", "xixi", now.Add(time.Hour)); ok {
+		t.Errorf("should not take an expired invitation")
+	}
+	if inv, ok := i.take("ops", "xixi", now.Add(time.Hour)); !ok || inv.by != "haha" {
+		t.Errorf("should take the invitation by haha got:%+v, %v", inv, ok)
+	}
+	if _, ok := i.take("ops", "xixi", now); ok {
+		t.Errorf("should not take an invitation twice")
+	}
+
+	i.expire(now.Add(time.Hour))
+	if len(i.users) != 0 {
+		t.Errorf("should have expired every invitation got:%v", i.users)
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sanctions, a mute keeps a user from sending, a ban from logging in or
+// joining a group
+const (
+	sanctionMute = "MUTE"
+	sanctionBan  = "BAN"
+)
+
+// sanction is a mute or ban of target, a user or for server bans an IP, in
+// scope, a group or protocol.ScopeServer. It lasts until until, forever if
+// that's zero.
+type sanction struct {
+	kind   string
+	scope  string
+	target string
+	by     string
+	until  time.Time
+}
+
+func (sn *sanction) key() string {
+	return sn.kind + " " + sn.scope + " " + sn.target
+}
+
+func (sn *sanction) expired(now time.Time) bool {
+	return !sn.until.IsZero() && !now.Before(sn.until)
+}
+
+// moderation file
+// # comment
+// MUTE|BAN scope target until by\n
+//
+// until is in unix milliseconds, 0 for forever. The whole file is written
+// again on every change, there are few enough sanctions for that.
+
+// moderation keeps the sanctions in force, saved to path if it's not empty.
+type moderation struct {
+	sanctions map[string]*sanction
+	path      string
+	mu        *sync.RWMutex
+}
+
+func newModeration(path string) *moderation {
+	return &moderation{
+		sanctions: make(map[string]*sanction),
+		path:      path,
+		mu:        &sync.RWMutex{},
+	}
+}
+
+// load reads the sanctions saved before, a missing file has none.
+func (m *moderation) load() error {
+	if m.path == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.Open(m.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 5 || (fields[0] != sanctionMute && fields[0] != sanctionBan) {
+			return InvalidModerationFileErr
+		}
+		ms, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil || ms < 0 || ms > maxMillis {
+			return InvalidModerationFileErr
+		}
+
+		sn := &sanction{kind: fields[0], scope: fields[1], target: fields[2], by: fields[4]}
+		if ms > 0 {
+			sn.until = fromMillis(ms)
+		}
+		m.sanctions[sn.key()] = sn
+	}
+	return scanner.Err()
+}
+
+// add puts sn in force, replacing the same kind of sanction of its target in
+// its scope. Names that would break the file aren't taken.
+func (m *moderation) add(sn sanction) error {
+	if !validName(sn.scope) || !validName(sn.target) || !validName(sn.by) {
+		return InvalidNameErr
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sanctions[sn.key()] = &sn
+	return m.save()
+}
+
+// lift ends a sanction early, ok is false if there was none.
+func (m *moderation) lift(kind, scope, target string, now time.Time) (ok bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := (&sanction{kind: kind, scope: scope, target: target}).key()
+	sn, ok := m.sanctions[key]
+	if !ok {
+		return false, nil
+	}
+	delete(m.sanctions, key)
+	return !sn.expired(now), m.save()
+}
+
+// active returns the sanction of kind on target in scope if it's in force.
+func (m *moderation) active(kind, scope, target string, now time.Time) (sanction, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sn, ok := m.sanctions[(&sanction{kind: kind, scope: scope, target: target}).key()]
+	if !ok || sn.expired(now) {
+		return sanction{}, false
+	}
+	return *sn, true
+}
+
+// expire drops the sanctions that ran out.
+func (m *moderation) expire(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	changed := false
+	for key, sn := range m.sanctions {
+		if sn.expired(now) {
+			delete(m.sanctions, key)
+			changed = true
+		}
+	}
+	if changed {
+		if err := m.save(); err != nil {
+			log.Printf("save moderation err:%v", err)
+		}
+	}
+}
+
+// save writes every sanction to a new file and swaps it in, m.mu must be
+// held.
+func (m *moderation) save() error {
+	if m.path == "" {
+		return nil
+	}
+
+	keys := make([]string, 0, len(m.sanctions))
+	for key := range m.sanctions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tmpPath := filepath.Join(filepath.Dir(m.path), "."+filepath.Base(m.path)+".tmp")
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, key := range keys {
+		sn := m.sanctions[key]
+		var until int64
+		if !sn.until.IsZero() {
+			until = millis(sn.until)
+		}
+		_, _ = fmt.Fprintf(w, "%s %s %s %d %s\n", sn.kind, sn.scope, sn.target, until, sn.by)
+	}
+
+	if err = w.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, m.path)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestModeration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moderation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "moderation")
+	now := time.Now()
+	m := newModeration(path)
+	if err := m.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = m.add(sanction{kind: sanctionMute, scope: "team", target: "xixi", by: "zhenghe", until: now.Add(time.Hour)})
+	_ = m.add(sanction{kind: sanctionBan, scope: "*", target: "10.0.0.7", by: "zhenghe"})
+	_ = m.add(sanction{kind: sanctionBan, scope: "*", target: "haha", by: "zhenghe", until: now.Add(time.Minute)})
+	if ok, _ := m.lift(sanctionBan, "*", "haha", now); !ok {
+		t.Errorf("should have lifted the ban of haha")
+	}
+	if ok, _ := m.lift(sanctionBan, "*", "haha", now); ok {
+		t.Errorf("should not lift the ban of haha twice")
+	}
+	for _, sn := range []sanction{
+		{kind: sanctionMute, scope: "*", target: "", by: "zhenghe"},
+		{kind: sanctionMute, scope: "te am", target: "xixi", by: "zhenghe"},
+		{kind: sanctionBan, scope: "*", target: "xi\nxi", by: "zhenghe"},
+	} {
+		if err := m.add(sn); err != InvalidNameErr {
+			t.Errorf("should have err:%v adding %+v got:%v", InvalidNameErr, sn, err)
+		}
+	}
+
+	m = newModeration(path)
+	if err := m.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		kind, scope, target string
+		at                  time.Duration
+		expected            bool
+	}{
+		{sanctionMute, "team", "xixi", 0, true},
+		{sanctionMute, "team", "xixi", time.Hour, false},
+		{sanctionMute, "*", "xixi", 0, false},
+		{sanctionBan, "team", "xixi", 0, false},
+		{sanctionBan, "*", "10.0.0.7", 24 * time.Hour, true},
+		{sanctionBan, "*", "haha", 0, false},
+	}
+
+	for i, c := range cases {
+		if _, ok := m.active(c.kind, c.scope, c.target, now.Add(c.at)); ok != c.expected {
+			t.Errorf("case %d: should have active:%v got:%v", i, c.expected, ok)
+		}
+	}
+
+	m.expire(now.Add(time.Hour))
+	m = newModeration(path)
+	_ = m.load()
+	if len(m.sanctions) != 1 {
+		t.Errorf("should have kept 1 sanction got:%d", len(m.sanctions))
+	}
+}
+
+func TestInvalidModerationFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moderation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "moderation")
+	cases := []string{
+		"# by hand\nKICK * haha 0 zhenghe\n",
+		"MUTE * haha -1 zhenghe\n",
+		// past what a time in unix nanoseconds holds
+		"MUTE * haha 10000000000000000 zhenghe\n",
+	}
+
+	for i, c := range cases {
+		_ = ioutil.WriteFile(path, []byte(c), 0644)
+		if err := newModeration(path).load(); err != InvalidModerationFileErr {
+			t.Errorf("case %d: should have err:%v got:%v", i, InvalidModerationFileErr, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOfflineSize = 100
+	defaultOfflineTTL  = 7 * 24 * time.Hour
+)
+
+type offlineMessage struct {
+	cmd     protocol.Command
+	expires time.Time
+}
+
+// offlineQueue keeps the messages sent to users while they have no session,
+// at most size per user and each for ttl, the oldest go first when full.
+type offlineQueue struct {
+	users map[string][]offlineMessage
+	size  int
+	ttl   time.Duration
+	mu    *sync.Mutex
+}
+
+func newOfflineQueue(size int, ttl time.Duration) *offlineQueue {
+	return &offlineQueue{
+		users: make(map[string][]offlineMessage),
+		size:  size,
+		ttl:   ttl,
+		mu:    &sync.Mutex{},
+	}
+}
+
+// push queues cmd for user, dropped reports whether the oldest message of
+// user was discarded to do so.
+func (q *offlineQueue) push(user string, cmd protocol.Command, now time.Time) (dropped bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msgs := unexpired(q.users[user], now)
+	if len(msgs) >= q.size {
+		msgs[0] = offlineMessage{}
+		msgs = msgs[1:]
+		dropped = true
+	}
+	q.users[user] = append(msgs, offlineMessage{cmd: cmd, expires: now.Add(q.ttl)})
+	return
+}
+
+// take removes and returns the unexpired messages of user, oldest first.
+func (q *offlineQueue) take(user string, now time.Time) []protocol.Command {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msgs := unexpired(q.users[user], now)
+	delete(q.users, user)
+
+	cmds := make([]protocol.Command, 0, len(msgs))
+	for _, msg := range msgs {
+		cmds = append(cmds, msg.cmd)
+	}
+	return cmds
+}
+
+// sweep throws away every expired message.
+func (q *offlineQueue) sweep(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for user, msgs := range q.users {
+		if msgs = unexpired(msgs, now); len(msgs) == 0 {
+			delete(q.users, user)
+		} else {
+			q.users[user] = msgs
+		}
+	}
+}
+
+// unexpired drops the expired head of msgs, which are in push order.
+func unexpired(msgs []offlineMessage, now time.Time) []offlineMessage {
+	i := 0
+	for i < len(msgs) && !now.Before(msgs[i].expires) {
+		i++
+	}
+	return msgs[i:]
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
+	"strings"
+	"testing"
+	"time"
+)
+
+func textsOf(cmds []protocol.Command) string {
+	var texts []string
+	for _, cmd := range cmds {
+		texts = append(texts, cmd.(*protocol.NoticeCommand).Text)
+	}
+	return strings.Join(texts, ",")
+}
+
+func TestOfflineQueue(t *testing.T) {
+	start := time.Now()
+
+	cases := []struct {
+		pushes          []string
+		takeAfter       time.Duration
+		expectedTexts   string
+		expectedDropped int
+	}{
+		{[]string{"1", "2"}, 0, "1,2", 0},
+		{[]string{"1", "2", "3", "4"}, 0, "2,3,4", 1},
+		// pushed a second apart, the first two are past their ttl
+		{[]string{"1", "2", "3"}, 11500 * time.Millisecond, "3", 0},
+		{[]string{"1"}, time.Hour, "", 0},
+	}
+
+	for i, c := range cases {
+		q := newOfflineQueue(3, 10*time.Second)
+
+		dropped := 0
+		for j, text := range c.pushes {
+			if q.push("zhenghe", noticeOf(text), start.Add(time.Duration(j)*time.Second)) {
+				dropped++
+			}
+		}
+		if dropped != c.expectedDropped {
+			t.Errorf("case %d: should have dropped:%d got:%d",
+				i, c.expectedDropped, dropped)
+		}
+
+		if texts := textsOf(q.take("zhenghe", start.Add(c.takeAfter))); texts != c.expectedTexts {
+			t.Errorf("case %d: should have texts:%s got:%s",
+				i, c.expectedTexts, texts)
+		}
+		if texts := textsOf(q.take("zhenghe", start.Add(c.takeAfter))); texts != "" {
+			t.Errorf("case %d: should have taken everything got:%s", i, texts)
+		}
+	}
+}
+
+func TestOfflineQueueSweep(t *testing.T) {
+	now := time.Now()
+	q := newOfflineQueue(3, time.Minute)
+	q.push("zhenghe", noticeOf("1"), now)
+	q.push("xixi", noticeOf("2"), now.Add(time.Minute))
+
+	q.sweep(now.Add(90 * time.Second))
+
+	if len(q.users) != 1 || len(q.users["xixi"]) != 1 {
+		t.Errorf("should have kept only the message to xixi got:%v", q.users)
+	}
+}
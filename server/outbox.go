@@ -0,0 +1,138 @@
+package server
+
+import (
+	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
+	"sync"
+)
+
+// OverflowPolicy decides what happens to a command written to a client whose
+// outbound queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDisconnect closes the connection of the slow client.
+	OverflowDisconnect OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest queued command to make room.
+	OverflowDropOldest
+	// OverflowDropNewest discards the command being written.
+	OverflowDropNewest
+)
+
+const defaultOutboxSize = 256
+
+// outbox is the bounded queue of commands waiting to be written to one
+// client, filled by any goroutine and drained by the writeLoop of the client.
+type outbox struct {
+	items  []protocol.Command
+	size   int
+	policy OverflowPolicy
+	closed bool
+	ready  chan struct{}
+	// room is signalled when take makes room for pushWait.
+	room chan struct{}
+	mu   *sync.Mutex
+}
+
+func newOutbox(size int, policy OverflowPolicy) *outbox {
+	return &outbox{
+		size:   size,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+		room:   make(chan struct{}, 1),
+		mu:     &sync.Mutex{},
+	}
+}
+
+// push queues cmd, dropped reports whether a command was discarded to do so.
+func (o *outbox) push(cmd protocol.Command) (dropped bool, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return false, ConnClosedErr
+	}
+
+	if len(o.items) >= o.size {
+		switch o.policy {
+		case OverflowDisconnect:
+			return false, SlowConsumerErr
+		case OverflowDropNewest:
+			return true, nil
+		case OverflowDropOldest:
+			o.items[0] = nil
+			o.items = o.items[1:]
+			dropped = true
+		}
+	}
+
+	o.items = append(o.items, cmd)
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+	return
+}
+
+// pushWait queues cmd like push, but waits for room rather than overflow.
+// It gives up once o is closed or quit is.
+func (o *outbox) pushWait(cmd protocol.Command, quit <-chan struct{}) error {
+	for {
+		o.mu.Lock()
+		if o.closed {
+			o.mu.Unlock()
+			return ConnClosedErr
+		}
+		if len(o.items) < o.size {
+			o.items = append(o.items, cmd)
+			o.mu.Unlock()
+			signal(o.ready)
+			return nil
+		}
+		o.mu.Unlock()
+
+		select {
+		case <-o.room:
+		case <-quit:
+			return ConnClosedErr
+		}
+	}
+}
+
+// signal wakes up whoever waits on c, if anyone.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// take waits for queued commands and returns all of them, ok is false once
+// the outbox is closed and the last commands have been taken.
+func (o *outbox) take() (cmds []protocol.Command, ok bool) {
+	for {
+		o.mu.Lock()
+		if len(o.items) > 0 || o.closed {
+			cmds, o.items = o.items, nil
+			ok = !o.closed
+			o.mu.Unlock()
+			signal(o.room)
+			return
+		}
+		o.mu.Unlock()
+
+		<-o.ready
+	}
+}
+
+// close lets take return what's left, later pushes fail.
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return
+	}
+	o.closed = true
+	signal(o.ready)
+	signal(o.room)
+}
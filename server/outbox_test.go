@@ -0,0 +1,129 @@
+package server
+
+import (
+	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
+	"net"
+	"testing"
+)
+
+func noticeOf(text string) protocol.Command {
+	return &protocol.NoticeCommand{BaseCommand: serverBase(), Kind: "TEST", Text: text}
+}
+
+func TestOutboxOverflow(t *testing.T) {
+	cases := []struct {
+		policy          OverflowPolicy
+		expectedErr     error
+		expectedTexts   []string
+		expectedDropped uint64
+	}{
+		{OverflowDropOldest, nil, []string{"2", "3"}, 1},
+		{OverflowDropNewest, nil, []string{"1", "2"}, 1},
+		// the command that didn't fit counts as dropped too
+		{OverflowDisconnect, SlowConsumerErr, []string{"1", "2"}, 1},
+	}
+
+	for i, c := range cases {
+		s := NewTcpChatServer()
+		conn, peer := net.Pipe()
+		o := newOutbox(2, c.policy)
+		cc := &clientConn{conn: conn, outbox: o, totalDropped: &s.dropped}
+
+		var err error
+		for _, text := range []string{"1", "2", "3"} {
+			if err = cc.Write(noticeOf(text)); err != nil {
+				break
+			}
+		}
+		_ = peer.Close()
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+
+		cmds, ok := o.take()
+		if !ok {
+			t.Errorf("case %d: outbox should be open", i)
+		}
+
+		var texts []string
+		for _, cmd := range cmds {
+			texts = append(texts, cmd.(*protocol.NoticeCommand).Text)
+		}
+		if len(texts) != len(c.expectedTexts) || texts[0] != c.expectedTexts[0] || texts[1] != c.expectedTexts[1] {
+			t.Errorf("case %d: should have texts:%v got:%v",
+				i, c.expectedTexts, texts)
+		}
+
+		if s.DroppedMessages() != c.expectedDropped {
+			t.Errorf("case %d: should have dropped:%d got:%d",
+				i, c.expectedDropped, s.DroppedMessages())
+		}
+		if cc.Dropped() != c.expectedDropped {
+			t.Errorf("case %d: should have dropped:%d from cc got:%d",
+				i, c.expectedDropped, cc.Dropped())
+		}
+	}
+}
+
+func TestOutboxClose(t *testing.T) {
+	o := newOutbox(2, OverflowDisconnect)
+
+	_, _ = o.push(noticeOf("1"))
+	o.close()
+
+	cmds, ok := o.take()
+	if ok || len(cmds) != 1 {
+		t.Errorf("should take the last command of a closed outbox, got:%v ok:%v", cmds, ok)
+	}
+
+	if _, err := o.push(noticeOf("2")); err != ConnClosedErr {
+		t.Errorf("should have err:%v got:%v", ConnClosedErr, err)
+	}
+}
+
+func TestOutboxPushWait(t *testing.T) {
+	o := newOutbox(1, OverflowDisconnect)
+	_ = o.pushWait(noticeOf("1"), nil)
+
+	pushed := make(chan error, 1)
+	go func() {
+		pushed <- o.pushWait(noticeOf("2"), nil)
+	}()
+	if cmds, _ := o.take(); len(cmds) != 1 {
+		t.Errorf("should take 1 command got:%v", cmds)
+	}
+	if err := <-pushed; err != nil {
+		t.Errorf("should have pushed once there was room got err:%v", err)
+	}
+
+	quit := make(chan struct{})
+	close(quit)
+	if err := o.pushWait(noticeOf("3"), quit); err != ConnClosedErr {
+		t.Errorf("should have err:%v got:%v", ConnClosedErr, err)
+	}
+}
+
+func TestDroppedPerConn(t *testing.T) {
+	s := NewTcpChatServer()
+	slow, fast := &clientConn{}, &clientConn{}
+	for _, cc := range []*clientConn{slow, fast} {
+		conn, peer := net.Pipe()
+		defer peer.Close()
+		cc.conn = conn
+		cc.outbox = newOutbox(1, OverflowDropNewest)
+		cc.totalDropped = &s.dropped
+	}
+
+	for _, text := range []string{"1", "2", "3"} {
+		_ = slow.Write(noticeOf(text))
+	}
+	_ = fast.Write(noticeOf("1"))
+
+	if slow.Dropped() != 2 || fast.Dropped() != 0 {
+		t.Errorf("should have dropped 2 from slow and 0 from fast got:%d, %d", slow.Dropped(), fast.Dropped())
+	}
+	if s.DroppedMessages() != 2 {
+		t.Errorf("should have dropped 2 in total got:%d", s.DroppedMessages())
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
+	"sync"
+	"time"
+)
+
+// status is the presence of a user, since is when it was set, the last
+// seen time of an offline user.
+type status struct {
+	state   string
+	message string
+	since   time.Time
+}
+
+// presence keeps the state every user is in and who subscribed to whom.
+// The server holds mu from changing a state until the PRESENCE for it is
+// queued, so watchers get the changes of a user in order.
+//
+// lock order is presence.mu, then registry.mu.
+type presence struct {
+	statuses map[string]*status
+	// subscribers are indexed by the user they watch, subscriptions by the
+	// subscriber.
+	subscribers   map[string]map[string]struct{}
+	subscriptions map[string]map[string]struct{}
+	mu            *sync.Mutex
+}
+
+func newPresence() *presence {
+	return &presence{
+		statuses:      make(map[string]*status),
+		subscribers:   make(map[string]map[string]struct{}),
+		subscriptions: make(map[string]map[string]struct{}),
+		mu:            &sync.Mutex{},
+	}
+}
+
+// get returns the status of user, who's offline since forever if never
+// seen. p.mu must be held.
+func (p *presence) get(user string) status {
+	if st, ok := p.statuses[user]; ok {
+		return *st
+	}
+	return status{state: protocol.PresenceOffline}
+}
+
+// lookup returns the status of user like get does, seen is false if they
+// never logged in since the server started. p.mu must not be held.
+func (p *presence) lookup(user string) (st status, seen bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, seen = p.statuses[user]
+	return p.get(user), seen
+}
+
+// seen reports whether user logged in since the server started. p.mu must
+// not be held.
+func (p *presence) seen(user string) bool {
+	_, seen := p.lookup(user)
+	return seen
+}
+
+// connected brings user online or takes them offline as their sessions come
+// and go, changed is false if they already were. p.mu must be held.
+func (p *presence) connected(user string, online bool, now time.Time) (st status, changed bool) {
+	st = p.get(user)
+	if (st.state != protocol.PresenceOffline) == online {
+		return st, false
+	}
+
+	st = status{state: protocol.PresenceOffline, since: now}
+	if online {
+		st.state = protocol.PresenceOnline
+	}
+	p.statuses[user] = &st
+	return st, true
+}
+
+// set changes the state and message of an online user, changed is false if
+// both stay the same. p.mu must be held.
+func (p *presence) set(user, state, message string, now time.Time) (st status, changed bool) {
+	st = p.get(user)
+	if st.state == state && st.message == message {
+		return st, false
+	}
+
+	st = status{state: state, message: message, since: now}
+	p.statuses[user] = &st
+	return st, true
+}
+
+// subscribe makes subscriber watch user, p.mu must be held.
+func (p *presence) subscribe(subscriber, user string) {
+	addTo(p.subscribers, user, subscriber)
+	addTo(p.subscriptions, subscriber, user)
+}
+
+// unsubscribe stops subscriber from watching user, p.mu must be held.
+func (p *presence) unsubscribe(subscriber, user string) {
+	removeFrom(p.subscribers, user, subscriber)
+	removeFrom(p.subscriptions, subscriber, user)
+}
+
+func addTo(index map[string]map[string]struct{}, key, name string) {
+	set, ok := index[key]
+	if !ok {
+		set = make(map[string]struct{})
+		index[key] = set
+	}
+	set[name] = struct{}{}
+}
+
+func removeFrom(index map[string]map[string]struct{}, key, name string) {
+	if set, ok := index[key]; ok {
+		delete(set, name)
+		if len(set) == 0 {
+			delete(index, key)
+		}
+	}
+}
+
+// presenceOf is the PRESENCE telling st of user.
+func presenceOf(user string, st status) *protocol.PresenceCommand {
+	var since int64
+	if !st.since.IsZero() {
+		since = millis(st.since)
+	}
+
+	return &protocol.PresenceCommand{
+		BaseCommand: serverBase(),
+		User:        user,
+		State:       st.state,
+		Since:       since,
+		Message:     st.message,
+	}
+}
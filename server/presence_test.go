@@ -0,0 +1,69 @@
+package server
+
+import (
+	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	now := time.Now()
+	p := newPresence()
+
+	cases := []struct {
+		online          bool
+		state           string
+		message         string
+		expectedState   string
+		expectedMessage string
+		expectedChanged bool
+	}{
+		{false, "", "", protocol.PresenceOffline, "", false},
+		{true, "", "", protocol.PresenceOnline, "", true},
+		// a second session changes nothing
+		{true, "", "", protocol.PresenceOnline, "", false},
+		{true, protocol.PresenceBusy, "in a meeting", protocol.PresenceBusy, "in a meeting", true},
+		{true, protocol.PresenceBusy, "in a meeting", protocol.PresenceBusy, "in a meeting", false},
+		{true, protocol.PresenceBusy, "", protocol.PresenceBusy, "", true},
+		{false, "", "", protocol.PresenceOffline, "", true},
+		// coming back clears the state set before
+		{true, "", "", protocol.PresenceOnline, "", true},
+	}
+
+	for i, c := range cases {
+		at := now.Add(time.Duration(i) * time.Second)
+
+		var st status
+		var changed bool
+		if c.state != "" {
+			st, changed = p.set("xixi", c.state, c.message, at)
+		} else {
+			st, changed = p.connected("xixi", c.online, at)
+		}
+
+		if st.state != c.expectedState || st.message != c.expectedMessage || changed != c.expectedChanged {
+			t.Errorf("case %d: should have %s:%q changed:%v got:%s:%q changed:%v",
+				i, c.expectedState, c.expectedMessage, c.expectedChanged, st.state, st.message, changed)
+		}
+		if changed && !st.since.Equal(at) {
+			t.Errorf("case %d: should have changed at %v got:%v", i, at, st.since)
+		}
+	}
+
+	if st, seen := p.lookup("xixi"); !seen || st.state != protocol.PresenceOnline {
+		t.Errorf("should have seen xixi online got:%s seen:%v", st.state, seen)
+	}
+	if p.seen("nobody") {
+		t.Errorf("should not have seen nobody")
+	}
+
+	p.subscribe("zhenghe", "xixi")
+	p.subscribe("haha", "xixi")
+	p.unsubscribe("zhenghe", "xixi")
+	if _, ok := p.subscribers["xixi"]["haha"]; !ok || len(p.subscribers["xixi"]) != 1 {
+		t.Errorf("should have haha subscribed to xixi got:%v", p.subscribers["xixi"])
+	}
+	if _, ok := p.subscriptions["zhenghe"]; ok {
+		t.Errorf("should have no subscriptions of zhenghe got:%v", p.subscriptions["zhenghe"])
+	}
+}
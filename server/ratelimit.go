@@ -0,0 +1,228 @@
+package server
+
+import (
+	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRateLimitStrikes  = 10
+	defaultRateLimitCooldown = time.Minute
+)
+
+// RateLimit lets Burst actions through at once, then Rate a second. A Rate
+// of 0 means no limit, a Burst below 1 is taken for 1.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// messageCmds, groupCmds and loginCmds are rate limited together, the rest
+// aren't.
+var (
+	messageCmds = map[string]bool{
+		protocol.CmdSend:      true,
+		protocol.CmdBroadCast: true,
+	}
+	groupCmds = map[string]bool{
+		protocol.CmdGroup:       true,
+		protocol.CmdChannel:     true,
+		protocol.CmdInvite:      true,
+		protocol.CmdJoin:        true,
+		protocol.CmdAccept:      true,
+		protocol.CmdDecline:     true,
+		protocol.CmdLeave:       true,
+		protocol.CmdKick:        true,
+		protocol.CmdPromote:     true,
+		protocol.CmdTopic:       true,
+		protocol.CmdDescription: true,
+	}
+	loginCmds = map[string]bool{
+		protocol.CmdLogin:  true,
+		protocol.CmdResume: true,
+	}
+)
+
+// bucket holds the tokens left at last.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter keeps a token bucket for each key.
+type limiter struct {
+	limit   RateLimit
+	buckets map[string]*bucket
+	mu      *sync.Mutex
+}
+
+func newLimiter(limit RateLimit) *limiter {
+	// no token would ever be there to take
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &limiter{
+		limit:   limit,
+		buckets: make(map[string]*bucket),
+		mu:      &sync.Mutex{},
+	}
+}
+
+// allow takes a token from the bucket of key, it returns false if there's
+// none left.
+func (l *limiter) allow(key string, now time.Time) bool {
+	if l.limit.Rate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.refill(l.limit, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// expire drops the buckets that filled up again, they're as good as new.
+func (l *limiter) expire(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		b.refill(l.limit, now)
+		if b.tokens >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (b *bucket) refill(limit RateLimit, now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+		b.last = now
+	}
+	if b.tokens > float64(limit.Burst) {
+		b.tokens = float64(limit.Burst)
+	}
+}
+
+// offender is an IP that hit a rate limit or failed to log in strikes
+// times, each within cooldown of the one before.
+type offender struct {
+	strikes int
+	last    time.Time
+	blocked time.Time
+}
+
+// rateLimits limits the commands of each user and IP and the connections of
+// each IP, and keeps out for a while the IPs that keep hitting the limits.
+type rateLimits struct {
+	messages *limiter
+	groups   *limiter
+	logins   *limiter
+	conns    *limiter
+	strikes  int
+	cooldown time.Duration
+
+	offenders map[string]*offender
+	mu        *sync.Mutex
+}
+
+func newRateLimits(messages, groups, logins, conns RateLimit, strikes int, cooldown time.Duration) *rateLimits {
+	return &rateLimits{
+		messages:  newLimiter(messages),
+		groups:    newLimiter(groups),
+		logins:    newLimiter(logins),
+		conns:     newLimiter(conns),
+		strikes:   strikes,
+		cooldown:  cooldown,
+		offenders: make(map[string]*offender),
+		mu:        &sync.Mutex{},
+	}
+}
+
+// command checks that neither user, if known, nor host went over the limit
+// of cmdName. For LOGIN user is the one logging in.
+func (r *rateLimits) command(user, host, cmdName string, now time.Time) bool {
+	var l *limiter
+	switch {
+	case messageCmds[cmdName]:
+		l = r.messages
+	case groupCmds[cmdName]:
+		l = r.groups
+	case loginCmds[cmdName]:
+		l = r.logins
+	default:
+		return true
+	}
+
+	if user != "" && !l.allow("user:"+user, now) {
+		return false
+	}
+	return l.allow("ip:"+host, now)
+}
+
+// connect checks that host isn't kept out and didn't go over the connection
+// limit.
+func (r *rateLimits) connect(host string, now time.Time) bool {
+	r.mu.Lock()
+	o, ok := r.offenders[host]
+	blocked := ok && now.Before(o.blocked)
+	r.mu.Unlock()
+
+	return !blocked && r.conns.allow("ip:"+host, now)
+}
+
+// strike records that host hit a limit or failed to log in. Once it did so
+// strikes times in a row, it's kept out until the returned time. A zero
+// time means it's let off.
+func (r *rateLimits) strike(host string, now time.Time) time.Time {
+	if r.strikes <= 0 {
+		return time.Time{}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o, ok := r.offenders[host]
+	if !ok || now.Sub(o.last) > r.cooldown {
+		o = &offender{}
+		r.offenders[host] = o
+	}
+	o.strikes++
+	o.last = now
+	if o.strikes < r.strikes {
+		return time.Time{}
+	}
+
+	o.strikes = 0
+	o.blocked = now.Add(r.cooldown)
+	return o.blocked
+}
+
+// expire forgets the buckets that filled up and the offenders that behaved
+// for a cooldown.
+func (r *rateLimits) expire(now time.Time) {
+	r.messages.expire(now)
+	r.groups.expire(now)
+	r.logins.expire(now)
+	r.conns.expire(now)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for host, o := range r.offenders {
+		if now.Sub(o.last) > r.cooldown && !now.Before(o.blocked) {
+			delete(r.offenders, host)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := newLimiter(RateLimit{Rate: 2, Burst: 3})
+
+	cases := []struct {
+		key      string
+		at       time.Duration
+		expected bool
+	}{
+		{"xixi", 0, true},
+		{"xixi", 0, true},
+		{"xixi", 0, true},
+		{"xixi", 0, false},
+		{"haha", 0, true},
+		{"xixi", 400 * time.Millisecond, false},
+		{"xixi", 500 * time.Millisecond, true},
+		{"xixi", 500 * time.Millisecond, false},
+		{"xixi", time.Hour, true},
+	}
+
+	for i, c := range cases {
+		if ok := l.allow(c.key, now.Add(c.at)); ok != c.expected {
+			t.Errorf("case %d: should have allowed:%v got:%v", i, c.expected, ok)
+		}
+	}
+
+	l.expire(now.Add(time.Hour))
+	if len(l.buckets) != 1 {
+		t.Errorf("should have kept the bucket of xixi got:%v", l.buckets)
+	}
+	l.expire(now.Add(2 * time.Hour))
+	if len(l.buckets) != 0 {
+		t.Errorf("should have dropped every bucket got:%v", l.buckets)
+	}
+
+	if !newLimiter(RateLimit{}).allow("xixi", now) {
+		t.Errorf("should allow everything without a rate")
+	}
+
+	// a burst of 0 would let nothing through
+	l = newLimiter(RateLimit{Rate: 1})
+	if !l.allow("xixi", now) || l.allow("xixi", now) || !l.allow("xixi", now.Add(time.Second)) {
+		t.Errorf("should allow one at a time without a burst")
+	}
+}
+
+func TestRateLimitStrikes(t *testing.T) {
+	now := time.Now()
+	r := newRateLimits(RateLimit{}, RateLimit{}, RateLimit{}, RateLimit{}, 3, time.Minute)
+
+	cases := []struct {
+		at              time.Duration
+		expectedBlocked bool
+	}{
+		{0, false},
+		{time.Second, false},
+		// too long after the one before, counting starts over
+		{2 * time.Minute, false},
+		{2*time.Minute + time.Second, false},
+		{2*time.Minute + 2*time.Second, true},
+	}
+
+	for i, c := range cases {
+		if until := r.strike("10.0.0.7", now.Add(c.at)); until.IsZero() == c.expectedBlocked {
+			t.Errorf("case %d: should have blocked:%v got until:%v", i, c.expectedBlocked, until)
+		}
+	}
+
+	blocked := now.Add(2*time.Minute + 2*time.Second)
+	if r.connect("10.0.0.7", blocked.Add(time.Second)) {
+		t.Errorf("should keep 10.0.0.7 out")
+	}
+	if !r.connect("10.0.0.8", blocked) {
+		t.Errorf("should let 10.0.0.8 in")
+	}
+	if !r.connect("10.0.0.7", blocked.Add(time.Minute)) {
+		t.Errorf("should let 10.0.0.7 in after the cooldown")
+	}
+
+	r.expire(blocked.Add(2 * time.Minute))
+	if len(r.offenders) != 0 {
+		t.Errorf("should have forgotten every offender got:%v", r.offenders)
+	}
+}
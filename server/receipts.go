@@ -0,0 +1,103 @@
+package server
+
+import (
+	"sync"
+)
+
+// defaultReceiptsSize is how many of the latest messages receipts are
+// tracked for.
+const defaultReceiptsSize = 10000
+
+type receipt struct {
+	from       string
+	recipients map[string]struct{}
+	delivered  map[string]struct{}
+	read       map[string]struct{}
+}
+
+// receipts tracks which recipients got and read each of the last size
+// messages, older messages are forgotten.
+type receipts struct {
+	messages map[uint64]*receipt
+	order    []uint64
+	size     int
+	mu       *sync.Mutex
+}
+
+func newReceipts(size int) *receipts {
+	return &receipts{
+		messages: make(map[uint64]*receipt),
+		size:     size,
+		mu:       &sync.Mutex{},
+	}
+}
+
+// track starts tracking message id sent by from to recipients.
+func (r *receipts) track(id uint64, from string, recipients []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.order) >= r.size {
+		delete(r.messages, r.order[0])
+		r.order = r.order[1:]
+	}
+
+	rc := &receipt{
+		from:       from,
+		recipients: make(map[string]struct{}, len(recipients)),
+		delivered:  make(map[string]struct{}),
+		read:       make(map[string]struct{}),
+	}
+	for _, recipient := range recipients {
+		rc.recipients[recipient] = struct{}{}
+	}
+	r.messages[id] = rc
+	r.order = append(r.order, id)
+}
+
+// forget stops tracking a message that was never delivered.
+func (r *receipts) forget(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.messages, id)
+}
+
+// delivered records that message id reached user, first is false if it's
+// not tracked, user isn't a recipient or got it before.
+func (r *receipts) delivered(id uint64, user string) (from string, count, total int, first bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rc, ok := r.messages[id]
+	if !ok {
+		return
+	}
+	if _, ok := rc.recipients[user]; !ok {
+		return
+	}
+
+	_, seen := rc.delivered[user]
+	rc.delivered[user] = struct{}{}
+	return rc.from, len(rc.delivered), len(rc.recipients), !seen
+}
+
+// read records that user read message id, first is false if user read it
+// before.
+func (r *receipts) read(id uint64, user string) (from string, count, total int, first bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rc, ok := r.messages[id]
+	if !ok {
+		return "", 0, 0, false, UnknownMessageErr
+	}
+	if _, ok := rc.recipients[user]; !ok {
+		return "", 0, 0, false, NotMemberErr
+	}
+
+	_, seen := rc.read[user]
+	rc.read[user] = struct{}{}
+	rc.delivered[user] = struct{}{}
+	return rc.from, len(rc.read), len(rc.recipients), !seen, nil
+}
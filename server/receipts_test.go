@@ -0,0 +1,61 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestReceipts(t *testing.T) {
+	r := newReceipts(2)
+	r.track(1, "zhenghe", []string{"xixi", "haha"})
+	r.track(2, "zhenghe", []string{"xixi"})
+
+	cases := []struct {
+		read          bool
+		id            uint64
+		user          string
+		expectedCount int
+		expectedTotal int
+		expectedFirst bool
+		expectedErr   error
+	}{
+		{false, 1, "xixi", 1, 2, true, nil},
+		{false, 1, "xixi", 1, 2, false, nil},
+		{true, 1, "haha", 1, 2, true, nil},
+		{false, 1, "haha", 2, 2, false, nil},
+		{true, 1, "xixi", 2, 2, true, nil},
+		{true, 1, "xixi", 2, 2, false, nil},
+		{true, 1, "zhenghe", 0, 0, false, NotMemberErr},
+		{false, 2, "haha", 0, 0, false, nil},
+		{true, 3, "xixi", 0, 0, false, UnknownMessageErr},
+	}
+
+	for i, c := range cases {
+		var from string
+		var count, total int
+		var first bool
+		var err error
+		if c.read {
+			from, count, total, first, err = r.read(c.id, c.user)
+		} else {
+			from, count, total, first = r.delivered(c.id, c.user)
+		}
+
+		if err != c.expectedErr {
+			t.Errorf("case %d: should have err:%v got:%v",
+				i, c.expectedErr, err)
+		}
+		if count != c.expectedCount || total != c.expectedTotal || first != c.expectedFirst {
+			t.Errorf("case %d: should have %d/%d first:%v got:%d/%d first:%v",
+				i, c.expectedCount, c.expectedTotal, c.expectedFirst, count, total, first)
+		}
+		if c.expectedCount > 0 && from != "zhenghe" {
+			t.Errorf("case %d: should be from zhenghe got:%s", i, from)
+		}
+	}
+
+	// a third message pushes out the first
+	r.track(3, "xixi", []string{"zhenghe"})
+	if _, _, _, _, err := r.read(1, "xixi"); err != UnknownMessageErr {
+		t.Errorf("should have forgotten message 1 got err:%v", err)
+	}
+}
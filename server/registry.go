@@ -0,0 +1,447 @@
+package server
+
+import (
+	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// registry is the shared state of the server: the connected clients, the
+// sessions of each user, the sessions waiting for RESUME and the messages
+// queued for users who are offline.
+// Every method holds mu for the whole check and update, so callers never
+// see a half done login and a message is either delivered or queued.
+//
+// lock order is registry.mu, then clientConn.mu.
+type registry struct {
+	conns map[*clientConn]struct{}
+	users map[string]map[*clientConn]struct{}
+	// sessions are indexed by token, detached by user while they have no
+	// connection. grace is how long they wait for RESUME, 0 if they don't.
+	sessions map[string]*session
+	detached map[string]map[*session]struct{}
+	grace    time.Duration
+	// changed are the users who came online or went offline since
+	// takeChanged was last called.
+	changed map[string]struct{}
+	// offline is nil when messages to offline users aren't kept.
+	offline *offlineQueue
+	mu      *sync.RWMutex
+}
+
+func newRegistry(offline *offlineQueue, grace time.Duration) *registry {
+	return &registry{
+		conns:    make(map[*clientConn]struct{}),
+		users:    make(map[string]map[*clientConn]struct{}),
+		sessions: make(map[string]*session),
+		detached: make(map[string]map[*session]struct{}),
+		grace:    grace,
+		changed:  make(map[string]struct{}),
+		offline:  offline,
+		mu:       &sync.RWMutex{},
+	}
+}
+
+func (r *registry) add(cc *clientConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.conns[cc] = struct{}{}
+}
+
+// remove forgets cc, the session it holds waits for RESUME until the grace
+// period is over.
+func (r *registry) remove(cc *clientConn, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.conns, cc)
+	if s := cc.session; s != nil {
+		cc.session = nil
+		s.cc = nil
+		s.expires = now.Add(r.grace)
+
+		detached, ok := r.detached[s.user]
+		if !ok {
+			detached = make(map[*session]struct{})
+			r.detached[s.user] = detached
+		}
+		detached[s] = struct{}{}
+	}
+	r.unbind(cc)
+}
+
+// all returns every connected client.
+func (r *registry) all() []*clientConn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	conns := make([]*clientConn, 0, len(r.conns))
+	for cc := range r.conns {
+		conns = append(conns, cc)
+	}
+	return conns
+}
+
+// login names cc after user as policy allows, kicked are the older sessions
+// of user the caller has to tell and stop. token resumes the new session,
+// it's empty if sessions can't be resumed. Messages to user keep being
+// queued until flush is called for cc.
+func (r *registry) login(cc *clientConn, user string, policy LoginPolicy) (token string, kicked []*clientConn, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if kicked, err = r.others(cc, user, nil, policy); err != nil {
+		return
+	}
+
+	var s *session
+	if r.grace > 0 {
+		if s, err = newSession(user); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if policy != LoginPolicyMultiDevice {
+		// a new login supersedes the sessions waiting for RESUME
+		for ds := range r.detached[user] {
+			r.drop(ds)
+		}
+	}
+	for _, scc := range kicked {
+		r.end(scc)
+		r.unbind(scc)
+	}
+	r.end(cc)
+	r.bind(cc, user)
+	cc.flushing = r.offline != nil
+	if s != nil {
+		r.attach(s, cc)
+		token = s.token
+	}
+	return
+}
+
+// resume moves the session of token to cc, which hasn't logged in, as
+// policy allows. replaced is the connection the session had if the server
+// didn't notice it was gone yet, kicked are the other sessions of the user
+// policy throws out, the caller has to stop both. Messages after the one
+// with id lastID are written again once flush is called for cc.
+func (r *registry) resume(cc *clientConn, token string, lastID uint64, policy LoginPolicy, now time.Time) (user string, replaced *clientConn, kicked []*clientConn, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sessions[token]
+	if !ok || s.expired(now) {
+		return "", nil, nil, InvalidSessionErr
+	}
+	if cc.Name() != "" {
+		return "", nil, nil, AlreadyLoggedInErr
+	}
+	if kicked, err = r.others(cc, s.user, s.cc, policy); err != nil {
+		return "", nil, nil, err
+	}
+
+	if policy == LoginPolicyKickOld {
+		for ds := range r.detached[s.user] {
+			if ds != s {
+				r.drop(ds)
+			}
+		}
+	}
+	for _, scc := range kicked {
+		r.end(scc)
+		r.unbind(scc)
+	}
+	if replaced = s.cc; replaced != nil {
+		replaced.session = nil
+		r.unbind(replaced)
+	}
+	r.undetach(s)
+
+	r.bind(cc, s.user)
+	r.attach(s, cc)
+	s.resume(lastID)
+	cc.flushing = true
+	return s.user, replaced, kicked, nil
+}
+
+// sessionUser returns the user of the session of token, empty if there's
+// none.
+func (r *registry) sessionUser(token string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if s, ok := r.sessions[token]; ok {
+		return s.user
+	}
+	return ""
+}
+
+// others checks the sessions of user other than cc and own against policy,
+// returning the ones to kick, r.mu must be held.
+func (r *registry) others(cc *clientConn, user string, own *clientConn, policy LoginPolicy) (kicked []*clientConn, err error) {
+	for scc := range r.users[user] {
+		if scc == cc || scc == own {
+			continue
+		}
+
+		switch policy {
+		case LoginPolicyReject:
+			return nil, AlreadyLoggedInErr
+		case LoginPolicyKickOld:
+			kicked = append(kicked, scc)
+		}
+	}
+	return
+}
+
+// logout ends the session of cc, it can't be resumed anymore.
+func (r *registry) logout(cc *clientConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.end(cc)
+}
+
+// expire drops the sessions that waited for RESUME in vain, what they held
+// reached other sessions of their user already.
+func (r *registry) expire(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range r.sessions {
+		if s.expired(now) {
+			r.drop(s)
+		}
+	}
+}
+
+// attach indexes s as the session of cc, r.mu must be held.
+func (r *registry) attach(s *session, cc *clientConn) {
+	s.cc = cc
+	cc.session = s
+	r.sessions[s.token] = s
+}
+
+// end forgets the session of cc, r.mu must be held.
+func (r *registry) end(cc *clientConn) {
+	if s := cc.session; s != nil {
+		cc.session = nil
+		delete(r.sessions, s.token)
+	}
+}
+
+// drop forgets a detached session, r.mu must be held.
+func (r *registry) drop(s *session) {
+	delete(r.sessions, s.token)
+	r.undetach(s)
+}
+
+// undetach drops s from the detached sessions of its user, r.mu must be
+// held.
+func (r *registry) undetach(s *session) {
+	if detached, ok := r.detached[s.user]; ok {
+		delete(detached, s)
+		if len(detached) == 0 {
+			delete(r.detached, s.user)
+		}
+	}
+}
+
+// flush writes to cc what was queued for its user while they were offline
+// and what its session missed, then lets messages reach cc directly. There
+// may be more of them than the outbound queue of cc takes, so they're
+// written as the client reads them, without r.mu held. What arrives in the
+// meantime is held as before and written next.
+func (r *registry) flush(cc *clientConn, now time.Time) {
+	name := cc.Name()
+	total := 0
+	defer func() {
+		if total > 0 {
+			log.Printf("user:%s got %d missed messages", name, total)
+		}
+	}()
+
+	for {
+		r.mu.Lock()
+		if !cc.flushing {
+			r.mu.Unlock()
+			return
+		}
+
+		var cmds []protocol.Command
+		if r.offline != nil && name != "" {
+			cmds = r.offline.take(name, now)
+		}
+		s := cc.session
+		if s != nil {
+			cmds = s.replay(cmds)
+		}
+		if len(cmds) == 0 || name == "" {
+			cc.flushing = false
+			r.mu.Unlock()
+			return
+		}
+		r.mu.Unlock()
+
+		for _, cmd := range cmds {
+			if err := cc.outbox.pushWait(cmd, cc.quit); err != nil {
+				log.Printf("flush to %s err:%v", cc.conn.RemoteAddr().String(), err)
+				r.mu.Lock()
+				cc.flushing = false
+				r.mu.Unlock()
+				return
+			}
+			if s != nil {
+				s.remember(cmd)
+			}
+		}
+		total += len(cmds)
+	}
+}
+
+// send writes cmd to cc, which its session remembers in case the connection
+// is lost, r.mu must be held at least for reading.
+func (r *registry) send(cc *clientConn, cmd protocol.Command) error {
+	if err := cc.Write(cmd); err != nil {
+		return err
+	}
+	if cc.session != nil {
+		cc.session.remember(cmd)
+	}
+	return nil
+}
+
+// deliver writes cmd to every session of user but skip, and queues it while
+// user has no session ready for it. Sessions waiting for RESUME hold it
+// unless it's queued, the first session back then gets it. It returns
+// UnknownUserErr if user has no session and messages aren't queued.
+func (r *registry) deliver(user string, skip *clientConn, cmd protocol.Command, now time.Time) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	conns := r.users[user]
+	queue := len(conns) == 0
+	for cc := range conns {
+		if cc == skip {
+			continue
+		}
+		if cc.flushing {
+			if cc.session != nil {
+				cc.session.hold(cmd)
+			} else {
+				queue = true
+			}
+			continue
+		}
+
+		// a slow or leaving recipient is not the sender's fault
+		if err := r.send(cc, cmd); err != nil {
+			log.Printf("deliver to %s err:%v", cc.conn.RemoteAddr().String(), err)
+		}
+	}
+
+	if queue && r.offline != nil {
+		if r.offline.push(user, cmd, now) {
+			log.Printf("offline queue of user:%s is full, dropped the oldest message", user)
+		}
+		return nil
+	}
+
+	held := false
+	for s := range r.detached[user] {
+		if !s.expired(now) {
+			s.hold(cmd)
+			held = true
+		}
+	}
+	if len(conns) == 0 && !held {
+		return UnknownUserErr
+	}
+	return nil
+}
+
+// bind names cc after user and indexes it, r.mu must be held.
+func (r *registry) bind(cc *clientConn, user string) {
+	r.unbind(cc)
+
+	conns, ok := r.users[user]
+	if !ok {
+		conns = make(map[*clientConn]struct{})
+		r.users[user] = conns
+	}
+	conns[cc] = struct{}{}
+	if len(conns) == 1 {
+		r.changed[user] = struct{}{}
+	}
+	cc.setName(user)
+}
+
+// unbind drops cc from the index of its user, r.mu must be held.
+func (r *registry) unbind(cc *clientConn) {
+	name := cc.Name()
+	if name == "" {
+		return
+	}
+
+	if conns, ok := r.users[name]; ok {
+		delete(conns, cc)
+		if len(conns) == 0 {
+			delete(r.users, name)
+			r.changed[name] = struct{}{}
+		}
+	}
+	cc.setName("")
+}
+
+// takeChanged returns the users who came online or went offline lately,
+// some may have gone back since.
+func (r *registry) takeChanged() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.changed) == 0 {
+		return nil
+	}
+	users := sortedNames(r.changed)
+	r.changed = make(map[string]struct{})
+	return users
+}
+
+// online reports whether user has a session.
+func (r *registry) online(user string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.users[user]) > 0
+}
+
+// onlineUsers returns every user with a session in name order.
+func (r *registry) onlineUsers() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := make([]string, 0, len(r.users))
+	for user := range r.users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// connsOf returns every session of the given users.
+func (r *registry) connsOf(users ...string) []*clientConn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var conns []*clientConn
+	for _, user := range users {
+		for cc := range r.users[user] {
+			conns = append(conns, cc)
+		}
+	}
+	return conns
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+)
+
+// conversationLocks is the number of locks conversations are spread over.
+const conversationLocks = 64
+
+// sequencer is where every message gets its id and sequence number. Ids are
+// the microseconds since the epoch when the message was stamped, bumped to
+// stay increasing, so they're unique across restarts as long as the clock
+// doesn't go back. Sequence numbers count the messages of each conversation
+// from 1, picking up from the message store after a restart.
+type sequencer struct {
+	lastID uint64
+	seqs   map[conversation]uint64
+	store  MessageStore
+	mu     *sync.Mutex
+	// locks keep a conversation's messages delivered in sequence order.
+	locks [conversationLocks]sync.Mutex
+}
+
+func newSequencer(store MessageStore) *sequencer {
+	return &sequencer{
+		seqs:  make(map[conversation]uint64),
+		store: store,
+		mu:    &sync.Mutex{},
+	}
+}
+
+// lock holds conv from stamping a message until it's delivered, so the next
+// message of conv can't overtake it.
+func (q *sequencer) lock(conv conversation) (unlock func()) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(conv.group))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(conv.user1))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(conv.user2))
+
+	l := &q.locks[h.Sum32()%conversationLocks]
+	l.Lock()
+	return l.Unlock
+}
+
+// stamp sets the id and sequence number of msg, the conversation of msg
+// must be locked.
+func (q *sequencer) stamp(msg *Message) {
+	conv := msg.conversation()
+
+	q.mu.Lock()
+	seq, ok := q.seqs[conv]
+	q.mu.Unlock()
+	if !ok {
+		seq = q.lastSeq(msg)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	id := uint64(msg.Time.UnixNano() / int64(time.Microsecond))
+	if id <= q.lastID {
+		id = q.lastID + 1
+	}
+	q.lastID = id
+
+	msg.ID = id
+	msg.Seq = seq + 1
+	q.seqs[conv] = msg.Seq
+}
+
+// unstamp gives back the sequence number of a message that was never
+// delivered, the conversation of msg must still be locked.
+func (q *sequencer) unstamp(msg *Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seqs[msg.conversation()] = msg.Seq - 1
+}
+
+// lastSeq looks up the sequence number of the newest stored message of the
+// conversation of msg.
+func (q *sequencer) lastSeq(msg *Message) uint64 {
+	msgs, err := q.store.History(HistoryQuery{
+		Group: msg.Group,
+		User:  msg.From,
+		Peer:  msg.To,
+		Limit: 1,
+	})
+	if err != nil {
+		log.Printf("look up last seq err:%v", err)
+		return 0
+	}
+	if len(msgs) == 0 {
+		return 0
+	}
+	return msgs[0].Seq
+}
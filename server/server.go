@@ -1,8 +1,25 @@
 package server
 
-import "context"
+import (
+	"context"
+	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
+	"net"
+)
 
 type ChatServer interface {
 	Start(ctx context.Context, address string) error
 	Close(ctx context.Context) error
 }
+
+// Client is the connection a command arrived on, as seen by a Handler.
+type Client interface {
+	Name() string
+	Version() string
+	RemoteAddr() net.Addr
+	Write(cmd protocol.Command) error
+}
+
+// Handler handles one command from c. A nil reply and err makes the server
+// answer OK, a non-nil err makes it answer ERROR, otherwise reply is written
+// as the answer.
+type Handler func(c Client, cmd protocol.Command) (reply protocol.Command, err error)
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSessionGrace is how long a session outlives its connection,
+	// waiting for RESUME.
+	defaultSessionGrace = 2 * time.Minute
+	// sessionReplaySize bounds both the messages a session keeps to send
+	// again and the ones it holds while detached.
+	sessionReplaySize = 256
+)
+
+// session is a login that can be taken over by RESUME on a new connection.
+// While attached it remembers the last messages written to its connection,
+// which may have been lost with it. While detached it holds the messages
+// that reached other sessions of its user but not this one.
+type session struct {
+	token string
+	user  string
+
+	// cc and expires are guarded by registry.mu, cc is nil while detached.
+	cc      *clientConn
+	expires time.Time
+
+	// mu guards the messages below, deliveries add to them holding only
+	// the read lock of the registry.
+	recent  []protocol.Command
+	pending []protocol.Command
+	// resuming is set by RESUME until the session is flushed, resumeFrom is
+	// the id of the last message the client got.
+	resuming   bool
+	resumeFrom uint64
+	mu         *sync.Mutex
+}
+
+func newSession(user string) (*session, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{
+		token: token,
+		user:  user,
+		mu:    &sync.Mutex{},
+	}, nil
+}
+
+// newToken returns 128 random bits in hex.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *session) expired(now time.Time) bool {
+	return s.cc == nil && !now.Before(s.expires)
+}
+
+// remember keeps cmd as written to the connection of s.
+func (s *session) remember(cmd protocol.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.recent = bounded(s.recent, cmd)
+}
+
+// resume makes the next replay send again what came after message lastID.
+func (s *session) resume(lastID uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.resuming, s.resumeFrom = true, lastID
+}
+
+// hold keeps cmd until s is flushed.
+func (s *session) hold(cmd protocol.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.pending) >= sessionReplaySize {
+		log.Printf("session of user:%s holds too many messages, dropped the oldest", s.user)
+	}
+	s.pending = bounded(s.pending, cmd)
+}
+
+// replay merges what the client of s missed with queued, the messages taken
+// from the offline queue, in id order without duplicates.
+func (s *session) replay(queued []protocol.Command) []protocol.Command {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var cmds []protocol.Command
+	if s.resuming {
+		for _, cmd := range s.recent {
+			if messageID(cmd) > s.resumeFrom {
+				cmds = append(cmds, cmd)
+			}
+		}
+	}
+	cmds = append(cmds, s.pending...)
+	cmds = append(cmds, queued...)
+
+	s.recent, s.pending = nil, nil
+	s.resuming, s.resumeFrom = false, 0
+
+	sort.SliceStable(cmds, func(i, j int) bool {
+		return messageID(cmds[i]) < messageID(cmds[j])
+	})
+
+	var last uint64
+	uniq := cmds[:0]
+	for _, cmd := range cmds {
+		id := messageID(cmd)
+		if id != 0 && id == last {
+			continue
+		}
+		last = id
+		uniq = append(uniq, cmd)
+	}
+	return uniq
+}
+
+// bounded appends cmd to cmds, dropping the oldest beyond
+// sessionReplaySize.
+func bounded(cmds []protocol.Command, cmd protocol.Command) []protocol.Command {
+	if len(cmds) >= sessionReplaySize {
+		cmds[0] = nil
+		cmds = cmds[1:]
+	}
+	return append(cmds, cmd)
+}
+
+// messageID is the id of the message cmd delivers, 0 if it's not a RECEIVE.
+func messageID(cmd protocol.Command) uint64 {
+	if receive, ok := cmd.(*protocol.ReceiveCommand); ok {
+		return receive.ID
+	}
+	return 0
+}
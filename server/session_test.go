@@ -0,0 +1,73 @@
+package server
+
+import (
+	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
+	"reflect"
+	"testing"
+)
+
+func receivesOf(ids ...uint64) []protocol.Command {
+	var cmds []protocol.Command
+	for _, id := range ids {
+		cmds = append(cmds, &protocol.ReceiveCommand{ID: id})
+	}
+	return cmds
+}
+
+func TestSessionReplay(t *testing.T) {
+	cases := []struct {
+		recent      []uint64
+		pending     []uint64
+		queued      []uint64
+		resume      bool
+		lastID      uint64
+		expectedIDs []uint64
+	}{
+		// a fresh login sends nothing again
+		{[]uint64{1, 2}, []uint64{3}, []uint64{4}, false, 0, []uint64{3, 4}},
+		{[]uint64{1, 2, 3}, nil, nil, true, 1, []uint64{2, 3}},
+		{[]uint64{1, 2, 3}, nil, nil, true, 0, []uint64{1, 2, 3}},
+		{[]uint64{1, 2}, nil, nil, true, 2, nil},
+		// held while detached and queued while offline, in id order
+		{[]uint64{1, 2}, []uint64{3, 6}, []uint64{4, 5}, true, 1, []uint64{2, 3, 4, 5, 6}},
+		{[]uint64{1, 2}, []uint64{2, 3}, []uint64{3}, true, 0, []uint64{1, 2, 3}},
+	}
+
+	for i, c := range cases {
+		s, err := newSession("xixi")
+		if err != nil {
+			t.Fatalf("case %d: new session err:%v", i, err)
+		}
+		for _, cmd := range receivesOf(c.recent...) {
+			s.remember(cmd)
+		}
+		for _, cmd := range receivesOf(c.pending...) {
+			s.hold(cmd)
+		}
+		if c.resume {
+			s.resume(c.lastID)
+		}
+
+		var ids []uint64
+		for _, cmd := range s.replay(receivesOf(c.queued...)) {
+			ids = append(ids, messageID(cmd))
+		}
+		if !reflect.DeepEqual(ids, c.expectedIDs) {
+			t.Errorf("case %d: should have ids:%v got:%v", i, c.expectedIDs, ids)
+		}
+		if ids := s.replay(nil); len(ids) != 0 {
+			t.Errorf("case %d: should have replayed everything got:%d more", i, len(ids))
+		}
+	}
+}
+
+func TestSessionTokens(t *testing.T) {
+	s1, err1 := newSession("xixi")
+	s2, err2 := newSession("xixi")
+	if err1 != nil || err2 != nil {
+		t.Fatalf("new session err:%v, %v", err1, err2)
+	}
+	if len(s1.token) != 32 || s1.token == s2.token {
+		t.Errorf("should have distinct 32 digit tokens got:%s, %s", s1.token, s2.token)
+	}
+}
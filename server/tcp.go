@@ -1,120 +1,1020 @@
 package server
 
 import (
+	"bufio"
 	"context"
 	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type clientConn struct {
-	conn   net.Conn
-	name   string
-	writer *protocol.CommandWriter
+	// lastRead is the unix nanoseconds of the last command read from cc,
+	// dropped counts the commands its full outbox discarded and pinged is 1
+	// once a PING was sent after lastRead. They're accessed atomically and
+	// kept first for 64-bit alignment.
+	lastRead int64
+	dropped  uint64
+	pinged   int32
+
+	conn    net.Conn
+	framing protocol.Framing
+	reader  protocol.Reader
+
+	// mu guards the session state below, which handlers of other clients
+	// read while serve of cc changes it.
+	name         string
+	version      string
+	capabilities map[string]struct{}
+	mu           *sync.RWMutex
+
+	// flushing and session are guarded by registry.mu. flushing is set from
+	// LOGIN or RESUME until the messages the user missed are written.
+	flushing bool
+	session  *session
+
+	writer  protocol.Writer
+	writeMu *sync.Mutex
+	outbox  *outbox
+	// totalDropped is the count of the whole server, dropped adds to it.
+	totalDropped *uint64
+	quit         chan struct{}
+	quitOnce     *sync.Once
+}
+
+func (cc *clientConn) hasCapability(capability string) bool {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	_, ok := cc.capabilities[capability]
+	return ok
+}
+
+func (cc *clientConn) Name() string {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	return cc.name
+}
+
+func (cc *clientConn) setName(name string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.name = name
+}
+
+func (cc *clientConn) Version() string {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	return cc.version
+}
+
+// setSession records what HELLO settled on.
+func (cc *clientConn) setSession(version string, capabilities map[string]struct{}) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.version = version
+	cc.capabilities = capabilities
 }
 
+func (cc *clientConn) RemoteAddr() net.Addr {
+	return cc.conn.RemoteAddr()
+}
+
+// Write queues cmd for the writeLoop of cc, it never blocks on the network.
+func (cc *clientConn) Write(cmd protocol.Command) error {
+	dropped, err := cc.outbox.push(cmd)
+	if dropped {
+		cc.drop()
+		log.Printf("outbound queue of %s is full, dropped a command", cc.conn.RemoteAddr().String())
+	}
+
+	if err == SlowConsumerErr {
+		cc.drop()
+		log.Printf("outbound queue of %s is full, disconnecting", cc.conn.RemoteAddr().String())
+		_ = cc.conn.Close()
+	}
+	return err
+}
+
+func (cc *clientConn) drop() {
+	atomic.AddUint64(&cc.dropped, 1)
+	atomic.AddUint64(cc.totalDropped, 1)
+}
+
+// Dropped counts the commands that were never written to cc because its
+// outbound queue was full.
+func (cc *clientConn) Dropped() uint64 {
+	return atomic.LoadUint64(&cc.dropped)
+}
+
+// stop makes serve finish with cc once the command at hand is handled, what's
+// already queued is still written before the connection is closed.
+func (cc *clientConn) stop() {
+	cc.quitOnce.Do(func() {
+		close(cc.quit)
+		_ = cc.conn.SetReadDeadline(time.Now())
+	})
+}
+
+// touch records that a command was just read from cc.
+func (cc *clientConn) touch(now time.Time) {
+	atomic.StoreInt64(&cc.lastRead, now.UnixNano())
+	atomic.StoreInt32(&cc.pinged, 0)
+}
+
+// idle returns how long nothing was read from cc.
+func (cc *clientConn) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&cc.lastRead)))
+}
+
+func (cc *clientConn) stopped() bool {
+	select {
+	case <-cc.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// LoginPolicy decides what happens when a user logs in while already having
+// a session on another connection.
+type LoginPolicy int
+
+const (
+	// LoginPolicyReject refuses the new login with ALREADY_LOGGED_IN.
+	LoginPolicyReject LoginPolicy = iota
+	// LoginPolicyKickOld sends a SESSION_REPLACED notice to the older
+	// sessions and disconnects them.
+	LoginPolicyKickOld
+	// LoginPolicyMultiDevice keeps every session, messages to the user are
+	// delivered to all of them.
+	LoginPolicyMultiDevice
+)
+
+// OversizePolicy decides what happens to a client that sends a message over
+// the max size.
+type OversizePolicy int
+
+const (
+	// OversizeReply skips the message and replies ERROR MESSAGE_TOO_LARGE.
+	OversizeReply OversizePolicy = iota
+	// OversizeDisconnect replies the same, then closes the connection.
+	OversizeDisconnect
+)
+
 type TcpChatServer struct {
+	// dropped is accessed atomically and kept first for 64-bit alignment.
+	dropped        uint64
 	listener       net.Listener
-	clientConnSet  map[*clientConn]interface{}
-	groupToMembers map[string][]string
-	mu             *sync.RWMutex
+	registry       *registry
+	groups         GroupStore
+	messages       MessageStore
+	sequencer      *sequencer
+	receipts       *receipts
+	presence       *presence
+	invitations    *invitations
+	moderation     *moderation
+	limits         *rateLimits
+	operators      map[string]struct{}
+	capabilities   []string
+	handlers       map[string]Handler
+	authenticator  Authenticator
+	loginPolicy    LoginPolicy
+	outboxSize     int
+	overflowPolicy OverflowPolicy
+	offlineSize    int
+	offlineTTL     time.Duration
+	sessionGrace   time.Duration
+	invitationTTL  time.Duration
+	moderationPath string
+	maxFrameSize   int
+	maxBodySize    int
+	oversizePolicy OversizePolicy
+	// the rate limits and how many times in a row an IP may hit them, or
+	// fail to log in, before it's disconnected and kept out for
+	// rateLimitCooldown.
+	messageLimit      RateLimit
+	groupLimit        RateLimit
+	loginLimit        RateLimit
+	connLimit         RateLimit
+	rateLimitStrikes  int
+	rateLimitCooldown time.Duration
+	// a client that sent nothing for heartbeatInterval gets a PING, one that
+	// sends nothing for another heartbeatTimeout is evicted. Clients too old
+	// for PINGs are evicted once they sent nothing for idleTimeout.
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	idleTimeout       time.Duration
+	// mu guards listener, handlers and the check for closing in accept.
+	mu        *sync.RWMutex
+	closing   chan struct{}
+	closeOnce *sync.Once
+	wg        *sync.WaitGroup
 }
 
-func NewTcpChatServer() *TcpChatServer {
-	return &TcpChatServer{
-		mu:             &sync.RWMutex{},
-		clientConnSet:  make(map[*clientConn]interface{}),
-		groupToMembers: make(map[string][]string),
+const (
+	// shutdownTimeout bounds the shutdown started by cancelling the context
+	// passed to Start.
+	shutdownTimeout = 5 * time.Second
+	// flushTimeout bounds writing what's queued to a client that's leaving.
+	flushTimeout             = 5 * time.Second
+	defaultHeartbeatInterval = 30 * time.Second
+	defaultHeartbeatTimeout  = 15 * time.Second
+	defaultIdleTimeout       = 10 * time.Minute
+	// minHeartbeatTick keeps the heartbeat ticker from spinning, or
+	// panicking, on tiny timeouts.
+	minHeartbeatTick = time.Millisecond
+	// sweepInterval is how often expired offline messages of users who never
+	// come back, sessions nobody resumed, invitations nobody took up,
+	// sanctions that ran out and rate limits nobody is near are thrown away.
+	sweepInterval = time.Minute
+)
+
+type Option func(s *TcpChatServer)
+
+// WithAuthenticator makes LOGIN verify passwords with a, without one any
+// username is accepted as is.
+func WithAuthenticator(a Authenticator) Option {
+	return func(s *TcpChatServer) {
+		s.authenticator = a
 	}
 }
 
-func (s *TcpChatServer) listen(ctx context.Context, address string) error {
-	l, err := net.Listen("tcp", address)
-	if err != nil {
-		return err
+// WithLoginPolicy sets how a second login of the same user is handled, the
+// default is LoginPolicyReject.
+func WithLoginPolicy(policy LoginPolicy) Option {
+	return func(s *TcpChatServer) {
+		s.loginPolicy = policy
 	}
+}
 
-	s.listener = l
+// WithOutboundQueue bounds the commands queued for each client to size and
+// sets what happens when a client falls that far behind, the default is 256
+// commands and OverflowDisconnect.
+func WithOutboundQueue(size int, policy OverflowPolicy) Option {
+	return func(s *TcpChatServer) {
+		s.outboxSize = size
+		s.overflowPolicy = policy
+	}
+}
 
-	log.Printf("Listening on %s", address)
+// WithOfflineQueue keeps up to size messages for each offline user, each
+// for ttl, and writes them once the user logs in. A size of 0 turns it off,
+// SEND to an offline user then fails with UNKNOWN_USER. The default is 100
+// messages for 7 days.
+func WithOfflineQueue(size int, ttl time.Duration) Option {
+	return func(s *TcpChatServer) {
+		s.offlineSize = size
+		s.offlineTTL = ttl
+	}
+}
 
-	return err
+// WithSessionResume keeps the session of a lost connection for grace, the
+// client may take it over with RESUME until then. A grace of 0 turns it off.
+// The default is 2 minutes.
+func WithSessionResume(grace time.Duration) Option {
+	return func(s *TcpChatServer) {
+		s.sessionGrace = grace
+	}
+}
+
+// WithOperators lets users moderate the whole server: mute and ban anyone
+// and DISCONNECT them.
+func WithOperators(users ...string) Option {
+	return func(s *TcpChatServer) {
+		for _, user := range users {
+			s.operators[user] = struct{}{}
+		}
+	}
+}
+
+// WithModerationFile saves mutes and bans to the file at path so they
+// outlive a restart, the default keeps them in memory only.
+func WithModerationFile(path string) Option {
+	return func(s *TcpChatServer) {
+		s.moderationPath = path
+	}
+}
+
+// WithInvitationTTL makes invitations expire after ttl if they're neither
+// accepted nor declined, the default is 7 days.
+func WithInvitationTTL(ttl time.Duration) Option {
+	return func(s *TcpChatServer) {
+		s.invitationTTL = ttl
+	}
 }
 
-func (s *TcpChatServer) Close(ctx context.Context) error {
-	return s.listener.Close()
+// WithMaxMessageSize bounds the messages clients send to frame bytes, a line
+// or binary frame, and their arguments after the command name to body
+// bytes, and sets what happens to a client that sends a larger one. A
+// frame of 0 means protocol.MaxFrameSize, a body of 0 no bound of its own.
+// The default is protocol.DefaultMaxMessageSize, no body bound and
+// OversizeReply.
+func WithMaxMessageSize(frame, body int, policy OversizePolicy) Option {
+	return func(s *TcpChatServer) {
+		s.maxFrameSize = frame
+		s.maxBodySize = body
+		s.oversizePolicy = policy
+	}
+}
+
+// WithMessageRateLimit limits the SEND and BROADCAST of each user and of
+// each IP, the ones over it get ERROR RATE_LIMITED. The default is no limit.
+func WithMessageRateLimit(limit RateLimit) Option {
+	return func(s *TcpChatServer) {
+		s.messageLimit = limit
+	}
+}
+
+// WithGroupRateLimit limits the commands that create, join, leave or change
+// groups of each user and of each IP, the ones over it get ERROR
+// RATE_LIMITED. The default is no limit.
+func WithGroupRateLimit(limit RateLimit) Option {
+	return func(s *TcpChatServer) {
+		s.groupLimit = limit
+	}
+}
+
+// WithLoginRateLimit limits the LOGIN of each user and the LOGIN and RESUME
+// of each IP, the ones over it get ERROR RATE_LIMITED before any password is
+// checked. The default is no limit.
+func WithLoginRateLimit(limit RateLimit) Option {
+	return func(s *TcpChatServer) {
+		s.loginLimit = limit
+	}
+}
+
+// WithConnectionRateLimit limits the new connections from each IP, the ones
+// over it are closed right away. The default is no limit.
+func WithConnectionRateLimit(limit RateLimit) Option {
+	return func(s *TcpChatServer) {
+		s.connLimit = limit
+	}
+}
+
+// WithRateLimitStrikes disconnects a client whose IP collected strikes
+// strikes, each within cooldown of the one before, and keeps the IP from
+// connecting for cooldown. Going over a rate limit and failing LOGIN or
+// RESUME each count as a strike. A strikes of 0 never disconnects. The
+// default is 10 strikes and 1 minute.
+func WithRateLimitStrikes(strikes int, cooldown time.Duration) Option {
+	return func(s *TcpChatServer) {
+		s.rateLimitStrikes = strikes
+		s.rateLimitCooldown = cooldown
+	}
+}
+
+// WithHeartbeat makes the server PING clients that sent nothing for interval
+// and disconnect the ones that then send nothing, not even the PONG, within
+// timeout. Only clients that negotiated 1.3 or newer with HELLO get PINGs,
+// WithIdleTimeout covers the others. Writes that take longer than timeout
+// disconnect a client too. An interval of 0, or a timeout that isn't
+// positive, turns heartbeats off. The default is 30 seconds and 15 seconds.
+func WithHeartbeat(interval, timeout time.Duration) Option {
+	return func(s *TcpChatServer) {
+		if interval > 0 && timeout <= 0 {
+			// every write would miss its deadline
+			log.Printf("heartbeat timeout:%v isn't positive, heartbeats are off", timeout)
+			interval = 0
+		}
+		s.heartbeatInterval = interval
+		s.heartbeatTimeout = timeout
+	}
+}
+
+// WithIdleTimeout disconnects the clients that don't get PINGs once they sent
+// nothing for timeout, so that half-open connections of older clients go
+// away too. A timeout of 0 never does. The default is 10 minutes.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *TcpChatServer) {
+		s.idleTimeout = timeout
+	}
+}
+
+// WithGroupStore keeps groups in store, the default keeps them in memory
+// only.
+func WithGroupStore(store GroupStore) Option {
+	return func(s *TcpChatServer) {
+		s.groups = store
+	}
+}
+
+// WithMessageStore records messages in store, the default keeps the last
+// 1000 messages of every conversation in memory.
+func WithMessageStore(store MessageStore) Option {
+	return func(s *TcpChatServer) {
+		s.messages = store
+	}
+}
+
+func NewTcpChatServer(opts ...Option) *TcpChatServer {
+	s := &TcpChatServer{
+		mu:                &sync.RWMutex{},
+		offlineSize:       defaultOfflineSize,
+		offlineTTL:        defaultOfflineTTL,
+		sessionGrace:      defaultSessionGrace,
+		invitationTTL:     defaultInvitationTTL,
+		maxFrameSize:      protocol.DefaultMaxMessageSize,
+		rateLimitStrikes:  defaultRateLimitStrikes,
+		rateLimitCooldown: defaultRateLimitCooldown,
+		heartbeatInterval: defaultHeartbeatInterval,
+		heartbeatTimeout:  defaultHeartbeatTimeout,
+		idleTimeout:       defaultIdleTimeout,
+		groups:            NewMemoryGroupStore(),
+		messages:          NewMemoryMessageStore(defaultHistorySize),
+		receipts:          newReceipts(defaultReceiptsSize),
+		presence:          newPresence(),
+		capabilities:      []string{protocol.CapabilityReceipts, protocol.CapabilityPresence},
+		handlers:          make(map[string]Handler),
+		operators:         make(map[string]struct{}),
+		outboxSize:        defaultOutboxSize,
+		overflowPolicy:    OverflowDisconnect,
+		closing:           make(chan struct{}),
+		closeOnce:         &sync.Once{},
+		wg:                &sync.WaitGroup{},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	var offline *offlineQueue
+	if s.offlineSize > 0 {
+		offline = newOfflineQueue(s.offlineSize, s.offlineTTL)
+	}
+	s.registry = newRegistry(offline, s.sessionGrace)
+	s.invitations = newInvitations(s.invitationTTL)
+	s.moderation = newModeration(s.moderationPath)
+	s.limits = newRateLimits(s.messageLimit, s.groupLimit, s.loginLimit, s.connLimit, s.rateLimitStrikes, s.rateLimitCooldown)
+	s.sequencer = newSequencer(s.messages)
+
+	s.Handle(protocol.CmdSend, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleSend(c.(*clientConn), cmd.(*protocol.SendCommand))
+	})
+	s.Handle(protocol.CmdBroadCast, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleBroadcast(c.(*clientConn), cmd.(*protocol.BroadCastCommand))
+	})
+	s.Handle(protocol.CmdLogin, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return s.handleLogin(c.(*clientConn), cmd.(*protocol.LoginCommand))
+	})
+	s.Handle(protocol.CmdResume, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return s.handleResume(c.(*clientConn), cmd.(*protocol.ResumeCommand))
+	})
+	s.Handle(protocol.CmdLogout, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleLogout(c.(*clientConn), cmd.(*protocol.LogoutCommand))
+	})
+	s.Handle(protocol.CmdGroup, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleGroup(c.(*clientConn), cmd.(*protocol.GroupCommand))
+	})
+	s.Handle(protocol.CmdLeave, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleLeave(c.(*clientConn), cmd.(*protocol.LeaveCommand))
+	})
+	s.Handle(protocol.CmdInvite, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleInvite(c.(*clientConn), cmd.(*protocol.InviteCommand))
+	})
+	s.Handle(protocol.CmdJoin, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleJoin(c.(*clientConn), cmd.(*protocol.JoinCommand))
+	})
+	s.Handle(protocol.CmdAccept, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleAccept(c.(*clientConn), cmd.(*protocol.AcceptCommand))
+	})
+	s.Handle(protocol.CmdDecline, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleDecline(c.(*clientConn), cmd.(*protocol.DeclineCommand))
+	})
+	s.Handle(protocol.CmdKick, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleKick(c.(*clientConn), cmd.(*protocol.KickCommand))
+	})
+	s.Handle(protocol.CmdPromote, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handlePromote(c.(*clientConn), cmd.(*protocol.PromoteCommand))
+	})
+	s.Handle(protocol.CmdMute, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleMute(c.(*clientConn), cmd.(*protocol.MuteCommand))
+	})
+	s.Handle(protocol.CmdUnmute, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleUnmute(c.(*clientConn), cmd.(*protocol.UnmuteCommand))
+	})
+	s.Handle(protocol.CmdBan, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleBan(c.(*clientConn), cmd.(*protocol.BanCommand))
+	})
+	s.Handle(protocol.CmdUnban, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleUnban(c.(*clientConn), cmd.(*protocol.UnbanCommand))
+	})
+	s.Handle(protocol.CmdDisconnect, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleDisconnect(c.(*clientConn), cmd.(*protocol.DisconnectCommand))
+	})
+	s.Handle(protocol.CmdChannel, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleChannel(c.(*clientConn), cmd.(*protocol.ChannelCommand))
+	})
+	s.Handle(protocol.CmdTopic, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return s.handleTopic(c.(*clientConn), cmd.(*protocol.TopicCommand))
+	})
+	s.Handle(protocol.CmdDescription, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return s.handleDescription(c.(*clientConn), cmd.(*protocol.DescriptionCommand))
+	})
+	s.Handle(protocol.CmdHistory, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleHistory(c.(*clientConn), cmd.(*protocol.HistoryCommand))
+	})
+	s.Handle(protocol.CmdRead, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleRead(c.(*clientConn), cmd.(*protocol.ReadCommand))
+	})
+	s.Handle(protocol.CmdStatus, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleStatus(c.(*clientConn), cmd.(*protocol.StatusCommand))
+	})
+	s.Handle(protocol.CmdSubscribe, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleSubscribe(c.(*clientConn), cmd.(*protocol.SubscribeCommand))
+	})
+	s.Handle(protocol.CmdUnsubscribe, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return nil, s.handleUnsubscribe(c.(*clientConn), cmd.(*protocol.UnsubscribeCommand))
+	})
+	s.Handle(protocol.CmdList, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return s.handleList(c.(*clientConn), cmd.(*protocol.ListCommand))
+	})
+	s.Handle(protocol.CmdWhois, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return s.handleWhois(c.(*clientConn), cmd.(*protocol.WhoisCommand))
+	})
+	s.Handle(protocol.CmdPing, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return &protocol.PongCommand{Data: cmd.(*protocol.PingCommand).Data}, nil
+	})
+	s.Handle(protocol.CmdHello, func(c Client, cmd protocol.Command) (protocol.Command, error) {
+		return s.handleHello(c.(*clientConn), cmd.(*protocol.HelloCommand))
+	})
+
+	return s
+}
+
+// DroppedMessages counts the commands that were never written because the
+// outbound queue of their client was full, the server logs the count of each
+// client as it disconnects.
+func (s *TcpChatServer) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Handle makes the server answer cmdName with handler, replacing the built-in
+// handler if there is one. The command must be registered with
+// protocol.Register to be readable.
+func (s *TcpChatServer) Handle(cmdName string, handler Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[cmdName] = handler
+}
+
+// Addr returns the address the server listens on, nil before it's started.
+func (s *TcpChatServer) Addr() net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+func (s *TcpChatServer) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops accepting connections and wakes up every connection, which
+// then finishes the command at hand, gets a SERVER_SHUTDOWN notice and is
+// closed. Writes still pending when ctx is done are cut short.
+func (s *TcpChatServer) Close(ctx context.Context) (err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		close(s.closing)
+		conns := s.registry.all()
+		listener := s.listener
+		s.mu.Unlock()
+
+		if listener != nil {
+			err = listener.Close()
+		}
+
+		deadline, hasDeadline := ctx.Deadline()
+		for _, cc := range conns {
+			if hasDeadline {
+				_ = cc.conn.SetWriteDeadline(deadline)
+			}
+			_ = cc.conn.SetReadDeadline(time.Now())
+		}
+	})
+
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Printf("shutdown err:%v, closing remaining connections", ctx.Err())
+		for _, cc := range s.registry.all() {
+			_ = cc.conn.Close()
+		}
+		<-drained
+		err = ctx.Err()
+	}
+	return
 }
 
 func (s *TcpChatServer) Start(ctx context.Context, address string) error {
-	if err := s.listen(ctx, address); err != nil {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
 		return err
 	}
 
-Loop:
-	for {
+	log.Printf("Listening on %s", address)
+
+	return s.Serve(ctx, l)
+}
+
+// Serve loads the sanctions and groups and accepts connections on l until
+// ctx is done or Close is called, then waits for the connections to drain.
+func (s *TcpChatServer) Serve(ctx context.Context, l net.Listener) error {
+	if err := s.moderation.load(); err != nil {
+		_ = l.Close()
+		return err
+	}
+	if err := s.groups.Load(); err != nil {
+		_ = l.Close()
+		return err
+	}
+	defer func() {
+		if err := s.groups.Close(); err != nil {
+			log.Printf("close group store err:%v", err)
+		}
+	}()
+
+	s.mu.Lock()
+	if s.isClosing() {
+		s.mu.Unlock()
+		_ = l.Close()
+		return nil
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	go func() {
 		select {
 		case <-ctx.Done():
 			log.Println("chat server is shutting down...")
-			// TODO: implement elegant shutdown logic
+			sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := s.Close(sctx); err != nil {
+				log.Printf("shutdown err:%v", err)
+			}
 			log.Println("shutdown successfully")
-			break Loop
-		default:
+		case <-s.closing:
 		}
+	}()
+
+	go s.sweep()
+	if s.heartbeatInterval > 0 {
+		go s.heartbeat()
+	}
 
-		conn, err := s.listener.Accept()
+	for {
+		conn, err := l.Accept()
 
 		if err != nil {
+			if s.isClosing() {
+				break
+			}
 			log.Print(err)
 			continue
 		}
 
-		clientConn := s.accept(conn)
-		go s.serve(clientConn)
+		if !s.limits.connect(hostOf(conn.RemoteAddr()), time.Now()) {
+			log.Printf("too many connections from %s", conn.RemoteAddr().String())
+			_ = conn.Close()
+			continue
+		}
+
+		if cc := s.accept(conn); cc != nil {
+			go s.serve(cc)
+			go s.writeLoop(cc)
+		}
 	}
 
+	s.wg.Wait()
 	return nil
 }
 
+// sweep throws away expired offline messages, sessions, invitations,
+// sanctions and rate limit state until the server closes.
+func (s *TcpChatServer) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if s.registry.offline != nil {
+				s.registry.offline.sweep(now)
+			}
+			s.registry.expire(now)
+			s.invitations.expire(now)
+			s.moderation.expire(now)
+			s.limits.expire(now)
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// heartbeat PINGs the clients that went quiet until the server closes, serve
+// evicts the ones that stay quiet.
+func (s *TcpChatServer) heartbeat() {
+	ticker := time.NewTicker(s.heartbeatTick())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, cc := range s.registry.all() {
+				if !s.heartbeats(cc) || cc.idle(now) < s.heartbeatInterval || !atomic.CompareAndSwapInt32(&cc.pinged, 0, 1) {
+					continue
+				}
+				if err := cc.Write(&protocol.PingCommand{BaseCommand: serverBase()}); err != nil {
+					log.Printf("ping %s err:%v", cc.conn.RemoteAddr().String(), err)
+				}
+			}
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// heartbeatTick is how often heartbeat looks for quiet clients, so that a
+// PING goes out at most half a timeout late.
+func (s *TcpChatServer) heartbeatTick() time.Duration {
+	tick := s.heartbeatInterval
+	if s.heartbeatTimeout < tick {
+		tick = s.heartbeatTimeout
+	}
+	if tick/2 < minHeartbeatTick {
+		return minHeartbeatTick
+	}
+	return tick / 2
+}
+
+// accept registers conn, or closes it if the server is shutting down.
 func (s *TcpChatServer) accept(conn net.Conn) *clientConn {
 	log.Printf("Accepting connection from %s", conn.RemoteAddr().String())
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.isClosing() {
+		_ = conn.Close()
+		return nil
+	}
+
+	writer := protocol.NewCommandWriter(conn)
+	writer.SetVersion(protocol.ProtocolVersion)
+
 	cc := &clientConn{
-		conn:   conn,
-		writer: protocol.NewCommandWriter(conn),
+		conn:         conn,
+		version:      protocol.ProtocolVersion,
+		mu:           &sync.RWMutex{},
+		writer:       writer,
+		writeMu:      &sync.Mutex{},
+		outbox:       newOutbox(s.outboxSize, s.overflowPolicy),
+		totalDropped: &s.dropped,
+		quit:         make(chan struct{}),
+		quitOnce:     &sync.Once{},
 	}
+	cc.touch(time.Now())
 
-	s.clientConnSet[cc] = struct{}{}
+	s.registry.add(cc)
+	s.wg.Add(2)
 	return cc
 }
 
+// remove forgets cc and lets its writeLoop flush and close the connection.
 func (s *TcpChatServer) remove(cc *clientConn) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.registry.remove(cc, time.Now())
+	s.announce()
+
+	// tells which clients are too slow, the total doesn't
+	if dropped := cc.Dropped(); dropped > 0 {
+		log.Printf("%s user:%s had %d commands dropped", cc.conn.RemoteAddr().String(), cc.Name(), dropped)
+	}
+
+	if !s.isClosing() {
+		_ = cc.conn.SetWriteDeadline(time.Now().Add(flushTimeout))
+	}
+	cc.outbox.close()
+}
+
+// writeLoop writes the commands queued for cc until its outbox is closed,
+// then closes the connection.
+func (s *TcpChatServer) writeLoop(cc *clientConn) {
+	defer s.wg.Done()
+	defer cc.conn.Close()
+
+	for {
+		cmds, ok := cc.outbox.take()
+		for _, cmd := range cmds {
+			// once cc is leaving or the server closing, the deadline is theirs
+			if ok && s.heartbeatInterval > 0 && !s.isClosing() {
+				_ = cc.conn.SetWriteDeadline(time.Now().Add(s.heartbeatTimeout))
+			}
+
+			cc.writeMu.Lock()
+			err := cc.writer.Write(cmd)
+			cc.writeMu.Unlock()
+
+			if err != nil {
+				log.Printf("write to %s err:%v", cc.conn.RemoteAddr().String(), err)
+				cc.outbox.close()
+				return
+			}
+
+			if receive, ok := cmd.(*protocol.ReceiveCommand); ok {
+				s.acknowledge(cc, receive)
+			}
+		}
+
+		if !ok {
+			return
+		}
+	}
+}
+
+// acknowledge tells the sender of a message written to cc that it was
+// delivered, once per recipient.
+func (s *TcpChatServer) acknowledge(cc *clientConn, receive *protocol.ReceiveCommand) {
+	name := cc.Name()
+	if name == "" {
+		return
+	}
+
+	from, count, total, first := s.receipts.delivered(receive.ID, name)
+	if !first {
+		return
+	}
+	s.notifyReceipt(from, &protocol.DeliveredCommand{
+		BaseCommand: serverBase(),
+		ID:          receive.ID,
+		User:        name,
+		Count:       count,
+		Total:       total,
+	})
+}
+
+// notifyReceipt writes a receipt to the sessions of user that asked for
+// receipts, it's not kept for a user who's offline.
+func (s *TcpChatServer) notifyReceipt(user string, cmd protocol.Command) {
+	for _, cc := range s.registry.connsOf(user) {
+		if !cc.hasCapability(protocol.CapabilityReceipts) {
+			continue
+		}
+		if err := cc.Write(cmd); err != nil {
+			log.Printf("write receipt to %s err:%v", cc.conn.RemoteAddr().String(), err)
+		}
+	}
+}
+
+// serverBase is the header of the commands the server sends on its own.
+func serverBase() protocol.BaseCommand {
+	return protocol.BaseCommand{
+		Protocol: protocol.ProtocolName,
+		Version:  protocol.ProtocolVersion,
+	}
+}
+
+// reply tells the client whether the command it sent succeeded, resp is
+// written as is when the handler has a reply of its own.
+func (s *TcpChatServer) reply(cc *clientConn, base protocol.BaseCommand, resp protocol.Command, err error) {
+	if err == nil && resp == nil {
+		resp = &protocol.OkCommand{BaseCommand: base}
+	} else if err == nil {
+		*resp.Base() = base
+	} else {
+		code := errorCode(err)
+		message := err.Error()
+		if code == protocol.ErrCodeInternal {
+			message = "internal error"
+		}
+		resp = &protocol.ErrorCommand{
+			BaseCommand: base,
+			Code:        code,
+			Message:     message,
+		}
+	}
 
-	delete(s.clientConnSet, cc)
+	if werr := cc.Write(resp); werr != nil {
+		log.Printf("write reply err:%v", werr)
+	}
+}
+
+// goodbye tells a client the server is going away.
+func (s *TcpChatServer) goodbye(cc *clientConn) {
+	if err := cc.Write(&protocol.NoticeCommand{
+		BaseCommand: serverBase(),
+		Kind:        protocol.NoticeShutdown,
+		Text:        "server is going away",
+	}); err != nil {
+		log.Printf("write shutdown notice err:%v", err)
+	}
 }
 
 const ClosedConnectionMsg = "use of closed network connection"
 
 func (s *TcpChatServer) serve(cc *clientConn) {
-	mr := protocol.NewCommandReader(cc.conn)
+	defer s.wg.Done()
 	defer s.remove(cc)
 
+	br := bufio.NewReader(cc.conn)
+	if !s.deadline(cc) {
+		return
+	}
+	framing, err := protocol.SniffFraming(br)
+	if err != nil {
+		if isTimeout(err) && !s.isClosing() && !cc.stopped() {
+			s.evict(cc)
+		} else if err != io.EOF && !s.isClosing() {
+			log.Printf("sniff framing err:%v", err)
+		}
+		return
+	}
+
+	if framing != protocol.FramingLine {
+		writer := protocol.NewWriter(cc.conn, framing)
+		writer.SetVersion(cc.Version())
+
+		cc.writeMu.Lock()
+		cc.framing = framing
+		cc.writer = writer
+		cc.writeMu.Unlock()
+		log.Printf("%s uses %s framing", cc.conn.RemoteAddr().String(), framing)
+	}
+	cc.reader = protocol.NewReader(br, framing)
+	cc.reader.SetMaxSize(s.maxFrameSize, s.maxBodySize)
+
 	for {
 		var err error
 
-		cmd, err := mr.Read()
+		if !s.deadline(cc) {
+			if s.isClosing() {
+				s.goodbye(cc)
+			}
+			break
+		}
+		cmd, err := cc.reader.Read()
 
 		if err == io.EOF {
 			break
 		}
 
+		if err != nil && s.isClosing() {
+			s.goodbye(cc)
+			break
+		}
+
+		if err != nil && cc.stopped() {
+			break
+		}
+
+		if isTimeout(err) {
+			s.evict(cc)
+			break
+		}
+		if err == nil || err == protocol.InvalidMessageErr || err == protocol.UnsupportedCmdErr || err == protocol.MessageTooLargeErr {
+			cc.touch(time.Now())
+		}
+
+		if err == protocol.MessageTooLargeErr {
+			log.Printf("read message from %s err:%v", cc.conn.RemoteAddr().String(), err)
+			s.reply(cc, serverBase(), nil, err)
+			if s.oversizePolicy == OversizeDisconnect {
+				break
+			}
+			continue
+		}
+
+		if err == protocol.InvalidMessageErr || err == protocol.UnsupportedCmdErr {
+			log.Printf("read message err:%v", err)
+			s.reply(cc, serverBase(), nil, err)
+			continue
+		}
+
 		if err != nil {
 			log.Printf("read message err:%v", err)
 			// https://github.com/golang/go/blob/f686a2890b34996455c7d7aba9a0efba74b613f5/src/net/error_test.go#L506
@@ -124,27 +1024,134 @@ func (s *TcpChatServer) serve(cc *clientConn) {
 			continue
 		}
 
-		if cmd != nil {
-			switch v := cmd.(type) {
-			case *protocol.SendCommand:
-				err = s.handleSend(cc, cmd.(*protocol.SendCommand))
-			case *protocol.BroadCastCommand:
-				err = s.handleBroadcast(cc, cmd.(*protocol.BroadCastCommand))
-			case *protocol.LoginCommand:
-				err = s.handleLogin(cc, cmd.(*protocol.LoginCommand))
-			case *protocol.LogoutCommand:
-				err = s.handleLogout(cc, cmd.(*protocol.LogoutCommand))
-			case *protocol.GroupCommand:
-				err = s.handleGroup(cc, cmd.(*protocol.GroupCommand))
-			case *protocol.LeaveCommand:
-				err = s.handleLeave(cc, cmd.(*protocol.LeaveCommand))
-			default:
-				log.Printf("cmd:%T %v not supported", v, v)
-			}
+		// a PONG only shows the client is there, which touch recorded
+		if _, ok := cmd.(*protocol.PongCommand); ok {
+			continue
+		}
 
-			if err != nil {
-				log.Printf("handle cmd err:%v", err)
+		base := *cmd.Base()
+		reply, err := s.dispatch(cc, cmd)
+		if err != nil {
+			log.Printf("handle cmd err:%v", err)
+		}
+		s.reply(cc, base, reply, err)
+
+		// guessing passwords or sessions counts like going over a limit
+		if (err == RateLimitedErr || err == AuthFailedErr || err == InvalidSessionErr) && s.throttle(cc) {
+			break
+		}
+
+		switch cmd.(type) {
+		case *protocol.LoginCommand, *protocol.ResumeCommand:
+			if err == nil {
+				s.registry.flush(cc, time.Now())
+				s.roster(cc)
+				s.pendingInvitations(cc)
 			}
 		}
+
+		if _, ok := cmd.(*protocol.LogoutCommand); ok && err == nil {
+			break
+		}
+	}
+}
+
+// throttle counts a strike against the IP of cc, which went over a rate
+// limit or failed to log in. It returns true if serve has to disconnect cc,
+// the IP is then kept out for a while.
+func (s *TcpChatServer) throttle(cc *clientConn) bool {
+	until := s.limits.strike(hostOf(cc.conn.RemoteAddr()), time.Now())
+	if until.IsZero() {
+		return false
+	}
+
+	log.Printf("disconnecting %s user:%s, rate limited or failed to log in too often", cc.conn.RemoteAddr().String(), cc.Name())
+	if err := cc.Write(&protocol.NoticeCommand{
+		BaseCommand: serverBase(),
+		Kind:        protocol.NoticeRateLimited,
+		Text:        strconv.FormatInt(millis(until), 10),
+	}); err != nil {
+		log.Printf("write rate limited notice err:%v", err)
+	}
+	return true
+}
+
+// deadline gives the client of cc until a heartbeat is missed, or until it
+// was idle for too long, to send its next command. It returns false if
+// serve has to finish with cc instead.
+func (s *TcpChatServer) deadline(cc *clientConn) bool {
+	if s.heartbeats(cc) {
+		_ = cc.conn.SetReadDeadline(time.Now().Add(s.heartbeatInterval + s.heartbeatTimeout))
+	} else if s.idleTimeout > 0 {
+		_ = cc.conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+	} else if s.heartbeatInterval > 0 {
+		// HELLO may have settled on an older version
+		_ = cc.conn.SetReadDeadline(time.Time{})
+	}
+	// stop and Close wake serve up with a deadline of their own, which must
+	// not have been overwritten
+	return !cc.stopped() && !s.isClosing()
+}
+
+// heartbeats reports whether cc gets PINGs and is evicted when it keeps
+// quiet, which takes a client that negotiated a version knowing PING.
+func (s *TcpChatServer) heartbeats(cc *clientConn) bool {
+	return s.heartbeatInterval > 0 && protocol.SupportsHeartbeat(cc.Version())
+}
+
+// evict tells a client that missed its heartbeat, or was idle for too long,
+// it's being disconnected, should it still be there.
+func (s *TcpChatServer) evict(cc *clientConn) {
+	reason := "idle for too long"
+	if s.heartbeats(cc) {
+		reason = "missed heartbeat"
+	}
+	log.Printf("evicting %s user:%s, %s", cc.conn.RemoteAddr().String(), cc.Name(), reason)
+	if err := cc.Write(&protocol.NoticeCommand{
+		BaseCommand: serverBase(),
+		Kind:        protocol.NoticeIdleTimeout,
+		Text:        reason,
+	}); err != nil {
+		log.Printf("write idle notice err:%v", err)
+	}
+}
+
+// isTimeout reports whether err is a deadline running out.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// anonymousCmds may be sent before LOGIN succeeds.
+var anonymousCmds = map[string]bool{
+	protocol.CmdHello:  true,
+	protocol.CmdPing:   true,
+	protocol.CmdLogin:  true,
+	protocol.CmdResume: true,
+	protocol.CmdLogout: true,
+}
+
+func (s *TcpChatServer) dispatch(cc *clientConn, cmd protocol.Command) (protocol.Command, error) {
+	s.mu.RLock()
+	handler, ok := s.handlers[cmd.CmdName()]
+	s.mu.RUnlock()
+
+	if !ok {
+		log.Printf("cmd:%s not supported", cmd.CmdName())
+		return nil, protocol.UnsupportedCmdErr
+	}
+
+	name := cc.Name()
+	if name == "" && !anonymousCmds[cmd.CmdName()] {
+		return nil, NotLoggedInErr
+	}
+	user := name
+	if login, ok := cmd.(*protocol.LoginCommand); ok {
+		user = login.Username
+	}
+	if !s.limits.command(user, hostOf(cc.conn.RemoteAddr()), cmd.CmdName(), time.Now()) {
+		log.Printf("user:%s went over the rate limit of cmd:%s", user, cmd.CmdName())
+		return nil, RateLimitedErr
 	}
+	return handler(cc, cmd)
 }
@@ -0,0 +1,1321 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/ZhengHe-MD/network-examples/tcp/chat/protocol"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testBase = protocol.BaseCommand{Protocol: protocol.ProtocolName, Version: protocol.ProtocolVersion}
+
+// startServer serves s on a random local port, stop closes it and waits for
+// Serve to return.
+func startServer(t *testing.T, s *TcpChatServer) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err:%v", err)
+	}
+
+	log.SetOutput(ioutil.Discard)
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(context.Background(), l)
+	}()
+
+	return l.Addr().String(), func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Close(ctx); err != nil {
+			t.Errorf("close err:%v", err)
+		}
+		if err := <-served; err != nil {
+			t.Errorf("serve err:%v", err)
+		}
+		log.SetOutput(os.Stderr)
+	}
+}
+
+type testClient struct {
+	conn   net.Conn
+	reader protocol.Reader
+	writer protocol.Writer
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial err:%v", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	return &testClient{
+		conn:   conn,
+		reader: protocol.NewCommandReader(conn),
+		writer: protocol.NewCommandWriter(conn),
+	}
+}
+
+// stressClient pipelines rounds of GROUP, JOIN, BROADCAST, SEND and LEAVE,
+// then LOGOUT, while reading everything the server sends back.
+func stressClient(t *testing.T, addr string, id, clients, rounds int) {
+	c := dial(t, addr)
+	defer c.conn.Close()
+
+	name := fmt.Sprintf("user%d", id)
+	peer := fmt.Sprintf("user%d", (id+1)%clients)
+
+	var cmds []protocol.Command
+	cmds = append(cmds, &protocol.LoginCommand{BaseCommand: testBase, Username: name})
+	for i := 0; i < rounds; i++ {
+		group := fmt.Sprintf("group%d", (id+i)%4)
+		cmds = append(cmds,
+			&protocol.GroupCommand{BaseCommand: testBase, GroupName: group, UserNames: []string{name, peer, "churn"}},
+			&protocol.JoinCommand{BaseCommand: testBase, Group: group},
+			&protocol.BroadCastCommand{BaseCommand: testBase, GroupName: group, Data: []byte("hi all")},
+			&protocol.SendCommand{BaseCommand: testBase, Name: peer, Data: []byte("hi")},
+			&protocol.LeaveCommand{BaseCommand: testBase, GroupName: group},
+		)
+	}
+	cmds = append(cmds, &protocol.LogoutCommand{BaseCommand: testBase})
+
+	replies := make(chan int, 1)
+	go func() {
+		n := 0
+		defer func() { replies <- n }()
+		for {
+			cmd, err := c.reader.Read()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				t.Errorf("%s: read err:%v", name, err)
+				return
+			}
+
+			switch cmd := cmd.(type) {
+			case *protocol.OkCommand:
+				n++
+			case *protocol.ErrorCommand:
+				n++
+				// the peer may not be logged in yet or already gone, the
+				// group may be someone else's who didn't invite us or gone
+				// once its last member left
+				switch cmd.Code {
+				case protocol.ErrCodeUnknownUser, protocol.ErrCodeGroupExists, protocol.ErrCodeNotInvited,
+					protocol.ErrCodeAlreadyMember, protocol.ErrCodeNotMember, protocol.ErrCodeNoSuchGroup:
+				default:
+					t.Errorf("%s: should not have error:%s", name, cmd.Code)
+				}
+			}
+		}
+	}()
+
+	for _, cmd := range cmds {
+		if err := c.writer.Write(cmd); err != nil {
+			t.Errorf("%s: write err:%v", name, err)
+			break
+		}
+	}
+
+	if n := <-replies; n != len(cmds) {
+		t.Errorf("%s: should have %d replies got:%d", name, len(cmds), n)
+	}
+}
+
+// churnClient logs in and out as the same user over and over, kicking its
+// own older sessions.
+func churnClient(t *testing.T, addr string, rounds int) {
+	for i := 0; i < rounds; i++ {
+		c := dial(t, addr)
+		_ = c.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "churn"})
+		_ = c.writer.Write(&protocol.SendCommand{BaseCommand: testBase, Name: "user0", Data: []byte("churn")})
+		_ = c.writer.Write(&protocol.LogoutCommand{BaseCommand: testBase})
+
+		for {
+			if _, err := c.reader.Read(); err != nil {
+				break
+			}
+		}
+		c.conn.Close()
+	}
+}
+
+func TestServerConcurrentClients(t *testing.T) {
+	const clients, rounds, churners = 16, 50, 4
+
+	s := NewTcpChatServer(WithLoginPolicy(LoginPolicyKickOld), WithOutboundQueue(4096, OverflowDisconnect))
+	addr, stop := startServer(t, s)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			stressClient(t, addr, id, clients, rounds)
+		}(i)
+	}
+	for i := 0; i < churners; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			churnClient(t, addr, rounds)
+		}()
+	}
+	wg.Wait()
+
+	// every client saw its connection closed, which happens after it's removed
+	s.registry.mu.RLock()
+	conns, users := len(s.registry.conns), len(s.registry.users)
+	s.registry.mu.RUnlock()
+	if conns != 0 || users != 0 {
+		t.Errorf("should have no conns or users left got:%d, %d", conns, users)
+	}
+	// everyone left what they joined, which leaves the groups empty and gone
+	if groups := s.groups.(*MemoryGroupStore).names(); len(groups) != 0 {
+		t.Errorf("should have no groups left got:%v", groups)
+	}
+
+	stop()
+
+	if s.DroppedMessages() != 0 {
+		t.Errorf("should have dropped nothing got:%d", s.DroppedMessages())
+	}
+}
+
+// expect reads the next command from c and checks its line, request ids
+// and all.
+func (c *testClient) expect(t *testing.T, expected string) {
+	cmd, err := c.reader.Read()
+	if err != nil {
+		t.Errorf("should have %q got err:%v", expected, err)
+		return
+	}
+	if got := cmd.(fmt.Stringer).String(); got != expected {
+		t.Errorf("should have %q got:%q", expected, got)
+	}
+}
+
+// expectPrefix reads the next command from c and checks its line starts
+// with prefix.
+func (c *testClient) expectPrefix(t *testing.T, prefix string) {
+	cmd, err := c.reader.Read()
+	if err != nil {
+		t.Errorf("should have %q got err:%v", prefix, err)
+		return
+	}
+	if got := cmd.(fmt.Stringer).String(); !strings.HasPrefix(got, prefix) {
+		t.Errorf("should have %q got:%q", prefix, got)
+	}
+}
+
+// expectNotice reads the next command from c, which has to be a NOTICE of
+// kind.
+func (c *testClient) expectNotice(t *testing.T, kind string) {
+	cmd, err := c.reader.Read()
+	notice, ok := cmd.(*protocol.NoticeCommand)
+	if err != nil || !ok || notice.Kind != kind {
+		t.Fatalf("should have NOTICE %s got:%v, %v", kind, cmd, err)
+	}
+}
+
+// expectOk reads the next command from c, which has to be an OK.
+func (c *testClient) expectOk(t *testing.T) {
+	cmd, err := c.reader.Read()
+	if _, ok := cmd.(*protocol.OkCommand); err != nil || !ok {
+		t.Fatalf("should have OK got:%v, %v", cmd, err)
+	}
+}
+
+// makeGroup has c create group and invite members, who are online and join
+// in name order. The notices that takes are read.
+func (c *testClient) makeGroup(t *testing.T, group string, members map[string]*testClient) {
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	_ = c.writer.Write(&protocol.GroupCommand{BaseCommand: testBase, GroupName: group, UserNames: names})
+	c.expectOk(t)
+
+	joined := []*testClient{c}
+	for _, name := range names {
+		member := members[name]
+		member.expectNotice(t, protocol.NoticeInvited)
+		_ = member.writer.Write(&protocol.JoinCommand{BaseCommand: testBase, Group: group})
+		member.expectOk(t)
+		for _, cl := range joined {
+			cl.expectNotice(t, protocol.NoticeMemberJoined)
+		}
+		joined = append(joined, member)
+	}
+}
+
+func TestServerOfflineDelivery(t *testing.T) {
+	s := NewTcpChatServer()
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a, b := dial(t, addr), dial(t, addr)
+	defer a.conn.Close()
+	defer b.conn.Close()
+
+	for cl, name := range map[*testClient]string{a: "zhenghe", b: "xixi"} {
+		_ = cl.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: name})
+		cl.expect(t, "CHAT/1.0 OK\n")
+	}
+	a.makeGroup(t, "team", map[string]*testClient{"xixi": b})
+	_ = b.writer.Write(&protocol.LogoutCommand{BaseCommand: testBase})
+	b.expect(t, "CHAT/1.0 OK\n")
+
+	cmds := []protocol.Command{
+		&protocol.SendCommand{BaseCommand: testBase, Name: "xixi", Data: []byte("first")},
+		&protocol.BroadCastCommand{BaseCommand: testBase, GroupName: "team", Data: []byte("second")},
+		&protocol.SendCommand{BaseCommand: testBase, Name: "xixi", Data: []byte("third")},
+	}
+	for _, cmd := range cmds {
+		_ = a.writer.Write(cmd)
+		a.expect(t, "CHAT/1.0 OK\n")
+	}
+	// nothing is kept for a user who never was
+	_ = a.writer.Write(&protocol.SendCommand{BaseCommand: testBase, Name: "nobody", Data: []byte("hi")})
+	a.expect(t, "CHAT/1.0 ERROR UNKNOWN_USER unknown user\n")
+
+	b = dial(t, addr)
+	defer b.conn.Close()
+
+	_ = b.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "xixi"})
+	b.expect(t, "CHAT/1.0 OK\n")
+	b.expect(t, "CHAT/1.0 RECEIVE zhenghe first\n")
+	b.expect(t, "CHAT/1.0 RECEIVE zhenghe second\n")
+	b.expect(t, "CHAT/1.0 RECEIVE zhenghe third\n")
+
+	_ = a.writer.Write(&protocol.SendCommand{BaseCommand: testBase, Name: "xixi", Data: []byte("online")})
+	a.expect(t, "CHAT/1.0 OK\n")
+	b.expect(t, "CHAT/1.0 RECEIVE zhenghe online\n")
+}
+
+func TestServerLoginNames(t *testing.T) {
+	s := NewTcpChatServer(WithLoginPolicy(LoginPolicyMultiDevice))
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a := dial(t, addr)
+	defer a.conn.Close()
+
+	cases := []struct {
+		username string
+		expected string
+	}{
+		{"", "CHAT/1.0 ERROR INVALID_NAME invalid name\n"},
+		{"xi\txi", "CHAT/1.0 ERROR INVALID_NAME invalid name\n"},
+		{"xixi\x00", "CHAT/1.0 ERROR INVALID_NAME invalid name\n"},
+		{"xixi", "CHAT/1.0 OK\n"},
+	}
+
+	for _, c := range cases {
+		_ = a.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: c.username})
+		a.expect(t, c.expected)
+	}
+
+	s.registry.mu.RLock()
+	_, anonymous := s.registry.users[""]
+	s.registry.mu.RUnlock()
+	if anonymous {
+		t.Errorf("should not have indexed an empty user")
+	}
+}
+
+func TestServerHistory(t *testing.T) {
+	s := NewTcpChatServer()
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a, b, c := dial(t, addr), dial(t, addr), dial(t, addr)
+	defer a.conn.Close()
+	defer b.conn.Close()
+	defer c.conn.Close()
+
+	for cl, name := range map[*testClient]string{a: "zhenghe", b: "xixi", c: "haha"} {
+		_ = cl.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: name})
+		cl.expect(t, "CHAT/1.0 OK\n")
+	}
+	a.makeGroup(t, "team", map[string]*testClient{"xixi": b})
+
+	cmds := []protocol.Command{
+		&protocol.SendCommand{BaseCommand: testBase, Name: "xixi", Data: []byte("first")},
+		&protocol.BroadCastCommand{BaseCommand: testBase, GroupName: "team", Data: []byte("to the team")},
+		&protocol.SendCommand{BaseCommand: testBase, Name: "xixi", Data: []byte("second")},
+	}
+	for _, cmd := range cmds {
+		_ = a.writer.Write(cmd)
+		a.expect(t, "CHAT/1.0 OK\n")
+	}
+	for i := 0; i < 3; i++ {
+		_, _ = b.reader.Read()
+	}
+
+	cases := []struct {
+		client       *testClient
+		cmd          *protocol.HistoryCommand
+		expectedFrom []string
+		expectedData []string
+		expectedLast string
+	}{
+		{
+			b,
+			&protocol.HistoryCommand{Kind: protocol.ConversationUser, Name: "zhenghe", Direction: protocol.HistoryBefore},
+			[]string{"zhenghe", "zhenghe"},
+			[]string{"first", "second"},
+			"CHAT/1.0 OK\n",
+		},
+		{
+			b,
+			&protocol.HistoryCommand{Kind: protocol.ConversationUser, Name: "zhenghe", Direction: protocol.HistoryBefore, Limit: 1},
+			[]string{"zhenghe"},
+			[]string{"second"},
+			"CHAT/1.0 OK\n",
+		},
+		{
+			a,
+			&protocol.HistoryCommand{Kind: protocol.ConversationGroup, Name: "team", Direction: protocol.HistoryAfter},
+			[]string{"zhenghe"},
+			[]string{"to the team"},
+			"CHAT/1.0 OK\n",
+		},
+		{
+			c,
+			&protocol.HistoryCommand{Kind: protocol.ConversationGroup, Name: "team", Direction: protocol.HistoryBefore},
+			nil,
+			nil,
+			"CHAT/1.0 ERROR NOT_MEMBER not a member\n",
+		},
+		{
+			c,
+			&protocol.HistoryCommand{Kind: protocol.ConversationUser, Name: "xixi", Direction: protocol.HistoryBefore},
+			nil,
+			nil,
+			"CHAT/1.0 OK\n",
+		},
+	}
+
+	for i, cs := range cases {
+		cs.cmd.BaseCommand = testBase
+		_ = cs.client.writer.Write(cs.cmd)
+
+		for j := range cs.expectedFrom {
+			cmd, err := cs.client.reader.Read()
+			msg, ok := cmd.(*protocol.MessageCommand)
+			if err != nil || !ok {
+				t.Errorf("case %d: should have MESSAGE got:%v, %v", i, cmd, err)
+				break
+			}
+			if msg.From != cs.expectedFrom[j] || string(msg.Data) != cs.expectedData[j] {
+				t.Errorf("case %d: should have %s:%s got:%s:%s",
+					i, cs.expectedFrom[j], cs.expectedData[j], msg.From, msg.Data)
+			}
+		}
+		cs.client.expect(t, cs.expectedLast)
+	}
+}
+
+func TestServerMessageMeta(t *testing.T) {
+	s := NewTcpChatServer()
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a, b := dial(t, addr), dial(t, addr)
+	defer a.conn.Close()
+	defer b.conn.Close()
+
+	_ = b.writer.Write(&protocol.HelloCommand{BaseCommand: testBase, Versions: []string{protocol.ProtocolVersion12}})
+	b.expect(t, "CHAT/1.2 HELLO 1.2\n")
+	b.reader.SetVersion(protocol.ProtocolVersion12)
+	b.writer.SetVersion(protocol.ProtocolVersion12)
+
+	for cl, name := range map[*testClient]string{a: "zhenghe", b: "xixi"} {
+		_ = cl.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: name})
+		_, _ = cl.reader.Read()
+	}
+	a.makeGroup(t, "team", map[string]*testClient{"xixi": b})
+
+	cmds := []protocol.Command{
+		&protocol.SendCommand{BaseCommand: testBase, Name: "xixi", Data: []byte("first")},
+		&protocol.BroadCastCommand{BaseCommand: testBase, GroupName: "team", Data: []byte("to the team")},
+		&protocol.SendCommand{BaseCommand: testBase, Name: "xixi", Data: []byte("second")},
+		&protocol.BroadCastCommand{BaseCommand: testBase, GroupName: "team", Data: []byte("to the team again")},
+	}
+	for _, cmd := range cmds {
+		_ = a.writer.Write(cmd)
+		a.expect(t, "CHAT/1.0 OK\n")
+	}
+
+	cases := []struct {
+		expectedKind   string
+		expectedTarget string
+		expectedSeq    uint64
+		expectedData   string
+	}{
+		{protocol.ConversationUser, "zhenghe", 1, "first"},
+		{protocol.ConversationGroup, "team", 1, "to the team"},
+		{protocol.ConversationUser, "zhenghe", 2, "second"},
+		{protocol.ConversationGroup, "team", 2, "to the team again"},
+	}
+
+	var lastID uint64
+	for i, c := range cases {
+		cmd, err := b.reader.Read()
+		receive, ok := cmd.(*protocol.ReceiveCommand)
+		if err != nil || !ok {
+			t.Fatalf("case %d: should have RECEIVE got:%v, %v", i, cmd, err)
+		}
+
+		if receive.Kind != c.expectedKind || receive.Target != c.expectedTarget || receive.Seq != c.expectedSeq {
+			t.Errorf("case %d: should have %s:%s seq:%d got:%s:%s seq:%d",
+				i, c.expectedKind, c.expectedTarget, c.expectedSeq, receive.Kind, receive.Target, receive.Seq)
+		}
+		if string(receive.Data) != c.expectedData || receive.From != "zhenghe" {
+			t.Errorf("case %d: should have zhenghe:%s got:%s:%s",
+				i, c.expectedData, receive.From, receive.Data)
+		}
+		if receive.ID <= lastID || receive.Timestamp == 0 {
+			t.Errorf("case %d: should have an id after %d and a timestamp got:%d, %d",
+				i, lastID, receive.ID, receive.Timestamp)
+		}
+		lastID = receive.ID
+	}
+}
+
+// hello negotiates version and capabilities for c.
+func (c *testClient) hello(t *testing.T, version string, capabilities ...string) {
+	_ = c.writer.Write(&protocol.HelloCommand{BaseCommand: testBase, Versions: []string{version}, Capabilities: capabilities})
+	if _, err := c.reader.Read(); err != nil {
+		t.Fatalf("hello err:%v", err)
+	}
+	c.reader.SetVersion(version)
+	c.writer.SetVersion(version)
+}
+
+// collect reads n commands from c and returns their lines, in any order
+// the server happens to write them.
+func (c *testClient) collect(t *testing.T, n int) map[string]bool {
+	lines := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		cmd, err := c.reader.Read()
+		if err != nil {
+			t.Fatalf("read err:%v", err)
+		}
+		lines[cmd.(fmt.Stringer).String()] = true
+	}
+	return lines
+}
+
+// receiveID returns the id of the 1.2 RECEIVE in lines.
+func receiveID(lines map[string]bool) (id uint64) {
+	for line := range lines {
+		_, _ = fmt.Sscanf(line, "CHAT/1.2 RECEIVE %d", &id)
+	}
+	return
+}
+
+func TestServerReceipts(t *testing.T) {
+	s := NewTcpChatServer()
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a, b, c := dial(t, addr), dial(t, addr), dial(t, addr)
+	defer a.conn.Close()
+	defer b.conn.Close()
+	defer c.conn.Close()
+
+	a.hello(t, protocol.ProtocolVersion12, protocol.CapabilityReceipts)
+	b.hello(t, protocol.ProtocolVersion12)
+	for cl, name := range map[*testClient]string{a: "zhenghe", b: "xixi", c: "haha"} {
+		_ = cl.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: name})
+		_, _ = cl.reader.Read()
+	}
+
+	_ = a.writer.Write(&protocol.SendCommand{BaseCommand: testBase, Name: "xixi", Data: []byte("escalation")})
+	id := receiveID(b.collect(t, 1))
+
+	expected := []string{"CHAT/1.2 OK\n", fmt.Sprintf("CHAT/1.2 DELIVERED %d xixi 1 1\n", id)}
+	if lines := a.collect(t, 2); !lines[expected[0]] || !lines[expected[1]] {
+		t.Errorf("should have %q got:%v", expected, lines)
+	}
+
+	_ = b.writer.Write(&protocol.ReadCommand{BaseCommand: testBase, ID: id})
+	b.expect(t, "CHAT/1.2 OK\n")
+	a.expect(t, fmt.Sprintf("CHAT/1.2 READ %d xixi 1 1\n", id))
+
+	_ = c.writer.Write(&protocol.ReadCommand{BaseCommand: testBase, ID: id})
+	c.expect(t, "CHAT/1.0 ERROR NOT_MEMBER not a member\n")
+
+	// a group message counts every member but the sender
+	a.makeGroup(t, "team", map[string]*testClient{"xixi": b, "haha": c})
+	_ = a.writer.Write(&protocol.BroadCastCommand{BaseCommand: testBase, GroupName: "team", Data: []byte("all hands")})
+	id = receiveID(b.collect(t, 1))
+	_ = c.collect(t, 1)
+
+	lines := a.collect(t, 3)
+	counted := 0
+	for _, user := range []string{"xixi", "haha"} {
+		for count := 1; count <= 2; count++ {
+			if lines[fmt.Sprintf("CHAT/1.2 DELIVERED %d %s %d 2\n", id, user, count)] {
+				counted += count
+			}
+		}
+	}
+	if !lines["CHAT/1.2 OK\n"] || counted != 3 {
+		t.Errorf("should have OK and a DELIVERED for each member got:%v", lines)
+	}
+
+	_ = c.writer.Write(&protocol.ReadCommand{BaseCommand: testBase, ID: id})
+	c.expect(t, "CHAT/1.0 OK\n")
+	a.expect(t, fmt.Sprintf("CHAT/1.2 READ %d haha 1 2\n", id))
+
+	_ = c.writer.Write(&protocol.ReadCommand{BaseCommand: testBase, ID: 1})
+	c.expect(t, "CHAT/1.0 ERROR UNKNOWN_MESSAGE unknown message\n")
+}
+
+// readReceive reads the next command from c, which has to be a RECEIVE.
+func (c *testClient) readReceive(t *testing.T) *protocol.ReceiveCommand {
+	cmd, err := c.reader.Read()
+	receive, ok := cmd.(*protocol.ReceiveCommand)
+	if err != nil || !ok {
+		t.Fatalf("should have RECEIVE got:%v, %v", cmd, err)
+	}
+	return receive
+}
+
+func TestServerResume(t *testing.T) {
+	s := NewTcpChatServer()
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a, b := dial(t, addr), dial(t, addr)
+	defer a.conn.Close()
+
+	_ = a.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "zhenghe"})
+	a.expect(t, "CHAT/1.0 OK\n")
+
+	b.hello(t, protocol.ProtocolVersion12)
+	_ = b.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "xixi"})
+	cmd, err := b.reader.Read()
+	session, ok := cmd.(*protocol.SessionCommand)
+	if err != nil || !ok || session.Token == "" {
+		t.Fatalf("should have SESSION got:%v, %v", cmd, err)
+	}
+
+	send := func(data string) {
+		_ = a.writer.Write(&protocol.SendCommand{BaseCommand: testBase, Name: "xixi", Data: []byte(data)})
+		a.expect(t, "CHAT/1.0 OK\n")
+	}
+
+	send("first")
+	send("second")
+	lastID := b.readReceive(t).ID
+	_ = b.readReceive(t)
+	// the client lost second and whatever comes before it's back
+	b.conn.Close()
+	send("third")
+
+	c := dial(t, addr)
+	defer c.conn.Close()
+	c.hello(t, protocol.ProtocolVersion12)
+
+	_ = c.writer.Write(&protocol.ResumeCommand{BaseCommand: testBase, Token: "bogus", LastID: lastID})
+	c.expect(t, "CHAT/1.2 ERROR INVALID_SESSION invalid or expired session\n")
+
+	_ = c.writer.Write(&protocol.ResumeCommand{BaseCommand: testBase, Token: session.Token, LastID: lastID})
+	c.expect(t, "CHAT/1.2 SESSION "+session.Token+"\n")
+	for i, expected := range []string{"second", "third"} {
+		receive := c.readReceive(t)
+		if string(receive.Data) != expected || receive.ID <= lastID {
+			t.Errorf("case %d: should have %s after id %d got:%s id:%d", i, expected, lastID, receive.Data, receive.ID)
+		}
+		lastID = receive.ID
+	}
+
+	send("fourth")
+	if receive := c.readReceive(t); string(receive.Data) != "fourth" {
+		t.Errorf("should have fourth got:%s", receive.Data)
+	}
+
+	_ = c.writer.Write(&protocol.LogoutCommand{BaseCommand: testBase})
+	c.expect(t, "CHAT/1.2 OK\n")
+
+	d := dial(t, addr)
+	defer d.conn.Close()
+	_ = d.writer.Write(&protocol.ResumeCommand{BaseCommand: testBase, Token: session.Token, LastID: lastID})
+	d.expect(t, "CHAT/1.0 ERROR INVALID_SESSION invalid or expired session\n")
+}
+
+// TestServerResumeFullReplay resumes a session with more missed messages
+// than the outbound queue holds.
+func TestServerResumeFullReplay(t *testing.T) {
+	s := NewTcpChatServer()
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a, b := dial(t, addr), dial(t, addr)
+	defer a.conn.Close()
+
+	_ = a.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "zhenghe"})
+	a.expect(t, "CHAT/1.0 OK\n")
+
+	b.hello(t, protocol.ProtocolVersion12)
+	_ = b.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "xixi"})
+	cmd, err := b.reader.Read()
+	session, ok := cmd.(*protocol.SessionCommand)
+	if err != nil || !ok {
+		t.Fatalf("should have SESSION got:%v, %v", cmd, err)
+	}
+
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			_ = a.writer.Write(&protocol.SendCommand{BaseCommand: testBase, Name: "xixi", Data: []byte("hi")})
+			a.expect(t, "CHAT/1.0 OK\n")
+		}
+	}
+
+	send(sessionReplaySize)
+	for i := 0; i < sessionReplaySize; i++ {
+		_ = b.readReceive(t)
+	}
+	// the client lost all of them, then more are kept offline
+	b.conn.Close()
+	for s.registry.online("xixi") {
+		time.Sleep(time.Millisecond)
+	}
+	send(defaultOfflineSize)
+
+	c := dial(t, addr)
+	defer c.conn.Close()
+	c.hello(t, protocol.ProtocolVersion12)
+	_ = c.writer.Write(&protocol.ResumeCommand{BaseCommand: testBase, Token: session.Token, LastID: 0})
+	c.expect(t, "CHAT/1.2 SESSION "+session.Token+"\n")
+
+	var lastID uint64
+	for i := 0; i < sessionReplaySize+defaultOfflineSize; i++ {
+		receive := c.readReceive(t)
+		if receive.ID <= lastID {
+			t.Fatalf("case %d: should have an id after %d got:%d", i, lastID, receive.ID)
+		}
+		lastID = receive.ID
+	}
+
+	send(1)
+	if receive := c.readReceive(t); receive.ID <= lastID {
+		t.Errorf("should have the next message after id %d got:%d", lastID, receive.ID)
+	}
+	if s.DroppedMessages() != 0 {
+		t.Errorf("should have dropped nothing got:%d", s.DroppedMessages())
+	}
+}
+
+func TestServerHeartbeat(t *testing.T) {
+	s := NewTcpChatServer(WithHeartbeat(100*time.Millisecond, 100*time.Millisecond))
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a, b := dial(t, addr), dial(t, addr)
+	defer a.conn.Close()
+	defer b.conn.Close()
+
+	_ = b.writer.Write(&protocol.PingCommand{BaseCommand: testBase, Data: "43"})
+	b.expect(t, "CHAT/1.0 PONG 43\n")
+
+	a.hello(t, protocol.ProtocolVersion13)
+	_ = a.writer.Write(&protocol.PingCommand{BaseCommand: testBase, Data: "42"})
+	a.expect(t, "CHAT/1.3 PONG 42\n")
+
+	// answering every PING keeps an idle client connected
+	for i := 0; i < 3; i++ {
+		a.expect(t, "CHAT/1.3 PING\n")
+		_ = a.writer.Write(&protocol.PongCommand{BaseCommand: testBase})
+	}
+	_ = a.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "zhenghe"})
+	a.expectPrefix(t, "CHAT/1.3 SESSION ")
+
+	// one that stops answering is evicted and logged out
+	a.expect(t, "CHAT/1.3 PING\n")
+	a.expect(t, "CHAT/1.3 NOTICE IDLE_TIMEOUT missed heartbeat\n")
+	if cmd, err := a.reader.Read(); err != io.EOF {
+		t.Errorf("should have been disconnected got:%v, %v", cmd, err)
+	}
+
+	// a 1.0 client gets no PINGs and isn't evicted before the idle timeout
+	_ = b.writer.Write(&protocol.PingCommand{BaseCommand: testBase, Data: "44"})
+	b.expect(t, "CHAT/1.0 PONG 44\n")
+
+	s.registry.mu.RLock()
+	conns, users := len(s.registry.conns), len(s.registry.users)
+	s.registry.mu.RUnlock()
+	if conns != 1 || users != 0 {
+		t.Errorf("should have the conn of b and no users left got:%d, %d", conns, users)
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	s := NewTcpChatServer(WithHeartbeat(time.Minute, time.Minute), WithIdleTimeout(100*time.Millisecond))
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a := dial(t, addr)
+	defer a.conn.Close()
+
+	// a 1.2 client doesn't know PING, it's evicted without one
+	a.hello(t, protocol.ProtocolVersion12)
+	_ = a.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "zhenghe"})
+	a.expectPrefix(t, "CHAT/1.2 SESSION ")
+	a.expect(t, "CHAT/1.2 NOTICE IDLE_TIMEOUT idle for too long\n")
+	if cmd, err := a.reader.Read(); err != io.EOF {
+		t.Errorf("should have been disconnected got:%v, %v", cmd, err)
+	}
+}
+
+func TestServerHeartbeatTimeout(t *testing.T) {
+	cases := []struct {
+		interval, timeout time.Duration
+		expectedInterval  time.Duration
+		expectedTick      time.Duration
+	}{
+		{time.Second, 0, 0, minHeartbeatTick},
+		{time.Second, -time.Second, 0, minHeartbeatTick},
+		{time.Second, time.Nanosecond, time.Second, minHeartbeatTick},
+		{time.Second, 100 * time.Millisecond, time.Second, 50 * time.Millisecond},
+	}
+
+	for i, c := range cases {
+		s := NewTcpChatServer(WithHeartbeat(c.interval, c.timeout))
+		if s.heartbeatInterval != c.expectedInterval {
+			t.Errorf("case %d: should have interval:%v got:%v", i, c.expectedInterval, s.heartbeatInterval)
+		}
+		if c.expectedInterval > 0 && s.heartbeatTick() != c.expectedTick {
+			t.Errorf("case %d: should have tick:%v got:%v", i, c.expectedTick, s.heartbeatTick())
+		}
+	}
+
+	// a zero timeout neither brings the server down nor fails every write
+	s := NewTcpChatServer(WithHeartbeat(time.Millisecond, 0))
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a := dial(t, addr)
+	defer a.conn.Close()
+	a.hello(t, protocol.ProtocolVersion12)
+	_ = a.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "zhenghe"})
+	a.expectPrefix(t, "CHAT/1.2 SESSION ")
+	time.Sleep(20 * time.Millisecond)
+	_ = a.writer.Write(&protocol.PingCommand{BaseCommand: testBase, Data: "42"})
+	a.expect(t, "CHAT/1.2 PONG 42\n")
+}
+
+// expectPresence reads the next command from c, which has to be the
+// PRESENCE of user in state with message.
+func (c *testClient) expectPresence(t *testing.T, user, state, message string) {
+	cmd, err := c.reader.Read()
+	presence, ok := cmd.(*protocol.PresenceCommand)
+	if err != nil || !ok {
+		t.Fatalf("should have PRESENCE got:%v, %v", cmd, err)
+	}
+	if presence.User != user || presence.State != state || presence.Message != message || presence.Since == 0 {
+		t.Errorf("should have %s %s %q since some time got:%s %s %q since %d",
+			user, state, message, presence.User, presence.State, presence.Message, presence.Since)
+	}
+}
+
+func TestServerPresence(t *testing.T) {
+	s := NewTcpChatServer()
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a, b, c := dial(t, addr), dial(t, addr), dial(t, addr)
+	defer a.conn.Close()
+	defer b.conn.Close()
+	defer c.conn.Close()
+
+	a.hello(t, protocol.ProtocolVersion11, protocol.CapabilityPresence)
+	c.hello(t, protocol.ProtocolVersion11, protocol.CapabilityPresence)
+
+	_ = a.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "zhenghe"})
+	a.expect(t, "CHAT/1.1 OK\n")
+
+	// b shares a group with a, c subscribes to b, b doesn't ask for presence
+	_ = b.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "xixi"})
+	b.expect(t, "CHAT/1.0 OK\n")
+	a.makeGroup(t, "team", map[string]*testClient{"xixi": b})
+
+	_ = c.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "haha"})
+	c.expect(t, "CHAT/1.1 OK\n")
+	_ = c.writer.Write(&protocol.SubscribeCommand{BaseCommand: testBase, User: "xixi"})
+	c.expectPresence(t, "xixi", protocol.PresenceOnline, "")
+	c.expect(t, "CHAT/1.1 OK\n")
+
+	_ = b.writer.Write(&protocol.StatusCommand{BaseCommand: testBase, State: protocol.PresenceBusy, Message: "in a meeting"})
+	b.expect(t, "CHAT/1.0 OK\n")
+	a.expectPresence(t, "xixi", protocol.PresenceBusy, "in a meeting")
+	c.expectPresence(t, "xixi", protocol.PresenceBusy, "in a meeting")
+
+	_ = b.writer.Write(&protocol.LogoutCommand{BaseCommand: testBase})
+	b.expect(t, "CHAT/1.0 OK\n")
+	a.expectPresence(t, "xixi", protocol.PresenceOffline, "")
+	c.expectPresence(t, "xixi", protocol.PresenceOffline, "")
+
+	// the roster follows LOGIN
+	d := dial(t, addr)
+	defer d.conn.Close()
+	d.hello(t, protocol.ProtocolVersion11, protocol.CapabilityPresence)
+	_ = d.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "xixi"})
+	d.expect(t, "CHAT/1.1 OK\n")
+	d.expectPresence(t, "zhenghe", protocol.PresenceOnline, "")
+	a.expectPresence(t, "xixi", protocol.PresenceOnline, "")
+	c.expectPresence(t, "xixi", protocol.PresenceOnline, "")
+}
+
+func TestServerQueries(t *testing.T) {
+	s := NewTcpChatServer()
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a, b, c := dial(t, addr), dial(t, addr), dial(t, addr)
+	defer a.conn.Close()
+	defer b.conn.Close()
+	defer c.conn.Close()
+
+	for cl, name := range map[*testClient]string{a: "zhenghe", b: "xixi", c: "haha"} {
+		_ = cl.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: name})
+		cl.expect(t, "CHAT/1.0 OK\n")
+	}
+	b.makeGroup(t, "team", map[string]*testClient{"zhenghe": a})
+	b.makeGroup(t, "ops", map[string]*testClient{"haha": c})
+
+	cases := []struct {
+		cmd      protocol.Command
+		expected string
+	}{
+		{&protocol.ListCommand{Kind: protocol.ListUsers, Limit: 2}, "CHAT/1.0 NAMES USERS MORE haha xixi\n"},
+		{&protocol.ListCommand{Kind: protocol.ListUsers, Limit: 2, After: "xixi"}, "CHAT/1.0 NAMES USERS END zhenghe\n"},
+		{&protocol.ListCommand{Kind: protocol.ListGroups}, "CHAT/1.0 NAMES GROUPS END team\n"},
+		{&protocol.ListCommand{Kind: protocol.ListMembers, Group: "team"}, "CHAT/1.0 NAMES MEMBERS END xixi zhenghe\n"},
+		// the members of other groups are private
+		{&protocol.ListCommand{Kind: protocol.ListMembers, Group: "ops"}, "CHAT/1.0 ERROR NOT_MEMBER not a member\n"},
+		{&protocol.ListCommand{Kind: protocol.ListMembers, Group: "nope"}, "CHAT/1.0 ERROR NO_SUCH_GROUP no such group\n"},
+		{&protocol.WhoisCommand{User: "nobody"}, "CHAT/1.0 ERROR UNKNOWN_USER unknown user\n"},
+	}
+
+	for _, cs := range cases {
+		*cs.cmd.Base() = testBase
+		_ = a.writer.Write(cs.cmd)
+		a.expect(t, cs.expected)
+	}
+
+	whois := []struct {
+		user           string
+		expectedGroups []string
+	}{
+		{"xixi", []string{"team"}},
+		{"haha", nil},
+	}
+
+	for i, w := range whois {
+		_ = a.writer.Write(&protocol.WhoisCommand{BaseCommand: testBase, User: w.user})
+		cmd, err := a.reader.Read()
+		info, ok := cmd.(*protocol.UserInfoCommand)
+		if err != nil || !ok {
+			t.Fatalf("case %d: should have USERINFO got:%v, %v", i, cmd, err)
+		}
+		if info.User != w.user || info.State != protocol.PresenceOnline || info.Since == 0 ||
+			strings.Join(info.Groups, ",") != strings.Join(w.expectedGroups, ",") {
+			t.Errorf("case %d: should have %s online in %v got:%+v", i, w.user, w.expectedGroups, info)
+		}
+	}
+}
+
+func TestServerGroupRoles(t *testing.T) {
+	s := NewTcpChatServer()
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a, b, c := dial(t, addr), dial(t, addr), dial(t, addr)
+	defer a.conn.Close()
+	defer b.conn.Close()
+	defer c.conn.Close()
+
+	for cl, name := range map[*testClient]string{a: "zhenghe", b: "xixi", c: "haha"} {
+		_ = cl.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: name})
+		cl.expect(t, "CHAT/1.0 OK\n")
+	}
+	a.makeGroup(t, "team", map[string]*testClient{"xixi": b})
+
+	cases := []struct {
+		client   *testClient
+		cmd      protocol.Command
+		expected string
+		// notices start the lines the others get, in client order
+		notified []*testClient
+		notices  []string
+	}{
+		{b, &protocol.InviteCommand{Group: "team", User: "haha"}, "CHAT/1.0 ERROR NO_PERMISSION no permission\n", nil, nil},
+		{c, &protocol.JoinCommand{Group: "team"}, "CHAT/1.0 ERROR NOT_INVITED not invited\n", nil, nil},
+		{c, &protocol.BroadCastCommand{GroupName: "team", Data: []byte("hi")}, "CHAT/1.0 ERROR NOT_MEMBER not a member\n", nil, nil},
+		{
+			a, &protocol.PromoteCommand{Group: "team", User: "xixi", Role: protocol.RoleAdmin}, "CHAT/1.0 OK\n",
+			[]*testClient{b}, []string{"CHAT/1.0 NOTICE MEMBER_ROLE team xixi ADMIN zhenghe\n"},
+		},
+		{
+			b, &protocol.InviteCommand{Group: "team", User: "haha"}, "CHAT/1.0 OK\n",
+			[]*testClient{c}, []string{"CHAT/1.0 NOTICE INVITED team xixi "},
+		},
+		{b, &protocol.InviteCommand{Group: "team", User: "zhenghe"}, "CHAT/1.0 ERROR ALREADY_MEMBER already a member\n", nil, nil},
+		{
+			c, &protocol.JoinCommand{Group: "team"}, "CHAT/1.0 OK\n",
+			[]*testClient{a, b}, []string{"CHAT/1.0 NOTICE MEMBER_JOINED team haha\n", "CHAT/1.0 NOTICE MEMBER_JOINED team haha\n"},
+		},
+		{c, &protocol.JoinCommand{Group: "team"}, "CHAT/1.0 ERROR ALREADY_MEMBER already a member\n", nil, nil},
+		{c, &protocol.KickCommand{Group: "team", User: "xixi"}, "CHAT/1.0 ERROR NO_PERMISSION no permission\n", nil, nil},
+		{b, &protocol.KickCommand{Group: "team", User: "zhenghe"}, "CHAT/1.0 ERROR NO_PERMISSION no permission\n", nil, nil},
+		{
+			b, &protocol.KickCommand{Group: "team", User: "haha"}, "CHAT/1.0 OK\n",
+			[]*testClient{a, c}, []string{"CHAT/1.0 NOTICE MEMBER_KICKED team haha xixi\n", "CHAT/1.0 NOTICE MEMBER_KICKED team haha xixi\n"},
+		},
+		{
+			a, &protocol.LeaveCommand{GroupName: "team"}, "CHAT/1.0 OK\n",
+			[]*testClient{b, b}, []string{"CHAT/1.0 NOTICE MEMBER_LEFT team zhenghe\n", "CHAT/1.0 NOTICE MEMBER_ROLE team xixi OWNER zhenghe\n"},
+		},
+		{a, &protocol.GroupCommand{GroupName: "team"}, "CHAT/1.0 ERROR GROUP_EXISTS group exists\n", nil, nil},
+		{a, &protocol.GroupCommand{GroupName: "te\x00am"}, "CHAT/1.0 ERROR INVALID_NAME invalid name\n", nil, nil},
+		{a, &protocol.ChannelCommand{Name: "te\tam"}, "CHAT/1.0 ERROR INVALID_NAME invalid name\n", nil, nil},
+	}
+
+	for _, cs := range cases {
+		*cs.cmd.Base() = testBase
+		_ = cs.client.writer.Write(cs.cmd)
+		cs.client.expect(t, cs.expected)
+		for i, cl := range cs.notified {
+			cl.expectPrefix(t, cs.notices[i])
+		}
+	}
+}
+
+func TestServerChannels(t *testing.T) {
+	s := NewTcpChatServer()
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a, b := dial(t, addr), dial(t, addr)
+	defer a.conn.Close()
+	defer b.conn.Close()
+
+	for cl, name := range map[*testClient]string{a: "zhenghe", b: "haha"} {
+		_ = cl.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: name})
+		cl.expect(t, "CHAT/1.0 OK\n")
+	}
+
+	cases := []struct {
+		client   *testClient
+		cmd      protocol.Command
+		expected string
+		// notice is the line the other client gets, if any
+		notice string
+	}{
+		{a, &protocol.ChannelCommand{Name: "golang"}, "CHAT/1.0 OK\n", ""},
+		{a, &protocol.GroupCommand{GroupName: "secret"}, "CHAT/1.0 OK\n", ""},
+		{a, &protocol.ChannelCommand{Name: "secret"}, "CHAT/1.0 ERROR GROUP_EXISTS group exists\n", ""},
+		{a, &protocol.TopicCommand{Group: "golang", Topic: "release party"}, "CHAT/1.0 OK\n", ""},
+		// anyone finds and looks into a channel, but not a private group
+		{b, &protocol.ListCommand{Kind: protocol.ListChannels}, "CHAT/1.0 NAMES CHANNELS END golang\n", ""},
+		{b, &protocol.TopicCommand{Group: "golang"}, "CHAT/1.0 TOPIC golang release party\n", ""},
+		{b, &protocol.DescriptionCommand{Group: "golang"}, "CHAT/1.0 DESCRIPTION golang -\n", ""},
+		{b, &protocol.ListCommand{Kind: protocol.ListMembers, Group: "golang"}, "CHAT/1.0 NAMES MEMBERS END zhenghe\n", ""},
+		{b, &protocol.TopicCommand{Group: "secret"}, "CHAT/1.0 ERROR NOT_MEMBER not a member\n", ""},
+		{b, &protocol.JoinCommand{Group: "secret"}, "CHAT/1.0 ERROR NOT_INVITED not invited\n", ""},
+		{b, &protocol.JoinCommand{Group: "golang"}, "CHAT/1.0 OK\n", "CHAT/1.0 NOTICE MEMBER_JOINED golang haha\n"},
+		{b, &protocol.TopicCommand{Group: "golang", Topic: "mine now"}, "CHAT/1.0 ERROR NO_PERMISSION no permission\n", ""},
+		{
+			a, &protocol.DescriptionCommand{Group: "golang", Description: "all about go"}, "CHAT/1.0 OK\n",
+			"CHAT/1.0 NOTICE DESCRIPTION golang zhenghe all about go\n",
+		},
+		{a, &protocol.TopicCommand{Group: "golang", Topic: protocol.EmptyList}, "CHAT/1.0 OK\n", "CHAT/1.0 NOTICE TOPIC golang zhenghe\n"},
+		{b, &protocol.TopicCommand{Group: "golang"}, "CHAT/1.0 TOPIC golang -\n", ""},
+		{b, &protocol.LeaveCommand{GroupName: "golang"}, "CHAT/1.0 OK\n", "CHAT/1.0 NOTICE MEMBER_LEFT golang haha\n"},
+	}
+
+	for _, cs := range cases {
+		*cs.cmd.Base() = testBase
+		_ = cs.client.writer.Write(cs.cmd)
+		cs.client.expect(t, cs.expected)
+		if cs.notice != "" {
+			other := a
+			if cs.client == a {
+				other = b
+			}
+			other.expect(t, cs.notice)
+		}
+	}
+}
+
+func TestServerInvitations(t *testing.T) {
+	s := NewTcpChatServer()
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a, b := dial(t, addr), dial(t, addr)
+	defer a.conn.Close()
+	defer b.conn.Close()
+
+	for cl, name := range map[*testClient]string{a: "zhenghe", b: "haha"} {
+		_ = cl.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: name})
+		cl.expect(t, "CHAT/1.0 OK\n")
+	}
+
+	// haha is told right away, xixi once they log in
+	_ = a.writer.Write(&protocol.GroupCommand{BaseCommand: testBase, GroupName: "team", UserNames: []string{"xixi", "haha"}})
+	a.expect(t, "CHAT/1.0 OK\n")
+	b.expectPrefix(t, "CHAT/1.0 NOTICE INVITED team zhenghe ")
+
+	_ = b.writer.Write(&protocol.DeclineCommand{BaseCommand: testBase, Group: "team"})
+	b.expect(t, "CHAT/1.0 OK\n")
+	a.expect(t, "CHAT/1.0 NOTICE INVITE_DECLINED team haha\n")
+	_ = b.writer.Write(&protocol.AcceptCommand{BaseCommand: testBase, Group: "team"})
+	b.expect(t, "CHAT/1.0 ERROR NOT_INVITED not invited\n")
+
+	c := dial(t, addr)
+	defer c.conn.Close()
+	_ = c.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "xixi"})
+	c.expect(t, "CHAT/1.0 OK\n")
+	c.expectPrefix(t, "CHAT/1.0 NOTICE INVITED team zhenghe ")
+
+	_ = c.writer.Write(&protocol.AcceptCommand{BaseCommand: testBase, Group: "team"})
+	c.expect(t, "CHAT/1.0 OK\n")
+	a.expect(t, "CHAT/1.0 NOTICE MEMBER_JOINED team xixi\n")
+	_ = c.writer.Write(&protocol.AcceptCommand{BaseCommand: testBase, Group: "team"})
+	c.expect(t, "CHAT/1.0 ERROR ALREADY_MEMBER already a member\n")
+	_ = c.writer.Write(&protocol.DeclineCommand{BaseCommand: testBase, Group: "team"})
+	c.expect(t, "CHAT/1.0 ERROR NOT_INVITED not invited\n")
+}
+
+func TestServerModeration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moderation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/moderation"
+
+	s := NewTcpChatServer(WithOperators("zhenghe"), WithModerationFile(path))
+	addr, stop := startServer(t, s)
+
+	a, b, c, d := dial(t, addr), dial(t, addr), dial(t, addr), dial(t, addr)
+	defer a.conn.Close()
+	defer b.conn.Close()
+	defer c.conn.Close()
+	defer d.conn.Close()
+
+	for cl, name := range map[*testClient]string{a: "zhenghe", b: "xixi", c: "haha", d: "lala"} {
+		_ = cl.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: name})
+		cl.expect(t, "CHAT/1.0 OK\n")
+	}
+	a.makeGroup(t, "team", map[string]*testClient{"xixi": b, "haha": c})
+
+	cases := []struct {
+		client   *testClient
+		cmd      protocol.Command
+		expected string
+		// notices start the lines the others get, in client order
+		notified []*testClient
+		notices  []string
+	}{
+		{b, &protocol.MuteCommand{Target: "haha", Group: "team"}, "CHAT/1.0 ERROR NO_PERMISSION no permission\n", nil, nil},
+		{b, &protocol.MuteCommand{Target: "lala"}, "CHAT/1.0 ERROR NO_PERMISSION no permission\n", nil, nil},
+		// owning a group named like the server scope would moderate everyone
+		{b, &protocol.GroupCommand{GroupName: protocol.ScopeServer}, "CHAT/1.0 ERROR INVALID_NAME invalid name\n", nil, nil},
+		{b, &protocol.ChannelCommand{Name: protocol.ScopeServer}, "CHAT/1.0 ERROR INVALID_NAME invalid name\n", nil, nil},
+		{b, &protocol.BanCommand{Target: "lala", Group: protocol.ScopeServer}, "CHAT/1.0 ERROR NO_PERMISSION no permission\n", nil, nil},
+		// they'd break the moderation file
+		{a, &protocol.MuteCommand{Target: "lala\x00"}, "CHAT/1.0 ERROR INVALID_NAME invalid name\n", nil, nil},
+		{a, &protocol.BanCommand{Target: "la\tla", Group: "team"}, "CHAT/1.0 ERROR INVALID_NAME invalid name\n", nil, nil},
+		{a, &protocol.UnbanCommand{Target: "lala", Group: "te\tam"}, "CHAT/1.0 ERROR INVALID_NAME invalid name\n", nil, nil},
+		// it would overflow into the past
+		{a, &protocol.MuteCommand{Target: "lala", Duration: 10000000000}, "CHAT/1.0 ERROR INVALID_MESSAGE invalid message\n", nil, nil},
+		{a, &protocol.MuteCommand{Target: "zhenghe"}, "CHAT/1.0 ERROR NO_PERMISSION no permission\n", nil, nil},
+		{
+			a, &protocol.MuteCommand{Target: "haha", Duration: 600, Group: "team"}, "CHAT/1.0 OK\n",
+			[]*testClient{c}, []string{"CHAT/1.0 NOTICE MUTED team zhenghe "},
+		},
+		{c, &protocol.BroadCastCommand{GroupName: "team", Data: []byte("hi")}, "CHAT/1.0 ERROR MUTED muted\n", nil, nil},
+		{
+			a, &protocol.UnmuteCommand{Target: "haha", Group: "team"}, "CHAT/1.0 OK\n",
+			[]*testClient{c}, []string{"CHAT/1.0 NOTICE UNMUTED team zhenghe\n"},
+		},
+		{a, &protocol.UnmuteCommand{Target: "haha", Group: "team"}, "CHAT/1.0 OK\n", nil, nil},
+		{
+			a, &protocol.MuteCommand{Target: "lala"}, "CHAT/1.0 OK\n",
+			[]*testClient{d}, []string{"CHAT/1.0 NOTICE MUTED * zhenghe 0\n"},
+		},
+		{d, &protocol.SendCommand{Name: "zhenghe", Data: []byte("hi")}, "CHAT/1.0 ERROR MUTED muted\n", nil, nil},
+		{
+			a, &protocol.BanCommand{Target: "haha", Group: "team"}, "CHAT/1.0 OK\n",
+			[]*testClient{c, c, b}, []string{
+				"CHAT/1.0 NOTICE BANNED team zhenghe 0\n",
+				"CHAT/1.0 NOTICE MEMBER_KICKED team haha zhenghe\n",
+				"CHAT/1.0 NOTICE MEMBER_KICKED team haha zhenghe\n",
+			},
+		},
+		{a, &protocol.InviteCommand{Group: "team", User: "haha"}, "CHAT/1.0 ERROR BANNED banned\n", nil, nil},
+		{a, &protocol.DisconnectCommand{User: "nobody"}, "CHAT/1.0 ERROR UNKNOWN_USER unknown user\n", nil, nil},
+		{b, &protocol.DisconnectCommand{User: "haha"}, "CHAT/1.0 ERROR NO_PERMISSION no permission\n", nil, nil},
+		{
+			a, &protocol.DisconnectCommand{User: "haha"}, "CHAT/1.0 OK\n",
+			[]*testClient{c}, []string{"CHAT/1.0 NOTICE DISCONNECTED zhenghe\n"},
+		},
+		{
+			a, &protocol.BanCommand{Target: "lala", Duration: 3600}, "CHAT/1.0 OK\n",
+			[]*testClient{d}, []string{"CHAT/1.0 NOTICE BANNED * zhenghe "},
+		},
+	}
+
+	for _, cs := range cases {
+		*cs.cmd.Base() = testBase
+		_ = cs.client.writer.Write(cs.cmd)
+		cs.client.expect(t, cs.expected)
+		for i, cl := range cs.notified {
+			cl.expectPrefix(t, cs.notices[i])
+		}
+	}
+
+	for _, cl := range []*testClient{c, d} {
+		if cmd, err := cl.reader.Read(); err == nil {
+			t.Errorf("should have been disconnected got:%v", cmd)
+		}
+	}
+	stop()
+
+	// the ban outlives a restart
+	s = NewTcpChatServer(WithModerationFile(path))
+	addr, stop = startServer(t, s)
+	defer stop()
+
+	e := dial(t, addr)
+	defer e.conn.Close()
+	_ = e.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "lala"})
+	e.expect(t, "CHAT/1.0 ERROR BANNED banned\n")
+	_ = e.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "haha"})
+	e.expect(t, "CHAT/1.0 OK\n")
+}
+
+func TestServerRateLimit(t *testing.T) {
+	s := NewTcpChatServer(
+		WithMessageRateLimit(RateLimit{Rate: 0.001, Burst: 2}),
+		WithConnectionRateLimit(RateLimit{Rate: 0.001, Burst: 3}),
+		WithRateLimitStrikes(2, time.Minute),
+	)
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a, b := dial(t, addr), dial(t, addr)
+	defer a.conn.Close()
+	defer b.conn.Close()
+
+	for cl, name := range map[*testClient]string{a: "zhenghe", b: "xixi"} {
+		_ = cl.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: name})
+		cl.expect(t, "CHAT/1.0 OK\n")
+	}
+
+	// the IP is shared, so the limit of xixi is what zhenghe left over
+	_ = a.writer.Write(&protocol.SendCommand{BaseCommand: testBase, Name: "xixi", Data: []byte("hi")})
+	a.expect(t, "CHAT/1.0 OK\n")
+	b.expect(t, "CHAT/1.0 RECEIVE zhenghe hi\n")
+	_ = b.writer.Write(&protocol.SendCommand{BaseCommand: testBase, Name: "zhenghe", Data: []byte("hi")})
+	b.expect(t, "CHAT/1.0 OK\n")
+	a.expect(t, "CHAT/1.0 RECEIVE xixi hi\n")
+	_ = a.writer.Write(&protocol.SendCommand{BaseCommand: testBase, Name: "xixi", Data: []byte("hi")})
+	a.expect(t, "CHAT/1.0 ERROR RATE_LIMITED rate limited\n")
+	// other commands aren't limited
+	_ = a.writer.Write(&protocol.PingCommand{BaseCommand: testBase})
+	a.expect(t, "CHAT/1.0 PONG\n")
+
+	_ = a.writer.Write(&protocol.SendCommand{BaseCommand: testBase, Name: "xixi", Data: []byte("hi")})
+	a.expect(t, "CHAT/1.0 ERROR RATE_LIMITED rate limited\n")
+	a.expectPrefix(t, "CHAT/1.0 NOTICE RATE_LIMITED ")
+	if cmd, err := a.reader.Read(); err == nil {
+		t.Errorf("should have been disconnected got:%v", cmd)
+	}
+
+	// kept out, though the connection limit isn't reached
+	c := dial(t, addr)
+	defer c.conn.Close()
+	if cmd, err := c.reader.Read(); err == nil {
+		t.Errorf("should have been disconnected got:%v", cmd)
+	}
+}
+
+func TestServerLoginRateLimit(t *testing.T) {
+	s := NewTcpChatServer(
+		WithAuthenticator(NewMemoryAuthenticator(map[string]string{"xixi": "secret"})),
+		WithLoginRateLimit(RateLimit{Rate: 0.001, Burst: 2}),
+		WithRateLimitStrikes(3, time.Minute),
+	)
+	addr, stop := startServer(t, s)
+	defer stop()
+
+	a := dial(t, addr)
+	defer a.conn.Close()
+
+	// failures count as strikes
+	_ = a.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "xixi", Password: "guess"})
+	a.expect(t, "CHAT/1.0 ERROR AUTH_FAILED authentication failed\n")
+	_ = a.writer.Write(&protocol.ResumeCommand{BaseCommand: testBase, Token: "guess"})
+	a.expect(t, "CHAT/1.0 ERROR INVALID_SESSION invalid or expired session\n")
+	// the IP is out of tokens, the password isn't even checked
+	_ = a.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "xixi", Password: "secret"})
+	a.expect(t, "CHAT/1.0 ERROR RATE_LIMITED rate limited\n")
+	a.expectPrefix(t, "CHAT/1.0 NOTICE RATE_LIMITED ")
+	if cmd, err := a.reader.Read(); err == nil {
+		t.Errorf("should have been disconnected got:%v", cmd)
+	}
+
+	b := dial(t, addr)
+	defer b.conn.Close()
+	if cmd, err := b.reader.Read(); err == nil {
+		t.Errorf("should have been disconnected got:%v", cmd)
+	}
+}
+
+func TestServerMessageSize(t *testing.T) {
+	for _, policy := range []OversizePolicy{OversizeReply, OversizeDisconnect} {
+		s := NewTcpChatServer(WithMaxMessageSize(64, 16, policy))
+		addr, stop := startServer(t, s)
+
+		a := dial(t, addr)
+		_ = a.writer.Write(&protocol.LoginCommand{BaseCommand: testBase, Username: "zhenghe"})
+		a.expect(t, "CHAT/1.0 OK\n")
+
+		_ = a.writer.Write(&protocol.SendCommand{BaseCommand: testBase, Name: "xixi", Data: []byte(strings.Repeat("x", 100))})
+		a.expect(t, "CHAT/1.0 ERROR MESSAGE_TOO_LARGE message too large\n")
+		if policy == OversizeDisconnect {
+			if cmd, err := a.reader.Read(); err == nil {
+				t.Errorf("should have been disconnected got:%v", cmd)
+			}
+		} else {
+			_ = a.writer.Write(&protocol.SendCommand{BaseCommand: testBase, Name: "xixi", Data: []byte(strings.Repeat("x", 20))})
+			a.expect(t, "CHAT/1.0 ERROR MESSAGE_TOO_LARGE message too large\n")
+			// the rest of the line was skipped, the next one is read as is
+			_ = a.writer.Write(&protocol.PingCommand{BaseCommand: testBase})
+			a.expect(t, "CHAT/1.0 PONG\n")
+		}
+
+		_ = a.conn.Close()
+		stop()
+	}
+}